@@ -0,0 +1,97 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+  http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// Package ccerror is the error type shared by the chaincodes in this
+// repository. Every error a chaincode returns is serialized as the same JSON
+// object so client applications can branch on a stable code.
+package ccerror
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Code identifies the kind of failure. Codes never change once released.
+type Code string
+
+const (
+	NotFound        Code = "NOT_FOUND"
+	AlreadyExists   Code = "ALREADY_EXISTS"
+	InvalidArgument Code = "INVALID_ARGUMENT"
+	Forbidden       Code = "FORBIDDEN"
+	Conflict        Code = "CONFLICT"
+	Internal        Code = "INTERNAL"
+)
+
+// Error is a chaincode error. Field names the offending argument or field, if
+// any, and TxId is the transaction the error happened in, for correlation
+// with peer logs.
+type Error struct {
+	Code    Code        `json:"code"`
+	Message string      `json:"message"`
+	Field   string      `json:"field,omitempty"`
+	TxId    string      `json:"txId,omitempty"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// Error returns the JSON form of the error
+func (e *Error) Error() string {
+	jsonAsBytes, _ := json.Marshal(e)
+	return string(jsonAsBytes)
+}
+
+// New builds an error with a formatted message
+func New(code Code, field string, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Field: field, Message: fmt.Sprintf(format, args...)}
+}
+
+// IncorrectArgs reports a call with the wrong number of arguments
+func IncorrectArgs(expecting string) *Error {
+	return New(InvalidArgument, "args", "Incorrect number of arguments. Expecting %s", expecting)
+}
+
+// WithDetails returns a copy of the error carrying extra structured detail
+func (e *Error) WithDetails(details interface{}) *Error {
+	withDetails := *e
+	withDetails.Details = details
+	return &withDetails
+}
+
+// WithTx stamps an error with the transaction id. Errors that are not an
+// *Error, such as those returned by the shim, become INTERNAL errors.
+func WithTx(err error, txId string) error {
+	if err == nil {
+		return nil
+	}
+
+	ccErr, ok := err.(*Error)
+	if !ok {
+		return &Error{Code: Internal, Message: err.Error(), TxId: txId}
+	}
+
+	stamped := *ccErr
+	stamped.TxId = txId
+	return &stamped
+}
+
+// CodeOf returns the code of an error, INTERNAL when it is not an *Error
+func CodeOf(err error) Code {
+	if ccErr, ok := err.(*Error); ok {
+		return ccErr.Code
+	}
+	return Internal
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+// Roles an invoker can hold. The role and id are read from the attributes of
+// the caller's transaction certificate.
+const (
+	RoleCustomer    = "customer"
+	RoleInstitution = "institution"
+	RoleVerifier    = "verifier"
+	RoleRegulator   = "regulator"
+	RoleAdmin       = "admin"
+)
+
+// Certificate attributes the invoker identity is derived from
+const roleAttribute = "role"
+const idAttribute = "id"
+
+// Invoker is the identity behind the current transaction
+type Invoker struct {
+	Id   string `json:"id"`
+	Role string `json:"role"`
+}
+
+// accessRule lists the roles allowed to call a function. Customers are only
+// let through when owner resolves to their own person id, and institutions
+// when recipient resolves to their own institution id. Requests addressed to
+// no institution are left to admins. Institutions only change the person
+// subject resolves to when it is new or related to them, see
+// checkInstitutionRelation.
+type accessRule struct {
+	Roles     []string
+	Owner     func(kyc *KYCChaincode, stub shim.ChaincodeStubInterface, args []string) (string, error)
+	Recipient func(kyc *KYCChaincode, stub shim.ChaincodeStubInterface, args []string) (string, error)
+	Subject   func(kyc *KYCChaincode, stub shim.ChaincodeStubInterface, args []string) (string, error)
+}
+
+var accessRules = map[string]accessRule{
+	"init":                     {Roles: []string{RoleAdmin}},
+	"createPerson":             {Roles: []string{RoleCustomer, RoleInstitution, RoleAdmin}, Owner: personArg(0), Subject: personArg(0)},
+	"updateInfoElement":        {Roles: []string{RoleCustomer, RoleInstitution, RoleAdmin}, Owner: personArg(0), Subject: personArg(0)},
+	"updateInfoElements":       {Roles: []string{RoleCustomer, RoleInstitution, RoleAdmin}, Owner: personArg(0), Subject: personArg(0)},
+	"verifyInfoElement":        {Roles: []string{RoleVerifier}},
+	"deleteInfoElement":        {Roles: []string{RoleCustomer, RoleInstitution, RoleAdmin}, Owner: personArg(0), Subject: personArg(0)},
+	"deletePerson":             {Roles: []string{RoleCustomer, RoleAdmin}, Owner: personArg(0)},
+	"erasePerson":              {Roles: []string{RoleCustomer, RoleAdmin}, Owner: personArg(0)},
+	"registerPersonKey":        {Roles: []string{RoleCustomer, RoleAdmin}, Owner: personArg(0)},
+	"rotatePersonKey":          {Roles: []string{RoleAdmin}},
+	"saveRequestState":         {Roles: []string{RoleCustomer, RoleInstitution, RoleAdmin}, Owner: personArg(1), Subject: personArg(1)},
+	"migrateSubmittedRequests": {Roles: []string{RoleAdmin}},
+	"migrateLegacyPersons":     {Roles: []string{RoleAdmin}},
+	"startReview":              {Roles: []string{RoleInstitution, RoleAdmin}, Recipient: requestInstitutionArg(0)},
+	"approveRequest":           {Roles: []string{RoleInstitution, RoleAdmin}, Recipient: requestInstitutionArg(0)},
+	"rejectRequest":            {Roles: []string{RoleInstitution, RoleAdmin}, Recipient: requestInstitutionArg(0)},
+	"requestInfo":              {Roles: []string{RoleInstitution, RoleAdmin}, Recipient: requestInstitutionArg(0)},
+	"resubmitRequest":          {Roles: []string{RoleCustomer, RoleInstitution, RoleAdmin}, Owner: requestOwnerArg(0), Recipient: requestInstitutionArg(0)},
+	"withdrawRequest":          {Roles: []string{RoleCustomer, RoleInstitution, RoleAdmin}, Owner: requestOwnerArg(0), Recipient: requestInstitutionArg(0)},
+	"expireRequest":            {Roles: []string{RoleInstitution, RoleAdmin}, Recipient: requestInstitutionArg(0)},
+	"grantConsent":             {Roles: []string{RoleCustomer, RoleAdmin}, Owner: personArg(0)},
+	"revokeConsent":            {Roles: []string{RoleCustomer, RoleAdmin}, Owner: personArg(0)},
+	"sweepExpired":             {Roles: []string{RoleAdmin}},
+	"registerElementType":      {Roles: []string{RoleAdmin}},
+	"removeElementType":        {Roles: []string{RoleAdmin}},
+	"setRiskConfig":            {Roles: []string{RoleAdmin}},
+	"computeRiskScore":         {Roles: []string{RoleInstitution, RoleAdmin}},
+	"loadWatchList":            {Roles: []string{RoleAdmin}},
+	"updateWatchList":          {Roles: []string{RoleAdmin}},
+	"clearAlert":               {Roles: []string{RoleInstitution, RoleAdmin}, Recipient: requestInstitutionArg(0)},
+	"registerInstitution":      {Roles: []string{RoleAdmin}},
+	"updateInstitution":        {Roles: []string{RoleAdmin}},
+	"setFeeSchedule":           {Roles: []string{RoleAdmin}},
+	"registerVerifier":         {Roles: []string{RoleAdmin}},
+	"updateVerifier":           {Roles: []string{RoleAdmin}},
+	"queryPerson":              {Roles: []string{RoleCustomer, RoleInstitution, RoleVerifier, RoleRegulator, RoleAdmin}, Owner: personArg(0)},
+	"queryInfoElement":         {Roles: []string{RoleCustomer, RoleInstitution, RoleVerifier, RoleRegulator, RoleAdmin}, Owner: personArg(0)},
+	"queryRequestState":        {Roles: []string{RoleCustomer, RoleInstitution, RoleVerifier, RoleRegulator, RoleAdmin}, Owner: requestOwnerArg(0), Recipient: requestInstitutionArg(0)},
+	"queryRequestsByPerson":    {Roles: []string{RoleCustomer, RoleInstitution, RoleRegulator, RoleAdmin}, Owner: personArg(0)},
+	"verifyInfoElementValue":   {Roles: []string{RoleCustomer, RoleInstitution, RoleVerifier, RoleRegulator, RoleAdmin}, Owner: personArg(0)},
+	"verifyInfoElementHash":    {Roles: []string{RoleCustomer, RoleInstitution, RoleVerifier, RoleRegulator, RoleAdmin}, Owner: personArg(0)},
+	"queryExpiringElements":    {Roles: []string{RoleInstitution, RoleRegulator, RoleAdmin}},
+	"queryPersonHistory":       {Roles: []string{RoleCustomer, RoleRegulator, RoleAdmin}, Owner: personArg(0)},
+	"queryErasureReceipt":      {Roles: []string{RoleCustomer, RoleRegulator, RoleAdmin}, Owner: personArg(0)},
+	"queryInfoElementHistory":  {Roles: []string{RoleCustomer, RoleRegulator, RoleAdmin}, Owner: personArg(0)},
+	"queryPersonsByElement":    {Roles: []string{RoleInstitution, RoleVerifier, RoleRegulator, RoleAdmin}},
+	"listPersons":              {Roles: []string{RoleRegulator, RoleAdmin}},
+	"listRequests":             {Roles: []string{RoleRegulator, RoleAdmin}},
+	"queryElementTypes":        {Roles: []string{RoleCustomer, RoleInstitution, RoleVerifier, RoleRegulator, RoleAdmin}},
+	"queryRequestVersions":     {Roles: []string{RoleCustomer, RoleInstitution, RoleRegulator, RoleAdmin}, Owner: requestOwnerArg(0), Recipient: requestInstitutionArg(0)},
+	"queryMigrationReport":     {Roles: []string{RoleRegulator, RoleAdmin}},
+	"queryRiskConfig":          {Roles: []string{RoleInstitution, RoleRegulator, RoleAdmin}},
+	"queryRiskAssessment":      {Roles: []string{RoleInstitution, RoleRegulator, RoleAdmin}},
+	"queryWatchList":           {Roles: []string{RoleInstitution, RoleRegulator, RoleAdmin}},
+	"queryInstitution":         {Roles: []string{RoleCustomer, RoleInstitution, RoleVerifier, RoleRegulator, RoleAdmin}},
+	"listInstitutions":         {Roles: []string{RoleCustomer, RoleInstitution, RoleVerifier, RoleRegulator, RoleAdmin}},
+	"queryInbox":               {Roles: []string{RoleInstitution}},
+	"queryVerifier":            {Roles: []string{RoleCustomer, RoleInstitution, RoleVerifier, RoleRegulator, RoleAdmin}},
+	"listVerifiers":            {Roles: []string{RoleCustomer, RoleInstitution, RoleVerifier, RoleRegulator, RoleAdmin}},
+	"queryFeeSchedule":         {Roles: []string{RoleCustomer, RoleInstitution, RoleVerifier, RoleRegulator, RoleAdmin}},
+	"listConsents":             {Roles: []string{RoleCustomer, RoleInstitution, RoleRegulator, RoleAdmin}, Owner: personArg(0)},
+
+	// Decrypting variants are open to the same callers as the plain queries;
+	// only holders of the person's keys get clear values out of them
+	"queryPersonDecrypted":      {Roles: []string{RoleCustomer, RoleInstitution, RoleVerifier, RoleRegulator, RoleAdmin}, Owner: personArg(0)},
+	"queryInfoElementDecrypted": {Roles: []string{RoleCustomer, RoleInstitution, RoleVerifier, RoleRegulator, RoleAdmin}, Owner: personArg(0)},
+}
+
+// Reads the invoker's role and id from the caller certificate
+func getInvoker(stub shim.ChaincodeStubInterface) (Invoker, error) {
+	role, err := stub.ReadCertAttribute(roleAttribute)
+	if err != nil {
+		return Invoker{}, ccerror.New(ccerror.Forbidden, "", "Failed to read role attribute from caller certificate: %s", err.Error())
+	}
+	if !isKnownRole(string(role)) {
+		return Invoker{}, ccerror.New(ccerror.Forbidden, "", "Caller certificate has unknown role %s", string(role))
+	}
+
+	id, err := stub.ReadCertAttribute(idAttribute)
+	if err != nil {
+		return Invoker{}, ccerror.New(ccerror.Forbidden, "", "Failed to read id attribute from caller certificate: %s", err.Error())
+	}
+	if len(id) == 0 {
+		return Invoker{}, ccerror.New(ccerror.Forbidden, "", "Caller certificate has no id attribute")
+	}
+
+	return Invoker{Id: string(id), Role: string(role)}, nil
+}
+
+// Checks the invoker against the access rule of a function
+func (kyc *KYCChaincode) authorize(stub shim.ChaincodeStubInterface, function string, args []string) error {
+	rule, ok := accessRules[function]
+	if !ok {
+		return ccerror.New(ccerror.InvalidArgument, "function", "Received unknown function invocation")
+	}
+
+	invoker, err := getInvoker(stub)
+	if err != nil {
+		return err
+	}
+
+	if !hasRole(rule.Roles, invoker.Role) {
+		return ccerror.New(ccerror.Forbidden, "", "Role %s is not allowed to call %s", invoker.Role, function)
+	}
+
+	if invoker.Role == RoleCustomer && rule.Owner != nil {
+		owner, err := rule.Owner(kyc, stub, args)
+		if err != nil {
+			return err
+		}
+		if owner != invoker.Id {
+			return ccerror.New(ccerror.Forbidden, "", "Customer %s may only call %s on their own records", invoker.Id, function)
+		}
+	}
+
+	if invoker.Role == RoleInstitution && rule.Recipient != nil {
+		recipient, err := rule.Recipient(kyc, stub, args)
+		if err != nil {
+			return err
+		}
+		if recipient != invoker.Id {
+			return ccerror.New(ccerror.Forbidden, "", "Institution %s may only call %s on requests addressed to it", invoker.Id, function)
+		}
+	}
+
+	if invoker.Role == RoleInstitution && rule.Subject != nil {
+		subject, err := rule.Subject(kyc, stub, args)
+		if err != nil {
+			return err
+		}
+		err = kyc.checkInstitutionRelation(stub, subject, invoker.Id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Checks that an institution may change the data of a person. Institutions
+// may create persons, and otherwise need a consent in force granted to them
+// or an open request of the person addressed to them.
+func (kyc *KYCChaincode) checkInstitutionRelation(stub shim.ChaincodeStubInterface, personId string, institutionId string) error {
+	person, err := kyc.getPerson(stub, personId)
+	if err != nil || person == nil {
+		return err
+	}
+
+	now, err := getTxTime(stub)
+	if err != nil {
+		return err
+	}
+	consents, err := kyc.getConsents(stub, personId)
+	if err != nil {
+		return err
+	}
+	for _, consent := range consents {
+		if consent.InstitutionId == institutionId && consent.isActive(now) {
+			return nil
+		}
+	}
+
+	requestKeys, err := rangeKeys(stub, requestByPersonObjectType, []string{personId})
+	if err != nil {
+		return err
+	}
+	for _, requestKey := range requestKeys {
+		_, keyParts, err := splitCompositeKey(requestKey)
+		if err != nil {
+			return err
+		}
+		request, err := kyc.getRequest(stub, keyParts[1])
+		if err != nil {
+			return err
+		}
+		if request != nil && request.InstitutionId == institutionId && len(requestTransitions[request.currentStatus()]) > 0 {
+			return nil
+		}
+	}
+
+	return ccerror.New(ccerror.Forbidden, "", "Institution %s has no consent or open request of person %s", institutionId, personId)
+}
+
+// Resolves the owner as the person id found at the given argument position
+func personArg(index int) func(*KYCChaincode, shim.ChaincodeStubInterface, []string) (string, error) {
+	return func(kyc *KYCChaincode, stub shim.ChaincodeStubInterface, args []string) (string, error) {
+		if len(args) <= index {
+			return "", nil
+		}
+		return args[index], nil
+	}
+}
+
+// Resolves the owner as the person of the request found at the given argument position
+func requestOwnerArg(index int) func(*KYCChaincode, shim.ChaincodeStubInterface, []string) (string, error) {
+	return func(kyc *KYCChaincode, stub shim.ChaincodeStubInterface, args []string) (string, error) {
+		if len(args) <= index {
+			return "", nil
+		}
+		request, err := kyc.getRequest(stub, args[index])
+		if err != nil || request == nil {
+			return "", err
+		}
+		return request.Person.Id, nil
+	}
+}
+
+// Resolves the recipient as the institution the request found at the given
+// argument position is addressed to
+func requestInstitutionArg(index int) func(*KYCChaincode, shim.ChaincodeStubInterface, []string) (string, error) {
+	return func(kyc *KYCChaincode, stub shim.ChaincodeStubInterface, args []string) (string, error) {
+		if len(args) <= index {
+			return "", nil
+		}
+		request, err := kyc.getRequest(stub, args[index])
+		if err != nil || request == nil {
+			return "", err
+		}
+		return request.InstitutionId, nil
+	}
+}
+
+func isKnownRole(role string) bool {
+	return hasRole([]string{RoleCustomer, RoleInstitution, RoleVerifier, RoleRegulator, RoleAdmin}, role)
+}
+
+func hasRole(roles []string, role string) bool {
+	for _, allowed := range roles {
+		if allowed == role {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+func TestUnknownRoleIsForbidden(t *testing.T) {
+	stub := newTestStub(t)
+
+	_, err := stub.as("superuser", "eve").invoke("createPerson", "eve")
+	expectCode(t, err, ccerror.Forbidden)
+	_, err = stub.as("", "eve").query("queryElementTypes")
+	expectCode(t, err, ccerror.Forbidden)
+}
+
+func TestRolesNotInTheRuleAreForbidden(t *testing.T) {
+	stub := newTestStub(t)
+	stub.as(RoleCustomer, "c1").mustInvoke("createPerson", "c1")
+
+	denied := []struct {
+		role     string
+		function string
+		args     []string
+	}{
+		{RoleCustomer, "init", nil},
+		{RoleCustomer, "registerInstitution", []string{"{}"}},
+		{RoleInstitution, "deletePerson", []string{"c1"}},
+		{RoleVerifier, "updateInfoElement", []string{"c1", "{}"}},
+		{RoleRegulator, "createPerson", []string{"c2"}},
+		{RoleInstitution, "registerVerifier", []string{"{}"}},
+	}
+	for _, call := range denied {
+		_, err := stub.as(call.role, "x").invoke(call.function, call.args...)
+		expectCode(t, err, ccerror.Forbidden)
+	}
+
+	_, err := stub.as(RoleCustomer, "c1").query("listPersons", "10", "")
+	expectCode(t, err, ccerror.Forbidden)
+}
+
+func TestCustomersOnlyReachTheirOwnRecords(t *testing.T) {
+	stub := newTestStub(t)
+	stub.as(RoleCustomer, "c1").mustInvoke("createPerson", "c1")
+	stub.as(RoleCustomer, "c2").mustInvoke("createPerson", "c2")
+	stub.registerInstitution("bank1")
+	stub.as(RoleCustomer, "c1").mustInvoke("saveRequestState", "r1", "c1", "bank1")
+
+	stub.as(RoleCustomer, "c2")
+	_, err := stub.query("queryPerson", "c1")
+	expectCode(t, err, ccerror.Forbidden)
+	_, err = stub.invoke("deletePerson", "c1")
+	expectCode(t, err, ccerror.Forbidden)
+	_, err = stub.invoke("saveRequestState", "r2", "c1", "bank1")
+	expectCode(t, err, ccerror.Forbidden)
+	_, err = stub.invoke("withdrawRequest", "r1", "")
+	expectCode(t, err, ccerror.Forbidden)
+	_, err = stub.query("queryRequestState", "r1")
+	expectCode(t, err, ccerror.Forbidden)
+
+	stub.as(RoleCustomer, "c1")
+	person := Person{}
+	stub.mustQuery(&person, "queryPerson", "c1")
+	if person.Id != "c1" {
+		t.Errorf("queryPerson returned %s", person.Id)
+	}
+	stub.mustInvoke("withdrawRequest", "r1", "")
+	stub.mustInvoke("deletePerson", "c1")
+}
+
+func TestInstitutionsOnlyReachRequestsAddressedToThem(t *testing.T) {
+	stub := newTestStub(t)
+	stub.registerInstitution("bank1")
+	stub.registerInstitution("bank2")
+	stub.as(RoleCustomer, "c1").mustInvoke("createPerson", "c1")
+	stub.mustInvoke("saveRequestState", "r1", "c1", "bank1")
+
+	stub.as(RoleInstitution, "bank2")
+	for _, function := range []string{"startReview", "rejectRequest", "withdrawRequest", "expireRequest"} {
+		_, err := stub.invoke(function, "r1", "")
+		expectCode(t, err, ccerror.Forbidden)
+	}
+	_, err := stub.invoke("clearAlert", "r1", "alert-1", "false positive")
+	expectCode(t, err, ccerror.Forbidden)
+	_, err = stub.query("queryRequestState", "r1")
+	expectCode(t, err, ccerror.Forbidden)
+
+	stub.as(RoleInstitution, "bank1").mustInvoke("startReview", "r1", "")
+	stub.mustInvoke("approveRequest", "r1", "")
+}
+
+func TestRequestsWithoutInstitutionAreLeftToAdmins(t *testing.T) {
+	stub := newTestStub(t)
+	stub.registerInstitution("bank1")
+	stub.as(RoleCustomer, "c1").mustInvoke("createPerson", "c1")
+	stub.mustInvoke("saveRequestState", "r1", "c1")
+
+	stub.as(RoleInstitution, "bank1")
+	for _, function := range []string{"startReview", "approveRequest", "rejectRequest", "requestInfo", "expireRequest"} {
+		_, err := stub.invoke(function, "r1", "")
+		expectCode(t, err, ccerror.Forbidden)
+	}
+	_, err := stub.invoke("clearAlert", "r1", "alert-1", "false positive")
+	expectCode(t, err, ccerror.Forbidden)
+	_, err = stub.query("queryRequestState", "r1")
+	expectCode(t, err, ccerror.Forbidden)
+
+	stub.as(RoleAdmin, "admin").mustInvoke("startReview", "r1", "")
+	stub.mustInvoke("approveRequest", "r1", "")
+}
+
+func TestOnlyRegisteredVerifiersVerify(t *testing.T) {
+	stub := newTestStub(t)
+	stub.registerElementType("PASSPORT")
+	stub.registerElementType("ADDRESS")
+	stub.as(RoleCustomer, "c1").mustInvoke("createPerson", "c1")
+	stub.mustInvoke("updateInfoElement", "c1", jsonArg(InfoElement{Id: "e1", ElementType: "PASSPORT", ElementValue: "X1"}))
+	stub.mustInvoke("updateInfoElement", "c1", jsonArg(InfoElement{Id: "e2", ElementType: "ADDRESS", ElementValue: "Main St"}))
+
+	_, err := stub.as(RoleCustomer, "c1").invoke("verifyInfoElement", "c1", "e1", ElementStatusVerified, "proof")
+	expectCode(t, err, ccerror.Forbidden)
+	_, err = stub.as(RoleVerifier, "v1").invoke("verifyInfoElement", "c1", "e1", ElementStatusVerified, "proof")
+	expectCode(t, err, ccerror.Forbidden)
+
+	stub.registerVerifier("v1", "PASSPORT")
+	_, err = stub.invoke("verifyInfoElement", "c1", "e2", ElementStatusVerified, "proof")
+	expectCode(t, err, ccerror.Forbidden)
+	stub.mustInvoke("verifyInfoElement", "c1", "e1", ElementStatusVerified, "proof")
+
+	verified := findInfoElement(stub.person("c1"), "e1")
+	if verified.Status != ElementStatusVerified || verified.VerifiedBy != "v1" || verified.VerificationProof != "proof" {
+		t.Errorf("verified element = %+v", *verified)
+	}
+
+	stub.as(RoleAdmin, "admin").mustInvoke("updateVerifier", jsonArg(Verifier{Id: "v1", DisplayName: "v1", Status: VerifierStatusSuspended}))
+	_, err = stub.as(RoleVerifier, "v1").invoke("verifyInfoElement", "c1", "e2", ElementStatusVerified, "proof")
+	expectCode(t, err, ccerror.Forbidden)
+}
+
+func TestInstitutionsOnlyChangeRelatedPersons(t *testing.T) {
+	stub := newTestStub(t)
+	createConsentingPerson(stub)
+	stub.registerInstitution("bank1")
+	stub.registerInstitution("bank2")
+	stub.mustInvoke("grantConsent", "c1", jsonArg(Consent{Id: "k1", InstitutionId: "bank1", ElementTypes: []string{"PASSPORT"}, Purpose: "onboarding", ExpiresOn: "2026-06-01"}))
+
+	stub.as(RoleInstitution, "bank2")
+	for _, call := range [][]string{
+		{"createPerson", "c1", "upsert"},
+		{"updateInfoElement", "c1", jsonArg(InfoElement{Id: "e1", ElementType: "PASSPORT", ElementValue: "X9"})},
+		{"updateInfoElements", "c1", jsonArg(map[string]interface{}{"elements": []InfoElement{}})},
+		{"deleteInfoElement", "c1", "e1"},
+		{"saveRequestState", "r1", "c1", "bank2"},
+	} {
+		_, err := stub.invoke(call[0], call[1:]...)
+		expectCode(t, err, ccerror.Forbidden)
+	}
+	stub.mustInvoke("createPerson", "c2")
+
+	stub.as(RoleInstitution, "bank1").mustInvoke("updateInfoElement", "c1", jsonArg(InfoElement{Id: "e1", ElementType: "PASSPORT", ElementValue: "X2"}))
+	stub.mustInvoke("saveRequestState", "r1", "c1", "bank1")
+
+	// An open request addressed to the institution relates it to the person
+	// after the consent is revoked, until the request is closed
+	stub.as(RoleCustomer, "c1").mustInvoke("revokeConsent", "c1", "k1")
+	stub.as(RoleInstitution, "bank1").mustInvoke("deleteInfoElement", "c1", "e1")
+	stub.mustInvoke("startReview", "r1", "")
+	stub.mustInvoke("rejectRequest", "r1", "")
+	_, err := stub.invoke("deleteInfoElement", "c1", "e2")
+	expectCode(t, err, ccerror.Forbidden)
+}
+
+func TestVerifiersOnlyReadRequestsTheyCanVerify(t *testing.T) {
+	stub := newTestStub(t)
+	createConsentingPerson(stub)
+	stub.mustInvoke("saveRequestState", "r1", "c1")
+	stub.registerVerifier("v1", "PASSPORT")
+	stub.registerVerifier("v2", "DOB")
+
+	_, err := stub.as(RoleVerifier, "v0").query("queryRequestState", "r1")
+	expectCode(t, err, ccerror.Forbidden)
+	_, err = stub.as(RoleVerifier, "v2").query("queryRequestState", "r1")
+	expectCode(t, err, ccerror.Forbidden)
+
+	request := SubmittedRequest{}
+	stub.as(RoleVerifier, "v1").mustQuery(&request, "queryRequestState", "r1")
+	if ids := elementIds(request.Person); len(ids) != 1 || ids[0] != "e1" {
+		t.Errorf("v1 read elements %v, expected [e1]", ids)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+// Upper bound on elements plus deletions in one batch, to keep the Person
+// write and the validation work of a single transaction bounded
+const maxBatchSize = 100
+
+// Actions reported for the entries of a batch
+const (
+	BatchActionUpdated = "UPDATED"
+	BatchActionDeleted = "DELETED"
+)
+
+// InfoElementBatch is the argument of updateInfoElements. Elements are kept
+// raw so a malformed entry is reported against its own index.
+type InfoElementBatch struct {
+	Elements  []json.RawMessage `json:"elements"`
+	Deletions []string          `json:"deletions"`
+}
+
+// BatchResult is the outcome of one entry of a batch. Error is set on the
+// entries that failed; when any entry fails nothing is written.
+type BatchResult struct {
+	Index     int            `json:"index"`
+	ElementId string         `json:"elementId"`
+	Action    string         `json:"action"`
+	Error     *ccerror.Error `json:"error,omitempty"`
+}
+
+// Applies several InfoElement updates and deletions to one person and writes
+// the Person key once. Either every entry applies or none does: on failure the
+// returned INVALID_ARGUMENT error carries the results of all entries.
+func (kyc *KYCChaincode) updateInfoElements(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: updateInfoElements called")
+
+	if len(args) != 2 && len(args) != 3 {
+		return nil, ccerror.IncorrectArgs("2 or 3")
+	}
+
+	upsert, err := parseUpsert(args, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	batch := InfoElementBatch{}
+	err = json.Unmarshal([]byte(args[1]), &batch)
+	if err != nil {
+		return nil, ccerror.New(ccerror.InvalidArgument, "batch", "Failed to unmarshal batch: %s", err.Error())
+	}
+	if len(batch.Elements)+len(batch.Deletions) == 0 {
+		return nil, ccerror.New(ccerror.InvalidArgument, "batch", "Batch has no elements or deletions")
+	}
+	if len(batch.Elements)+len(batch.Deletions) > maxBatchSize {
+		return nil, ccerror.New(ccerror.InvalidArgument, "batch", "Batch has more than %d entries", maxBatchSize)
+	}
+
+	storedPerson, err := kyc.getPerson(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if storedPerson == nil && !upsert {
+		return nil, personNotFound(args[0])
+	}
+	created := storedPerson == nil
+	if created {
+		storedPerson = &Person{Id: args[0], InfoElements: []InfoElement{}}
+	}
+	person := *storedPerson
+
+	results := []BatchResult{}
+	failed := false
+	seen := map[string]bool{}
+	updatedIds := []string{}
+
+	for i, rawElement := range batch.Elements {
+		result := BatchResult{Index: i, Action: BatchActionUpdated}
+
+		infoElement, err := kyc.applyBatchElement(stub, &person, rawElement, seen)
+		result.ElementId = infoElement.Id
+		if err != nil {
+			result.Error = asBatchError(err)
+			failed = true
+		} else {
+			updatedIds = append(updatedIds, infoElement.Id)
+		}
+		results = append(results, result)
+	}
+
+	for i, elementId := range batch.Deletions {
+		result := BatchResult{Index: len(batch.Elements) + i, ElementId: elementId, Action: BatchActionDeleted}
+
+		if seen[elementId] {
+			err = ccerror.New(ccerror.InvalidArgument, "elementId", "InfoElement %s appears more than once in the batch", elementId)
+		} else {
+			seen[elementId] = true
+			err = removeInfoElement(&person, elementId)
+		}
+		if err != nil {
+			result.Error = asBatchError(err)
+			failed = true
+		}
+		results = append(results, result)
+	}
+
+	if failed {
+		return nil, ccerror.New(ccerror.InvalidArgument, "batch", "Batch was not applied, see details for the failing entries").WithDetails(results)
+	}
+
+	err = kyc.putPerson(stub, person)
+	if err != nil {
+		return nil, err
+	}
+
+	event := KYCEvent{
+		Type:       EventInfoElementsUpdated,
+		PersonId:   person.Id,
+		ElementIds: updatedIds,
+		DeletedIds: batch.Deletions,
+	}
+	if created {
+		event.Type = EventPersonCreated
+	}
+	err = emitEvent(stub, event)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("CHAINCODE: Returning from updateInfoElements")
+
+	return json.Marshal(results)
+}
+
+// Unmarshals and validates one batch entry and puts it on the person
+func (kyc *KYCChaincode) applyBatchElement(stub shim.ChaincodeStubInterface, person *Person, rawElement json.RawMessage, seen map[string]bool) (InfoElement, error) {
+	infoElement := InfoElement{}
+	err := json.Unmarshal(rawElement, &infoElement)
+	if err != nil {
+		return infoElement, ccerror.New(ccerror.InvalidArgument, "infoElement", "Failed to unmarshal infoElement: %s", err.Error())
+	}
+	if infoElement.Id != "" && seen[infoElement.Id] {
+		return infoElement, ccerror.New(ccerror.InvalidArgument, "elementId", "InfoElement %s appears more than once in the batch", infoElement.Id)
+	}
+	seen[infoElement.Id] = true
+
+	privateValue, err := applyPrivateValue(&infoElement)
+	if err != nil {
+		return infoElement, err
+	}
+
+	return kyc.applyInfoElement(stub, person, infoElement, privateValue)
+}
+
+// Per-entry errors are reported inline, so shim failures are wrapped the same
+// way the Invoke entry point would wrap them
+func asBatchError(err error) *ccerror.Error {
+	if ccErr, ok := err.(*ccerror.Error); ok {
+		return ccErr
+	}
+	return ccerror.New(ccerror.Internal, "", "%s", err.Error())
+}
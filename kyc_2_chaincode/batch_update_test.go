@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+// Decodes the per-entry results carried by a failed batch
+func batchErrors(t *testing.T, err error) []BatchResult {
+	t.Helper()
+	expectCode(t, err, ccerror.InvalidArgument)
+	results := []BatchResult{}
+	detailsAsJSON, _ := json.Marshal(err.(*ccerror.Error).Details)
+	json.Unmarshal(detailsAsJSON, &results)
+	return results
+}
+
+func TestBatchAppliesAllOrNothing(t *testing.T) {
+	stub := newTestStub(t)
+	createConsentingPerson(stub)
+
+	_, err := stub.invoke("updateInfoElements", "c1", jsonArg(map[string]interface{}{
+		"elements":  []InfoElement{{Id: "e3", ElementType: "PASSPORT", ElementValue: "X3"}, {Id: "e4", ElementType: "UNKNOWN"}},
+		"deletions": []string{"e1"},
+	}))
+	results := batchErrors(t, err)
+	if len(results) != 3 || results[0].Error != nil || results[1].Error == nil || results[1].ElementId != "e4" || results[2].Error != nil {
+		t.Errorf("results = %+v", results)
+	}
+	if ids := elementIds(storedPerson(stub, "c1")); len(ids) != 2 || ids[0] != "e1" || ids[1] != "e2" {
+		t.Errorf("failed batch changed the person to %v", ids)
+	}
+
+	payload := stub.mustInvoke("updateInfoElements", "c1", jsonArg(map[string]interface{}{
+		"elements":  []InfoElement{{Id: "e3", ElementType: "PASSPORT", ElementValue: "X3"}, {Id: "e2", ElementType: "ADDRESS", ElementValue: "High St"}},
+		"deletions": []string{"e1"},
+	}))
+	json.Unmarshal(payload, &results)
+	if len(results) != 3 || results[2].Action != BatchActionDeleted {
+		t.Errorf("results = %+v", results)
+	}
+	person := storedPerson(stub, "c1")
+	if ids := elementIds(person); len(ids) != 2 || ids[0] != "e2" || ids[1] != "e3" {
+		t.Errorf("person has %v after the batch", ids)
+	}
+	if findInfoElement(person, "e2").ElementValue != "High St" {
+		t.Error("e2 was not replaced")
+	}
+}
+
+func TestBatchRejectsRepeatedEntries(t *testing.T) {
+	stub := newTestStub(t)
+	createConsentingPerson(stub)
+
+	_, err := stub.invoke("updateInfoElements", "c1", jsonArg(map[string]interface{}{
+		"elements":  []InfoElement{{Id: "e3", ElementType: "PASSPORT", ElementValue: "X3"}},
+		"deletions": []string{"e3"},
+	}))
+	if results := batchErrors(t, err); results[1].Error == nil {
+		t.Errorf("updating and deleting e3 in one batch passed: %+v", results)
+	}
+}
+
+func TestBatchPrivateValuesNeedTheirOwnSalt(t *testing.T) {
+	stub := newTestStub(t)
+	createConsentingPerson(stub)
+
+	_, err := stub.invoke("updateInfoElements", "c1", jsonArg(map[string]interface{}{
+		"elements": []InfoElement{
+			{Id: "e3", ElementType: "PASSPORT", ValueHash: saltedHash(testSalt, "P1")},
+			{Id: "e4", ElementType: "PASSPORT", ValueHash: saltedHash(testSalt, "P1")},
+		},
+	}))
+	if results := batchErrors(t, err); results[0].Error != nil || results[1].Error == nil || results[1].Error.Field != "valueHash" {
+		t.Errorf("results = %+v", results)
+	}
+
+	stub.mustInvoke("updateInfoElements", "c1", jsonArg(map[string]interface{}{
+		"elements": []InfoElement{
+			{Id: "e3", ElementType: "PASSPORT", ValueHash: saltedHash("salt-of-e3-0001", "P1")},
+			{Id: "e4", ElementType: "PASSPORT", ValueHash: saltedHash("salt-of-e4-0002", "P1")},
+		},
+	}))
+
+	_, err = stub.invoke("updateInfoElement", "c1", jsonArg(InfoElement{Id: "e5", ElementType: "PASSPORT", ValueHash: saltedHash("salt-of-e3-0001", "P1")}))
+	expectCode(t, err, ccerror.InvalidArgument)
+	stub.mustInvoke("updateInfoElement", "c1", jsonArg(InfoElement{Id: "e3", ElementType: "PASSPORT", ValueHash: saltedHash("salt-of-e3-0001", "P1")}))
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+// Object type of the composite key consents are stored under, keyed by person and consent id
+const consentObjectType = "Consent"
+
+// Consent lets one institution read selected InfoElements of a person for a
+// stated purpose until it expires or is revoked
+type Consent struct {
+	Id            string   `json:"id"`
+	PersonId      string   `json:"personId"`
+	InstitutionId string   `json:"institutionId"`
+	ElementIds    []string `json:"elementIds"`
+	ElementTypes  []string `json:"elementTypes"`
+	Purpose       string   `json:"purpose"`
+	ExpiresOn     string   `json:"expiresOn"`
+	GrantedOn     string   `json:"grantedOn"`
+	GrantedBy     string   `json:"grantedBy"`
+	RevokedOn     string   `json:"revokedOn,omitempty"`
+	RevokedBy     string   `json:"revokedBy,omitempty"`
+}
+
+// Checks whether the consent is in force at the given time
+func (consent *Consent) isActive(now time.Time) bool {
+	if consent.RevokedOn != "" {
+		return false
+	}
+	expiresOn, err := parseDate(consent.ExpiresOn)
+	if err != nil {
+		return false
+	}
+	return now.Before(expiresOn)
+}
+
+// Checks whether the consent covers an InfoElement
+func (consent *Consent) covers(infoElement InfoElement) bool {
+	for _, elementId := range consent.ElementIds {
+		if elementId == infoElement.Id {
+			return true
+		}
+	}
+	for _, elementType := range consent.ElementTypes {
+		if elementType == infoElement.ElementType {
+			return true
+		}
+	}
+	return false
+}
+
+func (kyc *KYCChaincode) grantConsent(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: grantConsent called")
+
+	if len(args) != 2 {
+		return nil, ccerror.IncorrectArgs("2")
+	}
+
+	consent := Consent{}
+	err := json.Unmarshal([]byte(args[1]), &consent)
+	if err != nil {
+		return nil, ccerror.New(ccerror.InvalidArgument, "consent", "Failed to unmarshal consent: %s", err.Error())
+	}
+	consent.PersonId = args[0]
+
+	_, err = kyc.mustGetPerson(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if consent.Id == "" || consent.InstitutionId == "" || consent.Purpose == "" {
+		return nil, ccerror.New(ccerror.InvalidArgument, "consent", "Consent requires id, institutionId and purpose")
+	}
+	if len(consent.ElementIds) == 0 && len(consent.ElementTypes) == 0 {
+		return nil, ccerror.New(ccerror.InvalidArgument, "elementIds", "Consent must cover at least one element id or element type")
+	}
+
+	now, err := getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	expiresOn, err := parseDate(consent.ExpiresOn)
+	if err != nil {
+		return nil, ccerror.New(ccerror.InvalidArgument, "expiresOn", "%s", err.Error())
+	}
+	if !now.Before(expiresOn) {
+		return nil, ccerror.New(ccerror.InvalidArgument, "expiresOn", "Consent expiry must be in the future")
+	}
+
+	existingConsent, err := kyc.getConsent(stub, consent.PersonId, consent.Id)
+	if err != nil {
+		return nil, err
+	}
+	if existingConsent != nil {
+		return nil, ccerror.New(ccerror.AlreadyExists, "consentId", "Consent id already granted")
+	}
+
+	actor, err := getActor(stub)
+	if err != nil {
+		return nil, err
+	}
+	consent.GrantedOn = now.Format(time.RFC3339)
+	consent.GrantedBy = actor
+	consent.RevokedOn = ""
+	consent.RevokedBy = ""
+
+	err = kyc.putConsent(stub, consent)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (kyc *KYCChaincode) revokeConsent(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: revokeConsent called")
+
+	if len(args) != 2 {
+		return nil, ccerror.IncorrectArgs("2")
+	}
+
+	consent, err := kyc.getConsent(stub, args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	if consent == nil {
+		return nil, ccerror.New(ccerror.NotFound, "consentId", "Consent not found")
+	}
+	if consent.RevokedOn != "" {
+		return nil, ccerror.New(ccerror.Conflict, "consentId", "Consent already revoked")
+	}
+
+	now, err := getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	actor, err := getActor(stub)
+	if err != nil {
+		return nil, err
+	}
+	consent.RevokedOn = now.Format(time.RFC3339)
+	consent.RevokedBy = actor
+
+	err = kyc.putConsent(stub, *consent)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// Lists the consents of a person. Institutions only see the grants made to them.
+func (kyc *KYCChaincode) listConsents(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: listConsents called")
+
+	if len(args) != 1 {
+		return nil, ccerror.IncorrectArgs("1")
+	}
+
+	invoker, err := getInvoker(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	consents, err := kyc.getConsents(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	visibleConsents := []Consent{}
+	for _, consent := range consents {
+		if invoker.Role == RoleInstitution && consent.InstitutionId != invoker.Id {
+			continue
+		}
+		visibleConsents = append(visibleConsents, consent)
+	}
+
+	jsonAsBytes, _ := json.Marshal(visibleConsents)
+	return jsonAsBytes, nil
+}
+
+// Returns a filter selecting the InfoElements of a person the invoker may read
+// for a purpose, or nil when the invoker may read all of them
+func (kyc *KYCChaincode) consentFilter(stub shim.ChaincodeStubInterface, personId string, purpose string) (func(InfoElement) bool, error) {
+	invoker, err := getInvoker(stub)
+	if err != nil {
+		return nil, err
+	}
+	if invoker.Role == RoleAdmin || invoker.Role == RoleRegulator {
+		return nil, nil
+	}
+	if invoker.Role == RoleCustomer && invoker.Id == personId {
+		return nil, nil
+	}
+
+	if purpose == "" {
+		return nil, ccerror.New(ccerror.InvalidArgument, "purpose", "A purpose is required to read another person's data")
+	}
+
+	now, err := getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	consents, err := kyc.getConsents(stub, personId)
+	if err != nil {
+		return nil, err
+	}
+
+	activeConsents := []Consent{}
+	for _, consent := range consents {
+		if consent.InstitutionId == invoker.Id && consent.Purpose == purpose && consent.isActive(now) {
+			activeConsents = append(activeConsents, consent)
+		}
+	}
+
+	return func(infoElement InfoElement) bool {
+		for _, consent := range activeConsents {
+			if consent.covers(infoElement) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// Narrows a person to the InfoElements the invoker may read for a purpose.
+// The risk assessment is dropped unless every element it was computed from
+// is still there, since its factors describe those elements.
+func (kyc *KYCChaincode) filterConsented(stub shim.ChaincodeStubInterface, person *Person, purpose string) error {
+	consented, err := kyc.consentFilter(stub, person.Id, purpose)
+	if err != nil || consented == nil {
+		return err
+	}
+
+	fullPerson := *person
+	consentedInfoElements := []InfoElement{}
+	for _, infoElement := range person.InfoElements {
+		if consented(infoElement) {
+			consentedInfoElements = append(consentedInfoElements, infoElement)
+		}
+	}
+	person.InfoElements = consentedInfoElements
+	if person.RiskAssessment != nil {
+		if _, covered := assessmentCovered(*person.RiskAssessment, fullPerson, *person); !covered {
+			person.RiskAssessment = nil
+		}
+	}
+	return nil
+}
+
+func consentKey(personId string, consentId string) (string, error) {
+	return createCompositeKey(consentObjectType, []string{personId, consentId})
+}
+
+// Reads a consent, returning nil if it does not exist
+func (kyc *KYCChaincode) getConsent(stub shim.ChaincodeStubInterface, personId string, consentId string) (*Consent, error) {
+	key, err := consentKey(personId, consentId)
+	if err != nil {
+		return nil, err
+	}
+
+	consentJSONAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, ccerror.New(ccerror.Internal, "", "Failed to get state for consent %s", consentId)
+	}
+	if consentJSONAsBytes == nil {
+		return nil, nil
+	}
+
+	consent := Consent{}
+	err = json.Unmarshal(consentJSONAsBytes, &consent)
+	if err != nil {
+		return nil, ccerror.New(ccerror.Internal, "", "Failed to unmarshal consent %s: %s", consentId, err.Error())
+	}
+
+	return &consent, nil
+}
+
+// Reads every consent granted by a person
+func (kyc *KYCChaincode) getConsents(stub shim.ChaincodeStubInterface, personId string) ([]Consent, error) {
+	startKey, endKey, err := compositeKeyRange(consentObjectType, []string{personId})
+	if err != nil {
+		return nil, err
+	}
+
+	iterator, err := stub.RangeQueryState(startKey, endKey)
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	consents := []Consent{}
+	for iterator.HasNext() {
+		_, consentJSONAsBytes, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		consent := Consent{}
+		err = json.Unmarshal(consentJSONAsBytes, &consent)
+		if err != nil {
+			return nil, ccerror.New(ccerror.Internal, "", "Failed to unmarshal consent: %s", err.Error())
+		}
+		consents = append(consents, consent)
+	}
+
+	return consents, nil
+}
+
+func (kyc *KYCChaincode) putConsent(stub shim.ChaincodeStubInterface, consent Consent) error {
+	key, err := consentKey(consent.PersonId, consent.Id)
+	if err != nil {
+		return err
+	}
+
+	jsonAsBytes, _ := json.Marshal(consent)
+	return stub.PutState(key, jsonAsBytes)
+}
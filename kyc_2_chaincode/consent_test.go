@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+// Creates customer c1 with a passport e1 and an address e2
+func createConsentingPerson(stub *testStub) {
+	stub.t.Helper()
+	stub.registerElementType("PASSPORT")
+	stub.registerElementType("ADDRESS")
+	stub.as(RoleCustomer, "c1").mustInvoke("createPerson", "c1")
+	stub.mustInvoke("updateInfoElement", "c1", jsonArg(InfoElement{Id: "e1", ElementType: "PASSPORT", ElementValue: "X1"}))
+	stub.mustInvoke("updateInfoElement", "c1", jsonArg(InfoElement{Id: "e2", ElementType: "ADDRESS", ElementValue: "Main St"}))
+}
+
+func TestConsentFiltersElementsByInstitutionAndPurpose(t *testing.T) {
+	stub := newTestStub(t)
+	createConsentingPerson(stub)
+	stub.mustInvoke("grantConsent", "c1", jsonArg(Consent{Id: "k1", InstitutionId: "bank1", ElementTypes: []string{"PASSPORT"}, Purpose: "onboarding", ExpiresOn: "2026-06-01"}))
+
+	person := Person{}
+	stub.as(RoleInstitution, "bank1").mustQuery(&person, "queryPerson", "c1", "onboarding")
+	if ids := elementIds(person); len(ids) != 1 || ids[0] != "e1" {
+		t.Errorf("bank1 read %v for onboarding, expected [e1]", ids)
+	}
+
+	stub.mustQuery(&person, "queryPerson", "c1", "marketing")
+	if ids := elementIds(person); len(ids) != 0 {
+		t.Errorf("bank1 read %v for marketing, expected nothing", ids)
+	}
+	_, err := stub.query("queryPerson", "c1")
+	expectCode(t, err, ccerror.InvalidArgument)
+	_, err = stub.query("queryInfoElement", "c1", "e2", "onboarding")
+	expectCode(t, err, ccerror.Forbidden)
+
+	stub.as(RoleInstitution, "bank2").mustQuery(&person, "queryPerson", "c1", "onboarding")
+	if ids := elementIds(person); len(ids) != 0 {
+		t.Errorf("bank2 read %v without consent", ids)
+	}
+
+	for _, role := range []string{RoleRegulator, RoleAdmin} {
+		stub.as(role, "x").mustQuery(&person, "queryPerson", "c1")
+		if ids := elementIds(person); len(ids) != 2 {
+			t.Errorf("%s read %v, expected every element", role, ids)
+		}
+	}
+}
+
+func TestConsentEndsWhenRevokedOrExpired(t *testing.T) {
+	stub := newTestStub(t)
+	createConsentingPerson(stub)
+	stub.mustInvoke("grantConsent", "c1", jsonArg(Consent{Id: "k1", InstitutionId: "bank1", ElementIds: []string{"e2"}, Purpose: "onboarding", ExpiresOn: "2026-06-01"}))
+	stub.mustInvoke("grantConsent", "c1", jsonArg(Consent{Id: "k2", InstitutionId: "bank1", ElementIds: []string{"e1"}, Purpose: "onboarding", ExpiresOn: "2026-01-02"}))
+
+	element := InfoElement{}
+	stub.as(RoleInstitution, "bank1").mustQuery(&element, "queryInfoElement", "c1", "e1", "onboarding")
+
+	stub.as(RoleCustomer, "c1").mustInvoke("revokeConsent", "c1", "k1")
+	_, err := stub.as(RoleInstitution, "bank1").query("queryInfoElement", "c1", "e2", "onboarding")
+	expectCode(t, err, ccerror.Forbidden)
+	_, err = stub.as(RoleCustomer, "c1").invoke("revokeConsent", "c1", "k1")
+	expectCode(t, err, ccerror.Conflict)
+
+	stub.now = stub.now.AddDate(0, 0, 1)
+	_, err = stub.as(RoleInstitution, "bank1").query("queryInfoElement", "c1", "e1", "onboarding")
+	expectCode(t, err, ccerror.Forbidden)
+}
+
+func TestListConsentsShowsInstitutionsOnlyTheirGrants(t *testing.T) {
+	stub := newTestStub(t)
+	createConsentingPerson(stub)
+	stub.mustInvoke("grantConsent", "c1", jsonArg(Consent{Id: "k1", InstitutionId: "bank1", ElementIds: []string{"e1"}, Purpose: "onboarding", ExpiresOn: "2026-06-01"}))
+	stub.mustInvoke("grantConsent", "c1", jsonArg(Consent{Id: "k2", InstitutionId: "bank2", ElementIds: []string{"e1"}, Purpose: "onboarding", ExpiresOn: "2026-06-01"}))
+
+	consents := []Consent{}
+	stub.as(RoleInstitution, "bank2").mustQuery(&consents, "listConsents", "c1")
+	if len(consents) != 1 || consents[0].Id != "k2" {
+		t.Errorf("bank2 listed %+v, expected only k2", consents)
+	}
+	stub.as(RoleCustomer, "c1").mustQuery(&consents, "listConsents", "c1")
+	if len(consents) != 2 {
+		t.Errorf("c1 listed %d consents, expected 2", len(consents))
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+// Transient key carrying the raw bytes of a document to check
+const transientDocument = "document"
+
+// Digest algorithms accepted in InfoElement.Hash, keyed by name
+var hashAlgorithms = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+// Algorithms assumed for hashes stored without an "algorithm:" prefix, keyed by hex length
+var hashAlgorithmsByLength = map[int]string{
+	40:  "sha1",
+	64:  "sha256",
+	96:  "sha384",
+	128: "sha512",
+}
+
+// Result of checking a document digest against an InfoElement
+type HashVerification struct {
+	PersonId       string `json:"personId"`
+	ElementId      string `json:"elementId"`
+	Algorithm      string `json:"algorithm"`
+	Matches        bool   `json:"matches"`
+	ValidTill      string `json:"validTill"`
+	WithinValidity bool   `json:"withinValidity"`
+}
+
+// Splits a stored hash such as "sha256:ab12..." into its algorithm and lower
+// case hex digest, inferring the algorithm from the length when there is no prefix
+func parseStoredHash(storedHash string) (string, string, error) {
+	algorithm := ""
+	digest := storedHash
+	if separator := strings.Index(storedHash, ":"); separator >= 0 {
+		algorithm = strings.ToLower(storedHash[:separator])
+		digest = storedHash[separator+1:]
+	}
+	digest = strings.ToLower(digest)
+
+	if _, err := hex.DecodeString(digest); err != nil {
+		return "", "", ccerror.New(ccerror.Conflict, "hash", "Stored hash is not hex encoded")
+	}
+	if algorithm == "" {
+		algorithm = hashAlgorithmsByLength[len(digest)]
+	}
+	if _, ok := hashAlgorithms[algorithm]; !ok {
+		return "", "", ccerror.New(ccerror.Conflict, "hash", "Unsupported hash algorithm in stored hash")
+	}
+
+	return algorithm, digest, nil
+}
+
+// Checks a document digest, or the raw document passed in the transient
+// inputs, against the Hash of an InfoElement and reports whether the element
+// is still within ValidTill
+func (kyc *KYCChaincode) verifyInfoElementHash(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: verifyInfoElementHash called")
+
+	var purpose string
+
+	if len(args) != 3 && len(args) != 4 {
+		return nil, ccerror.IncorrectArgs("3 or 4")
+	}
+	if len(args) == 4 {
+		purpose = args[3]
+	}
+
+	infoElementAsJSONBytes, err := kyc.queryInfoElement(stub, []string{args[0], args[1], purpose})
+	if err != nil {
+		return nil, err
+	}
+
+	infoElement := InfoElement{}
+	json.Unmarshal(infoElementAsJSONBytes, &infoElement)
+	if infoElement.Hash == "" {
+		return nil, ccerror.New(ccerror.Conflict, "elementId", "InfoElement with id %s has no hash", args[1])
+	}
+
+	algorithm, storedDigest, err := parseStoredHash(infoElement.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	candidateDigest := strings.ToLower(args[2])
+	if separator := strings.Index(candidateDigest, ":"); separator >= 0 {
+		if candidateDigest[:separator] != algorithm {
+			return nil, ccerror.New(ccerror.InvalidArgument, "digest", "Digest algorithm does not match the stored %s hash", algorithm)
+		}
+		candidateDigest = candidateDigest[separator+1:]
+	}
+	if candidateDigest == "" {
+		transient, err := getTransient(stub)
+		if err != nil {
+			return nil, err
+		}
+		document, ok := transient[transientDocument]
+		if !ok {
+			return nil, ccerror.New(ccerror.InvalidArgument, "digest", "Either a digest or the transient input %s is required", transientDocument)
+		}
+		digest := hashAlgorithms[algorithm]()
+		digest.Write(document)
+		candidateDigest = hex.EncodeToString(digest.Sum(nil))
+	}
+
+	now, err := getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	result := HashVerification{
+		PersonId:       args[0],
+		ElementId:      args[1],
+		Algorithm:      algorithm,
+		Matches:        subtle.ConstantTimeCompare([]byte(candidateDigest), []byte(storedDigest)) == 1,
+		ValidTill:      infoElement.ValidTill,
+		WithinValidity: !isLapsed(infoElement, now),
+	}
+
+	jsonAsBytes, _ := json.Marshal(result)
+	return jsonAsBytes, nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+// Status given to InfoElements past their ValidTill date
+const ElementStatusExpired = "EXPIRED"
+
+// InfoElement that lapses within the window asked for by queryExpiringElements
+type ExpiringElement struct {
+	PersonId    string `json:"personId"`
+	ElementId   string `json:"elementId"`
+	ElementType string `json:"elementType"`
+	ValidTill   string `json:"validTill"`
+	Expired     bool   `json:"expired"`
+}
+
+// Result of marking lapsed InfoElements as expired on one page of persons.
+// Bookmark is empty once the last person has been swept.
+type SweepReport struct {
+	SweptOn  string            `json:"sweptOn"`
+	Expired  []ExpiringElement `json:"expired"`
+	Visited  int               `json:"visited"`
+	Persons  int               `json:"persons"`
+	Elements int               `json:"elements"`
+	Bookmark string            `json:"bookmark"`
+}
+
+// Checks whether an InfoElement has lapsed at the given time. Elements without
+// a ValidTill date never lapse. A plain date is the last day the element is
+// valid, so it lapses at the following midnight UTC; an RFC3339 timestamp is
+// the instant it lapses.
+func isLapsed(infoElement InfoElement, now time.Time) bool {
+	if infoElement.ValidTill == "" {
+		return false
+	}
+	lapsesOn, err := lapseTime(infoElement.ValidTill)
+	if err != nil {
+		return false
+	}
+	return !now.Before(lapsesOn)
+}
+
+// Returns the instant an element valid till the given date lapses
+func lapseTime(validTill string) (time.Time, error) {
+	lapsesOn, err := parseDate(validTill)
+	if err != nil {
+		return lapsesOn, err
+	}
+	if _, err := time.Parse("2006-01-02", validTill); err == nil {
+		lapsesOn = lapsesOn.AddDate(0, 0, 1)
+	}
+	return lapsesOn, nil
+}
+
+// Reports lapsed InfoElements as expired whatever status they were stored with
+func reportExpired(infoElements []InfoElement, now time.Time) {
+	for i := range infoElements {
+		if isLapsed(infoElements[i], now) {
+			infoElements[i].Status = ElementStatusExpired
+		}
+	}
+}
+
+// Lists the InfoElements that lapse within the given number of days,
+// including those that have already lapsed. Arguments are the number of days
+// and, for institutions, the purpose their consents were granted for; they
+// only see the elements those consents cover.
+func (kyc *KYCChaincode) queryExpiringElements(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: queryExpiringElements called")
+
+	var purpose string
+
+	if len(args) != 1 && len(args) != 2 {
+		return nil, ccerror.IncorrectArgs("1 or 2")
+	}
+	if len(args) == 2 {
+		purpose = args[1]
+	}
+
+	days, err := strconv.Atoi(args[0])
+	if err != nil || days < 0 {
+		return nil, ccerror.New(ccerror.InvalidArgument, "days", "Expecting a non-negative number of days")
+	}
+
+	now, err := getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	horizon := now.AddDate(0, 0, days)
+
+	expiringElements := []ExpiringElement{}
+	err = kyc.forEachPerson(stub, func(person Person) error {
+		err := kyc.filterConsented(stub, &person, purpose)
+		if err != nil {
+			return err
+		}
+		for _, infoElement := range person.InfoElements {
+			if isLapsed(infoElement, horizon) {
+				expiringElements = append(expiringElements, ExpiringElement{
+					PersonId:    person.Id,
+					ElementId:   infoElement.Id,
+					ElementType: infoElement.ElementType,
+					ValidTill:   infoElement.ValidTill,
+					Expired:     isLapsed(infoElement, now),
+				})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(expiringElements, func(i, j int) bool {
+		left, _ := lapseTime(expiringElements[i].ValidTill)
+		right, _ := lapseTime(expiringElements[j].ValidTill)
+		return left.Before(right)
+	})
+
+	jsonAsBytes, _ := json.Marshal(expiringElements)
+	return jsonAsBytes, nil
+}
+
+// Marks the InfoElements past their ValidTill date at the transaction
+// timestamp as EXPIRED, one page of persons per transaction so the work stays
+// bounded. Arguments are the page size and the bookmark of the previous page;
+// call again with the returned bookmark until it comes back empty. Persons are
+// visited in key order so every peer writes the same set.
+func (kyc *KYCChaincode) sweepExpired(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: sweepExpired called")
+
+	if len(args) != 2 {
+		return nil, ccerror.IncorrectArgs("2")
+	}
+
+	pageSize, lastKey, err := parsePageArgs(args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	startKey, endKey, err := compositeKeyRange(personObjectType, []string{})
+	if err != nil {
+		return nil, err
+	}
+
+	// Persons are collected first and written once the range scan is closed
+	page, err := pageKeys(stub, startKey, endKey, pageSize, lastKey, func(key string, value []byte) (interface{}, bool, error) {
+		person, err := kyc.getIndexedPerson(stub, key)
+		if err != nil || person == nil {
+			return nil, false, err
+		}
+		return *person, true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	report := SweepReport{SweptOn: now.Format(time.RFC3339), Expired: []ExpiringElement{}, Visited: page.Count, Bookmark: page.Bookmark}
+	for _, result := range page.Results {
+		person := result.(Person)
+		changed := false
+		for i, infoElement := range person.InfoElements {
+			if infoElement.Status == ElementStatusExpired || !isLapsed(infoElement, now) {
+				continue
+			}
+			person.InfoElements[i].Status = ElementStatusExpired
+			changed = true
+			report.Expired = append(report.Expired, ExpiringElement{
+				PersonId:    person.Id,
+				ElementId:   infoElement.Id,
+				ElementType: infoElement.ElementType,
+				ValidTill:   infoElement.ValidTill,
+				Expired:     true,
+			})
+		}
+		if !changed {
+			continue
+		}
+
+		err = kyc.putPerson(stub, person)
+		if err != nil {
+			return nil, err
+		}
+		report.Persons++
+	}
+	report.Elements = len(report.Expired)
+
+	jsonAsBytes, _ := json.Marshal(report)
+	return jsonAsBytes, nil
+}
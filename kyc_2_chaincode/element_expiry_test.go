@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+func TestIsLapsedCountsTheValidTillDay(t *testing.T) {
+	cases := []struct {
+		validTill string
+		now       time.Time
+		lapsed    bool
+	}{
+		{"", time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC), false},
+		{"2026-03-10", time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC), false},
+		{"2026-03-10", time.Date(2026, 3, 10, 23, 59, 59, 0, time.UTC), false},
+		{"2026-03-10", time.Date(2026, 3, 11, 0, 0, 0, 0, time.UTC), true},
+		{"2026-03-10T12:00:00Z", time.Date(2026, 3, 10, 11, 59, 59, 0, time.UTC), false},
+		{"2026-03-10T12:00:00Z", time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC), true},
+		{"2026-03-10T12:00:00+02:00", time.Date(2026, 3, 10, 10, 0, 0, 0, time.UTC), true},
+	}
+
+	for _, c := range cases {
+		if lapsed := isLapsed(InfoElement{ValidTill: c.validTill}, c.now); lapsed != c.lapsed {
+			t.Errorf("isLapsed(%q, %s) = %v, expected %v", c.validTill, c.now.Format(time.RFC3339), lapsed, c.lapsed)
+		}
+	}
+}
+
+// Creates persons whose passports are valid till 2026-01-10
+func createExpiringPersons(stub *testStub, personIds ...string) {
+	stub.t.Helper()
+	stub.registerElementType("PASSPORT")
+	stub.registerElementType("ADDRESS")
+	for _, personId := range personIds {
+		stub.as(RoleCustomer, personId).mustInvoke("createPerson", personId)
+		stub.mustInvoke("updateInfoElement", personId, jsonArg(InfoElement{Id: "e1", ElementType: "PASSPORT", ElementValue: "X1", ValidTill: "2026-01-10"}))
+		stub.mustInvoke("updateInfoElement", personId, jsonArg(InfoElement{Id: "e2", ElementType: "ADDRESS", ElementValue: "Main St", ValidTill: "2026-01-10"}))
+	}
+	stub.as(RoleAdmin, "admin")
+}
+
+func TestQueryExpiringElementsAppliesConsent(t *testing.T) {
+	stub := newTestStub(t)
+	createExpiringPersons(stub, "c1", "c2")
+	stub.as(RoleCustomer, "c1").mustInvoke("grantConsent", "c1", jsonArg(Consent{Id: "k1", InstitutionId: "bank1", ElementTypes: []string{"PASSPORT"}, Purpose: "monitoring", ExpiresOn: "2026-06-01"}))
+
+	expiring := []ExpiringElement{}
+	stub.as(RoleInstitution, "bank1").mustQuery(&expiring, "queryExpiringElements", "30", "monitoring")
+	if len(expiring) != 1 || expiring[0].PersonId != "c1" || expiring[0].ElementId != "e1" {
+		t.Errorf("bank1 sees %+v, expected only c1/e1", expiring)
+	}
+	_, err := stub.query("queryExpiringElements", "30")
+	expectCode(t, err, ccerror.InvalidArgument)
+
+	stub.as(RoleRegulator, "r1").mustQuery(&expiring, "queryExpiringElements", "30")
+	if len(expiring) != 4 {
+		t.Errorf("regulator sees %d elements, expected 4", len(expiring))
+	}
+	stub.mustQuery(&expiring, "queryExpiringElements", "2")
+	if len(expiring) != 0 {
+		t.Errorf("%d elements lapse within 2 days, expected none", len(expiring))
+	}
+}
+
+// Reads a person as stored, without the expiry reporting of queries
+func storedPerson(stub *testStub, personId string) Person {
+	stub.t.Helper()
+	person := Person{}
+	err := json.Unmarshal(stub.State[personId], &person)
+	if err != nil {
+		stub.t.Fatalf("person %s: %s", personId, err)
+	}
+	return person
+}
+
+func TestSweepExpiredPagesThroughPersons(t *testing.T) {
+	stub := newTestStub(t)
+	createExpiringPersons(stub, "c1", "c2", "c3")
+
+	report := SweepReport{}
+	stub.now = time.Date(2026, 1, 10, 23, 58, 0, 0, time.UTC)
+	json.Unmarshal(stub.mustInvoke("sweepExpired", "10", ""), &report)
+	if report.Elements != 0 {
+		t.Fatalf("swept %d elements on their last valid day", report.Elements)
+	}
+
+	stub.now = time.Date(2026, 1, 10, 23, 59, 0, 0, time.UTC)
+	json.Unmarshal(stub.mustInvoke("sweepExpired", "2", ""), &report)
+	if report.Visited != 2 || report.Persons != 2 || report.Elements != 4 || report.Bookmark == "" {
+		t.Fatalf("first page = %+v", report)
+	}
+	if status := findInfoElement(storedPerson(stub, "c3"), "e1").Status; status == ElementStatusExpired {
+		t.Error("c3 was swept before its page")
+	}
+
+	bookmark := report.Bookmark
+	report = SweepReport{}
+	json.Unmarshal(stub.mustInvoke("sweepExpired", "2", bookmark), &report)
+	if report.Visited != 1 || report.Persons != 1 || report.Bookmark != "" {
+		t.Fatalf("second page = %+v", report)
+	}
+
+	for _, personId := range []string{"c1", "c2", "c3"} {
+		for _, infoElement := range storedPerson(stub, personId).InfoElements {
+			if infoElement.Status != ElementStatusExpired {
+				t.Errorf("%s/%s is %s after the sweep", personId, infoElement.Id, infoElement.Status)
+			}
+		}
+	}
+
+	_, err := stub.invoke("sweepExpired", "0", "")
+	expectCode(t, err, ccerror.InvalidArgument)
+}
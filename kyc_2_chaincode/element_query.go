@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+// The v0.6 shim has no rich query support, so element selectors are evaluated
+// by the chaincode while walking the person index. This works the same on any
+// state database and on the mock stub.
+
+// ElementSelector picks InfoElements by type, status and verification. Unset
+// fields match everything.
+type ElementSelector struct {
+	ElementType  string `json:"elementType"`
+	Status       string `json:"status"`
+	Verified     *bool  `json:"verified"`
+	VerifiedFrom string `json:"verifiedFrom"`
+	VerifiedTo   string `json:"verifiedTo"`
+}
+
+// ElementMatch describes one InfoElement picked by a selector, without its value
+type ElementMatch struct {
+	ElementId   string `json:"elementId"`
+	ElementType string `json:"elementType"`
+	Status      string `json:"status"`
+	VerifiedOn  string `json:"verifiedOn"`
+	ValidTill   string `json:"validTill"`
+}
+
+// PersonMatch is a person with the InfoElements a selector picked
+type PersonMatch struct {
+	PersonId string         `json:"personId"`
+	Elements []ElementMatch `json:"elements"`
+}
+
+type compiledSelector struct {
+	ElementSelector
+	verifiedFrom time.Time
+	verifiedTo   time.Time
+}
+
+func compileSelector(selector ElementSelector) (compiledSelector, error) {
+	compiled := compiledSelector{ElementSelector: selector}
+	if selector.VerifiedFrom != "" {
+		verifiedFrom, err := parseDate(selector.VerifiedFrom)
+		if err != nil {
+			return compiled, ccerror.New(ccerror.InvalidArgument, "verifiedFrom", "%s", err.Error())
+		}
+		compiled.verifiedFrom = verifiedFrom
+	}
+	if selector.VerifiedTo != "" {
+		// A plain date includes the whole day, the way ValidTill does
+		verifiedTo, err := lapseTime(selector.VerifiedTo)
+		if err != nil {
+			return compiled, ccerror.New(ccerror.InvalidArgument, "verifiedTo", "%s", err.Error())
+		}
+		compiled.verifiedTo = verifiedTo
+	}
+	return compiled, nil
+}
+
+func (selector compiledSelector) matches(infoElement InfoElement) bool {
+	if selector.ElementType != "" && infoElement.ElementType != selector.ElementType {
+		return false
+	}
+	if selector.Status != "" && infoElement.Status != selector.Status {
+		return false
+	}
+	if selector.Verified != nil && (infoElement.VerifiedOn != "") != *selector.Verified {
+		return false
+	}
+	if selector.VerifiedFrom == "" && selector.VerifiedTo == "" {
+		return true
+	}
+
+	verifiedOn, err := parseDate(infoElement.VerifiedOn)
+	if err != nil {
+		return false
+	}
+	if selector.VerifiedFrom != "" && verifiedOn.Before(selector.verifiedFrom) {
+		return false
+	}
+	if selector.VerifiedTo != "" && !verifiedOn.Before(selector.verifiedTo) {
+		return false
+	}
+	return true
+}
+
+// Finds persons having InfoElements that match a selector, e.g.
+// {"elementType":"PASSPORT","verified":false}. Arguments are the selector
+// JSON, the page size, the bookmark of the previous page and the purpose of
+// the read. Only elements the caller may read under queryPerson's consent
+// rules are matched.
+func (kyc *KYCChaincode) queryPersonsByElement(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: queryPersonsByElement called")
+
+	var purpose string
+
+	if len(args) != 3 && len(args) != 4 {
+		return nil, ccerror.IncorrectArgs("3 or 4")
+	}
+	if len(args) == 4 {
+		purpose = args[3]
+	}
+
+	selector := ElementSelector{}
+	err := json.Unmarshal([]byte(args[0]), &selector)
+	if err != nil {
+		return nil, ccerror.New(ccerror.InvalidArgument, "selector", "Failed to unmarshal selector: %s", err.Error())
+	}
+	compiled, err := compileSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	pageSize, lastKey, err := parsePageArgs(args[1], args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	startKey, endKey, err := compositeKeyRange(personObjectType, []string{})
+	if err != nil {
+		return nil, err
+	}
+
+	page, err := pageKeys(stub, startKey, endKey, pageSize, lastKey, func(key string, value []byte) (interface{}, bool, error) {
+		person, err := kyc.getIndexedPerson(stub, key)
+		if err != nil || person == nil {
+			return nil, false, err
+		}
+		err = kyc.filterConsented(stub, person, purpose)
+		if err != nil {
+			return nil, false, err
+		}
+		reportExpired(person.InfoElements, now)
+
+		match := PersonMatch{PersonId: person.Id, Elements: []ElementMatch{}}
+		for _, infoElement := range person.InfoElements {
+			if compiled.matches(infoElement) {
+				match.Elements = append(match.Elements, ElementMatch{
+					ElementId:   infoElement.Id,
+					ElementType: infoElement.ElementType,
+					Status:      infoElement.Status,
+					VerifiedOn:  infoElement.VerifiedOn,
+					ValidTill:   infoElement.ValidTill,
+				})
+			}
+		}
+		return match, len(match.Elements) > 0, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	jsonAsBytes, _ := json.Marshal(page)
+	return jsonAsBytes, nil
+}
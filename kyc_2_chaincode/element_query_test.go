@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+// Decodes the PersonMatch results of a queryPersonsByElement page
+func personMatches(stub *testStub, args ...string) []PersonMatch {
+	stub.t.Helper()
+	page := struct {
+		Results []PersonMatch `json:"results"`
+	}{}
+	stub.mustQuery(&page, "queryPersonsByElement", args...)
+	return page.Results
+}
+
+func TestQueryPersonsByElementMatchesSelector(t *testing.T) {
+	stub := newTestStub(t)
+	createConsentingPerson(stub)
+	stub.registerVerifier("v1")
+	stub.as(RoleVerifier, "v1").mustInvoke("verifyInfoElement", "c1", "e1", ElementStatusVerified, "proof")
+	stub.as(RoleAdmin, "admin")
+
+	matches := personMatches(stub, jsonArg(ElementSelector{ElementType: "PASSPORT", Status: ElementStatusVerified}), "10", "")
+	if len(matches) != 1 || len(matches[0].Elements) != 1 || matches[0].Elements[0].ElementId != "e1" {
+		t.Errorf("verified passports = %+v", matches)
+	}
+
+	unverified := false
+	matches = personMatches(stub, jsonArg(ElementSelector{Verified: &unverified}), "10", "")
+	if len(matches) != 1 || len(matches[0].Elements) != 1 || matches[0].Elements[0].ElementId != "e2" {
+		t.Errorf("unverified elements = %+v", matches)
+	}
+
+	matches = personMatches(stub, jsonArg(ElementSelector{VerifiedFrom: "2026-01-02"}), "10", "")
+	if len(matches) != 0 {
+		t.Errorf("elements verified from 2026-01-02 = %+v", matches)
+	}
+
+	// e1 was verified during 2026-01-01, which both bounds include
+	matches = personMatches(stub, jsonArg(ElementSelector{VerifiedFrom: "2026-01-01", VerifiedTo: "2026-01-01"}), "10", "")
+	if len(matches) != 1 || len(matches[0].Elements) != 1 || matches[0].Elements[0].ElementId != "e1" {
+		t.Errorf("elements verified on 2026-01-01 = %+v", matches)
+	}
+	matches = personMatches(stub, jsonArg(ElementSelector{VerifiedTo: "2025-12-31"}), "10", "")
+	if len(matches) != 0 {
+		t.Errorf("elements verified until 2025-12-31 = %+v", matches)
+	}
+}
+
+func TestQueryPersonsByElementAppliesConsent(t *testing.T) {
+	stub := newTestStub(t)
+	createConsentingPerson(stub)
+	stub.mustInvoke("grantConsent", "c1", jsonArg(Consent{Id: "k1", InstitutionId: "bank1", ElementTypes: []string{"ADDRESS"}, Purpose: "onboarding", ExpiresOn: "2026-06-01"}))
+
+	stub.as(RoleInstitution, "bank1")
+	if matches := personMatches(stub, jsonArg(ElementSelector{ElementType: "PASSPORT"}), "10", "", "onboarding"); len(matches) != 0 {
+		t.Errorf("bank1 found passports without consent: %+v", matches)
+	}
+	if matches := personMatches(stub, jsonArg(ElementSelector{ElementType: "ADDRESS"}), "10", "", "onboarding"); len(matches) != 1 {
+		t.Errorf("bank1 found %+v, expected the consented address", matches)
+	}
+	if matches := personMatches(stub, jsonArg(ElementSelector{}), "10", "", "onboarding"); len(matches) != 1 || len(matches[0].Elements) != 1 {
+		t.Errorf("bank1 found %+v, expected only the consented address", matches)
+	}
+
+	_, err := stub.query("queryPersonsByElement", jsonArg(ElementSelector{}), "10", "")
+	expectCode(t, err, ccerror.InvalidArgument)
+	if matches := personMatches(stub.as(RoleInstitution, "bank2"), jsonArg(ElementSelector{}), "10", "", "onboarding"); len(matches) != 0 {
+		t.Errorf("bank2 found %+v without consent", matches)
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+// Object type of the composite key element type specs are stored under
+const elementTypeObjectType = "ElementType"
+
+// Field value types an ElementTypeSpec can declare
+const (
+	FieldTypeString  = "string"
+	FieldTypeDate    = "date"
+	FieldTypeNumber  = "number"
+	FieldTypeBoolean = "boolean"
+)
+
+// ElementTypeSpec describes what an InfoElement of one type must look like.
+// With Fields set, ElementValue must be a JSON object holding those fields;
+// without, it is a plain string optionally matching ValuePattern. Values of
+// Private types never reach the ledger in clear text: they are sent as a
+// salted valueHash or sealed by the client.
+type ElementTypeSpec struct {
+	Name                string      `json:"name"`
+	Description         string      `json:"description"`
+	Fields              []FieldSpec `json:"fields"`
+	ValuePattern        string      `json:"valuePattern"`
+	AllowedStatuses     []string    `json:"allowedStatuses"`
+	DefaultValidityDays int         `json:"defaultValidityDays"`
+	Private             bool        `json:"private"`
+}
+
+// FieldSpec describes one field of a structured ElementValue
+type FieldSpec struct {
+	Name      string   `json:"name"`
+	Type      string   `json:"type"`
+	Required  bool     `json:"required"`
+	Pattern   string   `json:"pattern"`
+	MaxLength int      `json:"maxLength"`
+	Enum      []string `json:"enum"`
+}
+
+// FieldError is one reason an InfoElement does not conform to its type
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError collects every FieldError found in one InfoElement
+type ValidationError struct {
+	ElementId string       `json:"elementId"`
+	Fields    []FieldError `json:"fields"`
+}
+
+// Returns the collected field errors as one INVALID_ARGUMENT error
+func (validationError *ValidationError) toError() error {
+	return ccerror.New(ccerror.InvalidArgument, "infoElement", "InfoElement %s does not conform to its element type", validationError.ElementId).WithDetails(validationError.Fields)
+}
+
+func (validationError *ValidationError) add(field string, message string) {
+	validationError.Fields = append(validationError.Fields, FieldError{Field: field, Message: message})
+}
+
+// Checks that a spec is itself well formed before it is stored
+func validateElementTypeSpec(spec ElementTypeSpec) error {
+	if spec.Name == "" {
+		return ccerror.New(ccerror.InvalidArgument, "name", "Element type name is required")
+	}
+	if spec.DefaultValidityDays < 0 {
+		return ccerror.New(ccerror.InvalidArgument, "defaultValidityDays", "defaultValidityDays must not be negative")
+	}
+	if _, err := regexp.Compile(spec.ValuePattern); err != nil {
+		return ccerror.New(ccerror.InvalidArgument, "valuePattern", "Invalid valuePattern: %s", err.Error())
+	}
+
+	seen := map[string]bool{}
+	for _, field := range spec.Fields {
+		if field.Name == "" {
+			return ccerror.New(ccerror.InvalidArgument, "fields", "Every field needs a name")
+		}
+		if seen[field.Name] {
+			return ccerror.New(ccerror.InvalidArgument, "fields", "Field %s is declared twice", field.Name)
+		}
+		seen[field.Name] = true
+
+		switch field.Type {
+		case FieldTypeString, FieldTypeDate, FieldTypeNumber, FieldTypeBoolean:
+		default:
+			return ccerror.New(ccerror.InvalidArgument, "fields", "Field %s has unknown type %s", field.Name, field.Type)
+		}
+		if _, err := regexp.Compile(field.Pattern); err != nil {
+			return ccerror.New(ccerror.InvalidArgument, "fields", "Field %s has an invalid pattern: %s", field.Name, err.Error())
+		}
+	}
+	return nil
+}
+
+// Checks an InfoElement against the spec of its type and fills in ValidTill
+// from the default validity period. Values held off-ledger as a salted hash or
+// encrypted by the client cannot be inspected, so only their dates are checked. AllowedStatuses is
+// enforced by verifyInfoElement, the only place statuses are chosen.
+func (kyc *KYCChaincode) conformInfoElement(stub shim.ChaincodeStubInterface, infoElement *InfoElement, privateValue bool) error {
+	validationError := &ValidationError{ElementId: infoElement.Id, Fields: []FieldError{}}
+
+	if infoElement.Id == "" {
+		validationError.add("id", "is required")
+	}
+
+	spec, err := kyc.getElementType(stub, infoElement.ElementType)
+	if err != nil {
+		return err
+	}
+	if spec == nil {
+		validationError.add("elementType", "unknown element type "+infoElement.ElementType)
+		return validationError.toError()
+	}
+
+	if infoElement.ValidTill != "" {
+		if _, err := parseDate(infoElement.ValidTill); err != nil {
+			validationError.add("validTill", err.Error())
+		}
+	}
+
+	if spec.Private && infoElement.ElementValue != "" && !isSealed(infoElement.ElementValue) {
+		validationError.add("elementValue", "must not be sent in clear text for private element type "+spec.Name+", send a valueHash instead")
+	} else if !privateValue && !isSealed(infoElement.ElementValue) {
+		validateElementValue(*spec, infoElement.ElementValue, validationError)
+	}
+
+	if len(validationError.Fields) > 0 {
+		return validationError.toError()
+	}
+
+	if infoElement.ValidTill == "" && spec.DefaultValidityDays > 0 {
+		now, err := getTxTime(stub)
+		if err != nil {
+			return err
+		}
+		infoElement.ValidTill = now.AddDate(0, 0, spec.DefaultValidityDays).Format("2006-01-02")
+	}
+
+	return nil
+}
+
+func validateElementValue(spec ElementTypeSpec, elementValue string, validationError *ValidationError) {
+	if len(spec.Fields) == 0 {
+		if spec.ValuePattern != "" && !regexp.MustCompile(spec.ValuePattern).MatchString(elementValue) {
+			validationError.add("elementValue", "does not match the pattern of "+spec.Name)
+		}
+		return
+	}
+
+	values := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(elementValue), &values); err != nil {
+		validationError.add("elementValue", "must be a JSON object")
+		return
+	}
+
+	declared := map[string]bool{}
+	for _, field := range spec.Fields {
+		declared[field.Name] = true
+		value, present := values[field.Name]
+		if !present || value == nil {
+			if field.Required {
+				validationError.add("elementValue."+field.Name, "is required")
+			}
+			continue
+		}
+		if message := validateFieldValue(field, value); message != "" {
+			validationError.add("elementValue."+field.Name, message)
+		}
+	}
+
+	undeclared := []string{}
+	for name := range values {
+		if !declared[name] {
+			undeclared = append(undeclared, name)
+		}
+	}
+	sort.Strings(undeclared)
+	for _, name := range undeclared {
+		validationError.add("elementValue."+name, "is not defined for "+spec.Name)
+	}
+}
+
+// Returns why a field value does not match its spec, or an empty string
+func validateFieldValue(field FieldSpec, value interface{}) string {
+	switch field.Type {
+	case FieldTypeNumber:
+		if _, ok := value.(float64); !ok {
+			return "must be a number"
+		}
+		return ""
+	case FieldTypeBoolean:
+		if _, ok := value.(bool); !ok {
+			return "must be a boolean"
+		}
+		return ""
+	}
+
+	text, ok := value.(string)
+	if !ok {
+		return "must be a string"
+	}
+	if field.Type == FieldTypeDate {
+		if _, err := parseDate(text); err != nil {
+			return err.Error()
+		}
+	}
+	if field.MaxLength > 0 && len([]rune(text)) > field.MaxLength {
+		return fmt.Sprintf("must be at most %d characters", field.MaxLength)
+	}
+	if len(field.Enum) > 0 && !containsString(field.Enum, text) {
+		return "must be one of the allowed values"
+	}
+	if field.Pattern != "" && !regexp.MustCompile(field.Pattern).MatchString(text) {
+		return "does not match the required pattern"
+	}
+	return ""
+}
+
+// Creates or replaces an element type spec
+func (kyc *KYCChaincode) registerElementType(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: registerElementType called")
+
+	if len(args) != 1 {
+		return nil, ccerror.IncorrectArgs("1")
+	}
+
+	spec := ElementTypeSpec{}
+	err := json.Unmarshal([]byte(args[0]), &spec)
+	if err != nil {
+		return nil, ccerror.New(ccerror.InvalidArgument, "elementType", "Failed to unmarshal element type: %s", err.Error())
+	}
+	err = validateElementTypeSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := createCompositeKey(elementTypeObjectType, []string{spec.Name})
+	if err != nil {
+		return nil, err
+	}
+
+	jsonAsBytes, _ := json.Marshal(spec)
+	err = stub.PutState(key, jsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (kyc *KYCChaincode) removeElementType(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: removeElementType called")
+
+	if len(args) != 1 {
+		return nil, ccerror.IncorrectArgs("1")
+	}
+
+	spec, err := kyc.getElementType(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if spec == nil {
+		return nil, ccerror.New(ccerror.NotFound, "elementType", "Element type not found")
+	}
+
+	key, _ := createCompositeKey(elementTypeObjectType, []string{args[0]})
+	err = stub.DelState(key)
+	if err != nil {
+		return nil, ccerror.New(ccerror.Internal, "", "Failed to delete state")
+	}
+
+	return nil, nil
+}
+
+// Lists every registered element type in name order
+func (kyc *KYCChaincode) queryElementTypes(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: queryElementTypes called")
+
+	if len(args) != 0 {
+		return nil, ccerror.IncorrectArgs("0")
+	}
+
+	startKey, endKey, err := compositeKeyRange(elementTypeObjectType, []string{})
+	if err != nil {
+		return nil, err
+	}
+
+	iterator, err := stub.RangeQueryState(startKey, endKey)
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	specs := []ElementTypeSpec{}
+	for iterator.HasNext() {
+		_, specJSONAsBytes, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		spec := ElementTypeSpec{}
+		err = json.Unmarshal(specJSONAsBytes, &spec)
+		if err != nil {
+			return nil, ccerror.New(ccerror.Internal, "", "Failed to unmarshal element type: %s", err.Error())
+		}
+		specs = append(specs, spec)
+	}
+
+	jsonAsBytes, _ := json.Marshal(specs)
+	return jsonAsBytes, nil
+}
+
+// Reads an element type spec, returning nil if the type is not registered
+func (kyc *KYCChaincode) getElementType(stub shim.ChaincodeStubInterface, name string) (*ElementTypeSpec, error) {
+	if name == "" {
+		return nil, nil
+	}
+
+	key, err := createCompositeKey(elementTypeObjectType, []string{name})
+	if err != nil {
+		return nil, err
+	}
+
+	specJSONAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, ccerror.New(ccerror.Internal, "", "Failed to get state for element type %s", name)
+	}
+	if specJSONAsBytes == nil {
+		return nil, nil
+	}
+
+	spec := ElementTypeSpec{}
+	err = json.Unmarshal(specJSONAsBytes, &spec)
+	if err != nil {
+		return nil, ccerror.New(ccerror.Internal, "", "Failed to unmarshal element type %s: %s", name, err.Error())
+	}
+
+	return &spec, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+// Transient key carrying a JSON object of base64 keys by id to decrypt with.
+// Only queries take it, since the caller metadata of an invoke is written into
+// the block.
+const transientPersonKeys = "personKeys"
+
+// Object type of the records of the keys registered for a person, keyed by
+// person id and key id
+const personKeyObjectType = "PersonKey"
+
+// Prefix of an encrypted field value, followed by the key id, a colon and the
+// base64 encoded nonce and ciphertext
+const sealedValuePrefix = "enc:v1:"
+
+// Keys are AES-256 keys
+const personKeyLength = 32
+
+// A sealed payload holds at least the GCM nonce and tag
+const minSealedPayloadLength = 12 + 16
+
+var keyIdPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+var fingerprintPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// The v0.6 shim has no private data collections and no transient map, so
+// anything an invoke receives ends up in the block. Element values and
+// comments are therefore encrypted by the data controller before they are
+// submitted: AES-256-GCM with a random 12 byte nonce, the element id, a NUL
+// byte and the field name as additional data, stored as
+// enc:v1:<keyId>:base64(nonce || ciphertext). The chaincode never sees a key.
+// It only records the key ids registered for a person with a fingerprint,
+// hex HMAC-SHA256 of "kyc key fingerprint" under the key, and rejects clear
+// values and unknown keys once a person has a key.
+
+// PersonKey records that a key was registered for a person. Retired keys
+// can still decrypt but no longer encrypt.
+type PersonKey struct {
+	PersonId     string `json:"personId"`
+	KeyId        string `json:"keyId"`
+	Fingerprint  string `json:"fingerprint"`
+	RegisteredOn string `json:"registeredOn"`
+	RetiredOn    string `json:"retiredOn,omitempty"`
+	TxId         string `json:"txId"`
+}
+
+// fieldCipher opens InfoElement fields sealed with one person key
+type fieldCipher struct {
+	keyId string
+	aead  cipher.AEAD
+}
+
+func newFieldCipher(keyId string, key []byte) (*fieldCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, ccerror.New(ccerror.InvalidArgument, transientPersonKeys, "Invalid key: %s", err.Error())
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, ccerror.New(ccerror.Internal, "", "Failed to create cipher: %s", err.Error())
+	}
+	return &fieldCipher{keyId: keyId, aead: aead}, nil
+}
+
+func keyFingerprint(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("kyc key fingerprint"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Decrypts a value sealed by the client with the same key
+func (fieldCipher *fieldCipher) open(elementId string, field string, value string) (string, error) {
+	keyId, payload := splitSealedValue(value)
+	if keyId != fieldCipher.keyId {
+		return "", ccerror.New(ccerror.InvalidArgument, transientPersonKeys, "%s of element %s is encrypted with key %s", field, elementId, keyId)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(payload)
+	nonceSize := fieldCipher.aead.NonceSize()
+	if err != nil || len(sealed) < nonceSize {
+		return "", ccerror.New(ccerror.Internal, "", "Malformed encrypted %s on element %s", field, elementId)
+	}
+
+	plaintext, err := fieldCipher.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(elementId+"\x00"+field))
+	if err != nil {
+		return "", ccerror.New(ccerror.InvalidArgument, transientPersonKeys, "Failed to decrypt %s of element %s", field, elementId)
+	}
+	return string(plaintext), nil
+}
+
+func isSealed(value string) bool {
+	return strings.HasPrefix(value, sealedValuePrefix)
+}
+
+// Returns the key id and the encoded payload of a sealed value
+func splitSealedValue(value string) (string, string) {
+	rest := strings.TrimPrefix(value, sealedValuePrefix)
+	separator := strings.Index(rest, ":")
+	if separator < 0 {
+		return "", rest
+	}
+	return rest[:separator], rest[separator+1:]
+}
+
+// Checks the format of a sealed value and returns its key id
+func parseSealedValue(elementId string, field string, value string) (string, error) {
+	keyId, payload := splitSealedValue(value)
+	if !keyIdPattern.MatchString(keyId) {
+		return "", ccerror.New(ccerror.InvalidArgument, field, "%s of element %s names an invalid key id", field, elementId)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil || len(sealed) < minSealedPayloadLength {
+		return "", ccerror.New(ccerror.InvalidArgument, field, "Malformed encrypted %s on element %s", field, elementId)
+	}
+	return keyId, nil
+}
+
+// Checks the value and comments of an element that is about to be stored.
+// Sealed fields must name an active key of the person. Once a person has a
+// key, clear values and comments are refused.
+func checkSealedInfoElement(stub shim.ChaincodeStubInterface, person Person, infoElement InfoElement) error {
+	for _, field := range []struct {
+		name  string
+		value string
+	}{{"elementValue", infoElement.ElementValue}, {"comments", infoElement.Comments}} {
+		if field.value == "" {
+			continue
+		}
+		if !isSealed(field.value) {
+			if len(person.EncryptionKeyIds) > 0 {
+				return ccerror.New(ccerror.InvalidArgument, field.name, "Values of person %s are encrypted, seal %s with one of its keys", person.Id, field.name)
+			}
+			continue
+		}
+
+		keyId, err := parseSealedValue(infoElement.Id, field.name, field.value)
+		if err != nil {
+			return err
+		}
+		record, err := getPersonKey(stub, person.Id, keyId)
+		if err != nil {
+			return err
+		}
+		if record == nil {
+			return ccerror.New(ccerror.NotFound, field.name, "Key %s is not registered for person %s", keyId, person.Id)
+		}
+		if record.RetiredOn != "" {
+			return ccerror.New(ccerror.InvalidArgument, field.name, "Key %s was retired on %s", keyId, record.RetiredOn)
+		}
+	}
+	return nil
+}
+
+// Registers a key for a person. Arguments are the person id, the key id and
+// the fingerprint of the key. The key itself stays with the data controller.
+func (kyc *KYCChaincode) registerPersonKey(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: registerPersonKey called")
+
+	if len(args) != 3 {
+		return nil, ccerror.IncorrectArgs("3")
+	}
+	keyId := args[1]
+	fingerprint := args[2]
+	if !keyIdPattern.MatchString(keyId) {
+		return nil, ccerror.New(ccerror.InvalidArgument, "keyId", "Key id must be 1 to 64 letters, digits, dots, dashes or underscores")
+	}
+	if !fingerprintPattern.MatchString(fingerprint) {
+		return nil, ccerror.New(ccerror.InvalidArgument, "fingerprint", "Fingerprint must be 64 lowercase hex digits")
+	}
+
+	person, err := kyc.mustGetPerson(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	record, err := getPersonKey(stub, person.Id, keyId)
+	if err != nil {
+		return nil, err
+	}
+	if record != nil {
+		return nil, ccerror.New(ccerror.AlreadyExists, "keyId", "Key %s is already registered for person %s", keyId, person.Id)
+	}
+
+	err = putPersonKey(stub, person.Id, keyId, fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	person.EncryptionKeyIds = append(person.EncryptionKeyIds, keyId)
+	err = kyc.putPerson(stub, person)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("CHAINCODE: Returning from registerPersonKey")
+
+	return nil, nil
+}
+
+// keyring holds the person keys passed to a query. Values are read with
+// whichever key sealed them.
+type keyring struct {
+	ciphers map[string]*fieldCipher
+}
+
+// Returns a keyring of the keys passed as personKeys in the transient inputs
+// of a query. Every key must be registered for the person and match its
+// fingerprint.
+func (kyc *KYCChaincode) getReadKeyring(stub shim.ChaincodeStubInterface, person Person) (*keyring, error) {
+	transient, err := getTransient(stub)
+	if err != nil {
+		return nil, err
+	}
+	readKeysJSON, ok := transient[transientPersonKeys]
+	if !ok {
+		return nil, ccerror.New(ccerror.InvalidArgument, transientPersonKeys, "Pass %s to decrypt", transientPersonKeys)
+	}
+
+	readKeys := map[string][]byte{}
+	err = json.Unmarshal(readKeysJSON, &readKeys)
+	if err != nil {
+		return nil, ccerror.New(ccerror.InvalidArgument, transientPersonKeys, "%s must be a JSON object of base64 keys: %s", transientPersonKeys, err.Error())
+	}
+	// Sorted so every peer reports the same error for the same input
+	keyIds := []string{}
+	for keyId := range readKeys {
+		keyIds = append(keyIds, keyId)
+	}
+	sort.Strings(keyIds)
+
+	ring := &keyring{ciphers: map[string]*fieldCipher{}}
+	for _, keyId := range keyIds {
+		readKey := readKeys[keyId]
+		err = checkPersonKey(stub, person.Id, keyId, readKey)
+		if err != nil {
+			return nil, err
+		}
+		ring.ciphers[keyId], err = newFieldCipher(keyId, readKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ring, nil
+}
+
+// Checks key material against the fingerprint registered for the key id
+func checkPersonKey(stub shim.ChaincodeStubInterface, personId string, keyId string, key []byte) error {
+	if !keyIdPattern.MatchString(keyId) {
+		return ccerror.New(ccerror.InvalidArgument, transientPersonKeys, "Key id must be 1 to 64 letters, digits, dots, dashes or underscores")
+	}
+	if len(key) != personKeyLength {
+		return ccerror.New(ccerror.InvalidArgument, transientPersonKeys, "Key %s must be %d bytes", keyId, personKeyLength)
+	}
+
+	record, err := getPersonKey(stub, personId, keyId)
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		return ccerror.New(ccerror.NotFound, transientPersonKeys, "Key %s is not registered for person %s", keyId, personId)
+	}
+	if !hmac.Equal([]byte(record.Fingerprint), []byte(keyFingerprint(key))) {
+		return ccerror.New(ccerror.Forbidden, transientPersonKeys, "Key does not match key id %s", keyId)
+	}
+	return nil
+}
+
+// Returns a copy of a stored element with its value and comments decrypted.
+// Every sealed field must be readable with the keys of the keyring.
+func openInfoElement(infoElement InfoElement, ring *keyring) (InfoElement, error) {
+	var err error
+	infoElement.ElementValue, err = ring.open(infoElement.Id, "elementValue", infoElement.ElementValue)
+	if err != nil {
+		return infoElement, err
+	}
+	infoElement.Comments, err = ring.open(infoElement.Id, "comments", infoElement.Comments)
+	if err != nil {
+		return infoElement, err
+	}
+	return infoElement, nil
+}
+
+// Decrypts a field with the key that sealed it. Clear values are returned as is.
+func (ring *keyring) open(elementId string, field string, value string) (string, error) {
+	if !isSealed(value) {
+		return value, nil
+	}
+
+	keyId, _ := splitSealedValue(value)
+	fieldCipher, ok := ring.ciphers[keyId]
+	if !ok {
+		return "", ccerror.New(ccerror.InvalidArgument, transientPersonKeys, "%s of element %s is encrypted with key %s, which was not passed", field, elementId, keyId)
+	}
+	return fieldCipher.open(elementId, field, value)
+}
+
+func personKeyKey(personId string, keyId string) (string, error) {
+	return createCompositeKey(personKeyObjectType, []string{personId, keyId})
+}
+
+// Reads a key record, returning nil if it does not exist
+func getPersonKey(stub shim.ChaincodeStubInterface, personId string, keyId string) (*PersonKey, error) {
+	key, err := personKeyKey(personId, keyId)
+	if err != nil {
+		return nil, err
+	}
+
+	recordJSONAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, ccerror.New(ccerror.Internal, "", "Failed to get key %s of %s", keyId, personId)
+	}
+	if recordJSONAsBytes == nil {
+		return nil, nil
+	}
+
+	record := PersonKey{}
+	err = json.Unmarshal(recordJSONAsBytes, &record)
+	if err != nil {
+		return nil, ccerror.New(ccerror.Internal, "", "Failed to unmarshal key %s of %s", keyId, personId)
+	}
+	return &record, nil
+}
+
+func putPersonKey(stub shim.ChaincodeStubInterface, personId string, keyId string, fingerprint string) error {
+	now, err := getTxTime(stub)
+	if err != nil {
+		return err
+	}
+
+	key, err := personKeyKey(personId, keyId)
+	if err != nil {
+		return err
+	}
+
+	jsonAsBytes, _ := json.Marshal(PersonKey{
+		PersonId:     personId,
+		KeyId:        keyId,
+		Fingerprint:  fingerprint,
+		RegisteredOn: now.Format(time.RFC3339),
+		TxId:         stub.GetTxID(),
+	})
+	return stub.PutState(key, jsonAsBytes)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"testing"
+
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+// Encrypts a field the way a client does before submitting it. The nonce is
+// derived from the input only to keep the tests deterministic.
+func clientSeal(key []byte, keyId string, elementId string, field string, value string) string {
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+	digest := sha256.Sum256([]byte(keyId + elementId + field + value))
+	nonce := digest[:aead.NonceSize()]
+	sealed := aead.Seal(nonce, nonce, []byte(value), []byte(elementId+"\x00"+field))
+	return sealedValuePrefix + keyId + ":" + base64.StdEncoding.EncodeToString(sealed)
+}
+
+func TestSealedValuesNeedARegisteredKey(t *testing.T) {
+	stub := newTestStub(t)
+	createConsentingPerson(stub)
+	stub.as(RoleCustomer, "c1")
+
+	_, err := stub.invoke("registerPersonKey", "c1", "k1", "not a fingerprint")
+	expectCode(t, err, ccerror.InvalidArgument)
+	stub.mustInvoke("registerPersonKey", "c1", "k1", keyFingerprint(testKey))
+	_, err = stub.invoke("registerPersonKey", "c1", "k1", keyFingerprint(testKey))
+	expectCode(t, err, ccerror.AlreadyExists)
+	if keyIds := storedPerson(stub, "c1").EncryptionKeyIds; len(keyIds) != 1 || keyIds[0] != "k1" {
+		t.Errorf("encryptionKeyIds = %v", keyIds)
+	}
+
+	_, err = stub.invoke("updateInfoElement", "c1", jsonArg(InfoElement{Id: "e3", ElementType: "PASSPORT", ElementValue: "X3"}))
+	expectCode(t, err, ccerror.InvalidArgument)
+	_, err = stub.invoke("updateInfoElement", "c1", jsonArg(InfoElement{Id: "e3", ElementType: "PASSPORT", ElementValue: clientSeal(testKey, "k2", "e3", "elementValue", "X3")}))
+	expectCode(t, err, ccerror.NotFound)
+	_, err = stub.invoke("updateInfoElement", "c1", jsonArg(InfoElement{Id: "e3", ElementType: "PASSPORT", ElementValue: sealedValuePrefix + "k1:c2hvcnQ="}))
+	expectCode(t, err, ccerror.InvalidArgument)
+
+	sealedValue := clientSeal(testKey, "k1", "e3", "elementValue", "X3")
+	sealedComments := clientSeal(testKey, "k1", "e3", "comments", "scanned at branch")
+	stub.mustInvoke("updateInfoElement", "c1", jsonArg(InfoElement{Id: "e3", ElementType: "PASSPORT", ElementValue: sealedValue, Comments: sealedComments}))
+	stored := findInfoElement(storedPerson(stub, "c1"), "e3")
+	if stored.ElementValue != sealedValue || stored.Comments != sealedComments {
+		t.Errorf("stored element = %+v", *stored)
+	}
+
+	_, err = stub.invoke("updateInfoElements", "c1", jsonArg(map[string]interface{}{
+		"elements": []InfoElement{{Id: "e4", ElementType: "PASSPORT", Comments: "clear"}},
+	}))
+	if results := batchErrors(t, err); results[0].Error == nil || results[0].Error.Field != "comments" {
+		t.Errorf("results = %+v", results)
+	}
+}
+
+func TestSealedValuesSkipValuePatterns(t *testing.T) {
+	stub := newTestStub(t)
+	stub.mustInvoke("registerElementType", jsonArg(ElementTypeSpec{Name: "PASSPORT", ValuePattern: "^[A-Z][0-9]+$"}))
+	stub.mustInvoke("createPerson", "c1")
+	stub.mustInvoke("registerPersonKey", "c1", "k1", keyFingerprint(testKey))
+
+	stub.mustInvoke("updateInfoElement", "c1", jsonArg(InfoElement{Id: "e1", ElementType: "PASSPORT", ElementValue: clientSeal(testKey, "k1", "e1", "elementValue", "X1")}))
+	_, err := stub.invoke("updateInfoElement", "c1", jsonArg(InfoElement{Id: "e1", ElementType: "PASSPORT", ElementValue: "not sealed"}))
+	expectCode(t, err, ccerror.InvalidArgument)
+}
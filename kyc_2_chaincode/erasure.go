@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+// Object type of the erasure receipts, keyed by person id
+const personErasureObjectType = "PersonErasure"
+
+// Erasure removes a person from the world state only. Every value ever
+// written is still in the block history, and values that were written in
+// clear remain readable there. Values the client encrypted become unreadable
+// once the data controller destroys the keys listed in the receipt.
+
+// ErasureReceipt records the erasure of a person. KeyIds are the keys
+// registered for the person, which the data controller should destroy.
+type ErasureReceipt struct {
+	PersonId         string   `json:"personId"`
+	ErasedOn         string   `json:"erasedOn"`
+	ErasedBy         string   `json:"erasedBy"`
+	TxId             string   `json:"txId"`
+	Reason           string   `json:"reason"`
+	KeyIds           []string `json:"keyIds"`
+	RedactedRequests []string `json:"redactedRequests"`
+	PurgedKeys       int      `json:"purgedKeys"`
+}
+
+// Erases a person from the world state. Arguments are the person id and an
+// optional reason. The Person is replaced by a tombstone, its requests are
+// redacted, and its history, consents, key records and indexes are deleted.
+// Persons already removed with deletePerson are erased the same way. The
+// receipt is stored and returned.
+func (kyc *KYCChaincode) erasePerson(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: erasePerson called")
+
+	if len(args) != 1 && len(args) != 2 {
+		return nil, ccerror.IncorrectArgs("1 or 2")
+	}
+
+	// A person removed with deletePerson still has its history, requests and
+	// other records, so it can be erased as long as any of them are left
+	person, err := kyc.getPerson(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if person == nil {
+		remains, err := kyc.hasPersonRecords(stub, args[0])
+		if err != nil {
+			return nil, err
+		}
+		if !remains {
+			return nil, personNotFound(args[0])
+		}
+		person = &Person{Id: args[0]}
+	}
+
+	now, err := getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	actor, err := getActor(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	receipt := ErasureReceipt{
+		PersonId:         person.Id,
+		ErasedOn:         now.Format(time.RFC3339),
+		ErasedBy:         actor,
+		TxId:             stub.GetTxID(),
+		KeyIds:           []string{},
+		RedactedRequests: []string{},
+	}
+	if len(args) == 2 {
+		receipt.Reason = args[1]
+	}
+	tombstone := Person{Id: person.Id, SchemaVersion: personSchemaVersion, ErasedOn: receipt.ErasedOn, InfoElements: []InfoElement{}}
+
+	receipt.RedactedRequests, err = kyc.redactRequests(stub, tombstone)
+	if err != nil {
+		return nil, err
+	}
+
+	keyKeys, err := rangeKeys(stub, personKeyObjectType, []string{person.Id})
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keyKeys {
+		_, keyParts, err := splitCompositeKey(key)
+		if err != nil {
+			return nil, err
+		}
+		receipt.KeyIds = append(receipt.KeyIds, keyParts[1])
+	}
+
+	for _, objectType := range []string{personKeyObjectType, personHistoryObjectType, consentObjectType, personMigrationObjectType, riskAssessmentObjectType, personObjectType} {
+		purged, err := deleteKeyRange(stub, objectType, []string{person.Id})
+		if err != nil {
+			return nil, err
+		}
+		receipt.PurgedKeys += purged
+	}
+
+	jsonAsBytes, _ := json.Marshal(tombstone)
+	err = stub.PutState(person.Id, jsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	receiptKey, err := createCompositeKey(personErasureObjectType, []string{person.Id})
+	if err != nil {
+		return nil, err
+	}
+	receiptJSONAsBytes, _ := json.Marshal(receipt)
+	err = stub.PutState(receiptKey, receiptJSONAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	err = emitEvent(stub, KYCEvent{Type: EventPersonErased, PersonId: person.Id})
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("CHAINCODE: Returning from erasePerson")
+
+	return receiptJSONAsBytes, nil
+}
+
+// Object types holding records of a person under keys led by its id
+var personRecordObjectTypes = []string{requestByPersonObjectType, personKeyObjectType, personHistoryObjectType, consentObjectType, personMigrationObjectType, riskAssessmentObjectType, personObjectType}
+
+// Checks whether any record of a person is left in the world state
+func (kyc *KYCChaincode) hasPersonRecords(stub shim.ChaincodeStubInterface, personId string) (bool, error) {
+	for _, objectType := range personRecordObjectTypes {
+		keys, err := rangeKeys(stub, objectType, []string{personId})
+		if err != nil {
+			return false, err
+		}
+		if len(keys) > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Replaces the Person snapshot of every request and request version of the
+// person with the tombstone, including requests still in the legacy list, and
+// clears the free text written about the person. Returns the ids of the
+// redacted requests.
+func (kyc *KYCChaincode) redactRequests(stub shim.ChaincodeStubInterface, tombstone Person) ([]string, error) {
+	indexKeys, err := rangeKeys(stub, requestByPersonObjectType, []string{tombstone.Id})
+	if err != nil {
+		return nil, err
+	}
+
+	redacted := []string{}
+	for _, indexKey := range indexKeys {
+		_, keyParts, err := splitCompositeKey(indexKey)
+		if err != nil {
+			return nil, err
+		}
+
+		request, err := kyc.getRequest(stub, keyParts[1])
+		if err != nil {
+			return nil, err
+		}
+		if request == nil {
+			continue
+		}
+		redactRequest(request, tombstone)
+		err = kyc.putRequest(stub, *request)
+		if err != nil {
+			return nil, err
+		}
+
+		err = redactRequestVersions(stub, request.Id, tombstone)
+		if err != nil {
+			return nil, err
+		}
+		redacted = append(redacted, request.Id)
+	}
+
+	legacyJSONAsBytes, err := stub.GetState(submittedRequestsListId)
+	if err != nil {
+		return nil, ccerror.New(ccerror.Internal, "", "Failed to get state for %s", submittedRequestsListId)
+	}
+	if legacyJSONAsBytes == nil {
+		return redacted, nil
+	}
+
+	legacyRequests := []SubmittedRequest{}
+	err = json.Unmarshal(legacyJSONAsBytes, &legacyRequests)
+	if err != nil {
+		return nil, ccerror.New(ccerror.Internal, "", "Failed to unmarshal %s: %s", submittedRequestsListId, err.Error())
+	}
+	legacyRedacted := false
+	for i := range legacyRequests {
+		if legacyRequests[i].Person.Id == tombstone.Id {
+			redactRequest(&legacyRequests[i], tombstone)
+			legacyRedacted = true
+		}
+	}
+	if legacyRedacted {
+		jsonAsBytes, _ := json.Marshal(legacyRequests)
+		err = stub.PutState(submittedRequestsListId, jsonAsBytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return redacted, nil
+}
+
+// Keeps only the outcome of a request: its statuses, actors and alert kinds.
+// Reasons are free text and a hash of a name is easily guessed.
+func redactRequest(request *SubmittedRequest, tombstone Person) {
+	request.Person = tombstone
+	for i := range request.StatusHistory {
+		request.StatusHistory[i].Reason = ""
+	}
+	for i := range request.Alerts {
+		request.Alerts[i].MatchedName = ""
+		request.Alerts[i].Reason = ""
+		request.Alerts[i].SubjectHash = ""
+		request.Alerts[i].ClearReason = ""
+	}
+}
+
+func redactRequestVersions(stub shim.ChaincodeStubInterface, requestId string, tombstone Person) error {
+	versionKeys, err := rangeKeys(stub, requestVersionObjectType, []string{requestId})
+	if err != nil {
+		return err
+	}
+
+	for _, versionKey := range versionKeys {
+		versionJSONAsBytes, err := stub.GetState(versionKey)
+		if err != nil {
+			return err
+		}
+
+		version := RequestVersion{}
+		err = json.Unmarshal(versionJSONAsBytes, &version)
+		if err != nil {
+			return ccerror.New(ccerror.Internal, "", "Failed to unmarshal version of request %s: %s", requestId, err.Error())
+		}
+		version.Person = tombstone
+
+		jsonAsBytes, _ := json.Marshal(version)
+		err = stub.PutState(versionKey, jsonAsBytes)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns every key under the given object type and leading attributes. Keys
+// are collected before they are changed, since writes during a range query
+// are not reflected by the open iterator.
+func rangeKeys(stub shim.ChaincodeStubInterface, objectType string, attributes []string) ([]string, error) {
+	startKey, endKey, err := compositeKeyRange(objectType, attributes)
+	if err != nil {
+		return nil, err
+	}
+
+	iterator, err := stub.RangeQueryState(startKey, endKey)
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	keys := []string{}
+	for iterator.HasNext() {
+		key, _, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// Deletes every key under the given object type and leading attributes and
+// returns how many there were
+func deleteKeyRange(stub shim.ChaincodeStubInterface, objectType string, attributes []string) (int, error) {
+	keys, err := rangeKeys(stub, objectType, attributes)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, key := range keys {
+		err = stub.DelState(key)
+		if err != nil {
+			return 0, ccerror.New(ccerror.Internal, "", "Failed to delete state")
+		}
+	}
+
+	return len(keys), nil
+}
+
+// Returns the erasure receipt of a person
+func (kyc *KYCChaincode) queryErasureReceipt(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: queryErasureReceipt called")
+
+	if len(args) != 1 {
+		return nil, ccerror.IncorrectArgs("1")
+	}
+
+	receiptKey, err := createCompositeKey(personErasureObjectType, []string{args[0]})
+	if err != nil {
+		return nil, err
+	}
+
+	receiptJSONAsBytes, err := stub.GetState(receiptKey)
+	if err != nil {
+		return nil, ccerror.New(ccerror.Internal, "", "Failed to get erasure receipt for %s", args[0])
+	}
+	if receiptJSONAsBytes == nil {
+		return nil, ccerror.New(ccerror.NotFound, "personId", "Person with id %s was not erased", args[0])
+	}
+
+	return receiptJSONAsBytes, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+func TestErasePersonRedactsRequests(t *testing.T) {
+	stub := newTestStub(t)
+	submitRequest(stub)
+	stub.mustInvoke("registerPersonKey", "c1", "k1", keyFingerprint(testKey))
+	stub.as(RoleInstitution, "bank1").mustInvoke("startReview", "r1", "")
+	stub.mustInvoke("requestInfo", "r1", "address of c1 does not match the passport")
+
+	receipt := ErasureReceipt{}
+	json.Unmarshal(stub.as(RoleCustomer, "c1").mustInvoke("erasePerson", "c1", "customer request"), &receipt)
+	if receipt.PersonId != "c1" || len(receipt.KeyIds) != 1 || receipt.KeyIds[0] != "k1" || len(receipt.RedactedRequests) != 1 || receipt.PurgedKeys == 0 {
+		t.Errorf("receipt = %+v", receipt)
+	}
+
+	stored := ErasureReceipt{}
+	stub.as(RoleAdmin, "admin").mustQuery(&stored, "queryErasureReceipt", "c1")
+	if stored.TxId != receipt.TxId {
+		t.Errorf("stored receipt = %+v", stored)
+	}
+	_, err := stub.query("queryPerson", "c1")
+	expectCode(t, err, ccerror.NotFound)
+	if record, _ := getPersonKey(stub, "c1", "k1"); record != nil {
+		t.Errorf("key record survived the erasure: %+v", record)
+	}
+
+	request := stub.request("r1")
+	if request.Person.ErasedOn == "" || len(request.Person.InfoElements) != 0 {
+		t.Errorf("request still holds %+v", request.Person)
+	}
+	for _, change := range request.StatusHistory {
+		if change.Reason != "" {
+			t.Errorf("status change kept its reason: %+v", change)
+		}
+	}
+
+	_, err = stub.invoke("createPerson", "c1")
+	expectCode(t, err, ccerror.NotFound)
+}
+
+func TestEraseDeletedPerson(t *testing.T) {
+	stub := newTestStub(t)
+	submitRequest(stub)
+	stub.registerElementType("PASSPORT")
+	stub.mustInvoke("updateInfoElement", "c1", jsonArg(InfoElement{Id: "e1", ElementType: "PASSPORT", ElementValue: "X1"}))
+	stub.as(RoleAdmin, "admin").mustInvoke("withdrawRequest", "r1", "")
+	stub.mustInvoke("deletePerson", "c1")
+
+	receipt := ErasureReceipt{}
+	json.Unmarshal(stub.as(RoleCustomer, "c1").mustInvoke("erasePerson", "c1"), &receipt)
+	if len(receipt.RedactedRequests) != 1 || receipt.PurgedKeys == 0 {
+		t.Errorf("receipt = %+v", receipt)
+	}
+	if request := stub.request("r1"); request.Person.ErasedOn == "" {
+		t.Errorf("request still holds %+v", request.Person)
+	}
+	if keys, _ := rangeKeys(stub, personHistoryObjectType, []string{"c1"}); len(keys) != 0 {
+		t.Errorf("%d history records survived the erasure", len(keys))
+	}
+
+	_, err := stub.as(RoleAdmin, "admin").invoke("erasePerson", "c1")
+	expectCode(t, err, ccerror.NotFound)
+	_, err = stub.invoke("erasePerson", "c9")
+	expectCode(t, err, ccerror.NotFound)
+}
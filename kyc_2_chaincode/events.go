@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Version of the event payload layout. Bump it when fields change meaning.
+const eventPayloadVersion = "1"
+
+// Names of the chaincode events emitted by KYC mutations
+const (
+	EventPersonCreated        = "PersonCreated"
+	EventPersonDeleted        = "PersonDeleted"
+	EventPersonErased         = "PersonErased"
+	EventInfoElementUpdated   = "InfoElementUpdated"
+	EventInfoElementDeleted   = "InfoElementDeleted"
+	EventInfoElementsUpdated  = "InfoElementsUpdated"
+	EventRequestSubmitted     = "RequestSubmitted"
+	EventRequestStatusChanged = "RequestStatusChanged"
+	EventRiskAssessed         = "RiskAssessed"
+	EventAlertCleared         = "AlertCleared"
+)
+
+// KYCEvent is the payload of every chaincode event. It carries ids and hashes
+// only, never element values or comments.
+type KYCEvent struct {
+	Version      string   `json:"version"`
+	Type         string   `json:"type"`
+	TxId         string   `json:"txId"`
+	Timestamp    string   `json:"timestamp"`
+	PersonId     string   `json:"personId,omitempty"`
+	ElementId    string   `json:"elementId,omitempty"`
+	ElementType  string   `json:"elementType,omitempty"`
+	ElementIds   []string `json:"elementIds,omitempty"`
+	DeletedIds   []string `json:"deletedIds,omitempty"`
+	RequestId    string   `json:"requestId,omitempty"`
+	Status       string   `json:"status,omitempty"`
+	DocumentHash string   `json:"documentHash,omitempty"`
+	ValueHash    string   `json:"valueHash,omitempty"`
+	SnapshotHash string   `json:"snapshotHash,omitempty"`
+}
+
+// Fills in the envelope fields of an event and sets it on the transaction.
+// The v0.6 shim keeps only the last event set by a transaction, so an upsert
+// that creates a person emits PersonCreated carrying the element fields of
+// the update.
+func emitEvent(stub shim.ChaincodeStubInterface, event KYCEvent) error {
+	now, err := getTxTime(stub)
+	if err != nil {
+		return err
+	}
+
+	event.Version = eventPayloadVersion
+	event.TxId = stub.GetTxID()
+	event.Timestamp = now.Format(time.RFC3339)
+
+	payload, _ := json.Marshal(event)
+	return stub.SetEvent(event.Type, payload)
+}
+
+// Hashes the Person snapshot of a request so subscribers can detect changes
+// without seeing its contents
+func snapshotHash(person Person) string {
+	jsonAsBytes, _ := json.Marshal(person)
+	digest := sha256.Sum256(jsonAsBytes)
+	return hex.EncodeToString(digest[:])
+}
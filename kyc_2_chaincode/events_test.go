@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// CapturedEvent is one event recorded by an EventCapturingStub
+type CapturedEvent struct {
+	Name    string
+	Payload []byte
+}
+
+// EventCapturingStub wraps a stub and records every event set on it. The
+// v0.6 MockStub drops events.
+type EventCapturingStub struct {
+	shim.ChaincodeStubInterface
+	Events []CapturedEvent
+}
+
+func NewEventCapturingStub(stub shim.ChaincodeStubInterface) *EventCapturingStub {
+	return &EventCapturingStub{ChaincodeStubInterface: stub}
+}
+
+func (stub *EventCapturingStub) SetEvent(name string, payload []byte) error {
+	stub.Events = append(stub.Events, CapturedEvent{Name: name, Payload: payload})
+	return stub.ChaincodeStubInterface.SetEvent(name, payload)
+}
+
+// KYCEvents decodes the payloads of the captured events
+func (stub *EventCapturingStub) KYCEvents() ([]KYCEvent, error) {
+	events := []KYCEvent{}
+	for _, captured := range stub.Events {
+		event := KYCEvent{}
+		err := json.Unmarshal(captured.Payload, &event)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// Returns the single event set by the last invoke
+func (stub *testStub) lastEvent() KYCEvent {
+	stub.t.Helper()
+	events, err := stub.events.KYCEvents()
+	if err != nil {
+		stub.t.Fatalf("undecodable event: %s", err)
+	}
+	if len(events) != 1 {
+		stub.t.Fatalf("%d events were set, expected 1", len(events))
+	}
+	if stub.events.Events[0].Name != events[0].Type {
+		stub.t.Errorf("event %s carries type %s", stub.events.Events[0].Name, events[0].Type)
+	}
+	if events[0].Version != eventPayloadVersion || events[0].TxId != fmt.Sprintf("tx%d", stub.txs) || events[0].Timestamp == "" {
+		stub.t.Errorf("event envelope = %+v", events[0])
+	}
+	return events[0]
+}
+
+func TestPersonEvents(t *testing.T) {
+	stub := newTestStub(t)
+	stub.registerElementType("PASSPORT")
+
+	stub.as(RoleCustomer, "c1").mustInvoke("createPerson", "c1")
+	if event := stub.lastEvent(); event.Type != EventPersonCreated || event.PersonId != "c1" {
+		t.Errorf("createPerson set %+v", event)
+	}
+
+	stub.mustInvoke("updateInfoElement", "c1", jsonArg(InfoElement{Id: "e1", ElementType: "PASSPORT", ElementValue: "P1234567", Hash: "sha256:ab", Comments: "scanned at branch"}))
+	event := stub.lastEvent()
+	if event.Type != EventInfoElementUpdated || event.PersonId != "c1" || event.ElementId != "e1" || event.ElementType != "PASSPORT" ||
+		event.Status != ElementStatusPending || event.DocumentHash != "sha256:ab" {
+		t.Errorf("updateInfoElement set %+v", event)
+	}
+	payload := string(stub.events.Events[0].Payload)
+	if strings.Contains(payload, "P1234567") || strings.Contains(payload, "scanned at branch") {
+		t.Errorf("event payload carries the element value or comments: %s", payload)
+	}
+
+	stub.mustInvoke("updateInfoElements", "c1", jsonArg(map[string]interface{}{
+		"elements":  []InfoElement{{Id: "e2", ElementType: "PASSPORT", ElementValue: "P7654321"}},
+		"deletions": []string{"e1"},
+	}))
+	event = stub.lastEvent()
+	if event.Type != EventInfoElementsUpdated || len(event.ElementIds) != 1 || event.ElementIds[0] != "e2" || len(event.DeletedIds) != 1 || event.DeletedIds[0] != "e1" {
+		t.Errorf("updateInfoElements set %+v", event)
+	}
+
+	stub.mustInvoke("deleteInfoElement", "c1", "e2")
+	if event := stub.lastEvent(); event.Type != EventInfoElementDeleted || event.ElementId != "e2" {
+		t.Errorf("deleteInfoElement set %+v", event)
+	}
+
+	stub.mustInvoke("deletePerson", "c1")
+	if event := stub.lastEvent(); event.Type != EventPersonDeleted || event.PersonId != "c1" {
+		t.Errorf("deletePerson set %+v", event)
+	}
+}
+
+func TestUpsertsThatCreateAPersonEmitPersonCreated(t *testing.T) {
+	stub := newTestStub(t)
+	stub.registerElementType("PASSPORT")
+
+	stub.mustInvoke("updateInfoElement", "c1", jsonArg(InfoElement{Id: "e1", ElementType: "PASSPORT", ElementValue: "P1234567"}), "upsert")
+	if event := stub.lastEvent(); event.Type != EventPersonCreated || event.PersonId != "c1" || event.ElementId != "e1" {
+		t.Errorf("creating updateInfoElement set %+v", event)
+	}
+	stub.mustInvoke("updateInfoElement", "c1", jsonArg(InfoElement{Id: "e1", ElementType: "PASSPORT", ElementValue: "P7654321"}), "upsert")
+	if event := stub.lastEvent(); event.Type != EventInfoElementUpdated {
+		t.Errorf("updateInfoElement on an existing person set %+v", event)
+	}
+
+	batch := jsonArg(map[string]interface{}{"elements": []InfoElement{{Id: "e1", ElementType: "PASSPORT", ElementValue: "P1234567"}}})
+	stub.mustInvoke("updateInfoElements", "c2", batch, "upsert")
+	if event := stub.lastEvent(); event.Type != EventPersonCreated || event.PersonId != "c2" || len(event.ElementIds) != 1 {
+		t.Errorf("creating updateInfoElements set %+v", event)
+	}
+	stub.mustInvoke("updateInfoElements", "c2", batch, "upsert")
+	if event := stub.lastEvent(); event.Type != EventInfoElementsUpdated {
+		t.Errorf("updateInfoElements on an existing person set %+v", event)
+	}
+}
+
+func TestRequestEvents(t *testing.T) {
+	stub := newTestStub(t)
+	submitRequest(stub)
+
+	request := stub.request("r1")
+	event := stub.lastEvent()
+	if event.Type != EventRequestSubmitted || event.RequestId != "r1" || event.PersonId != "c1" ||
+		event.Status != RequestStatusSubmitted || event.SnapshotHash != snapshotHash(request.Person) {
+		t.Errorf("saveRequestState set %+v", event)
+	}
+
+	stub.as(RoleInstitution, "bank1").mustInvoke("startReview", "r1", "")
+	if event := stub.lastEvent(); event.Type != EventRequestStatusChanged || event.RequestId != "r1" || event.Status != RequestStatusUnderReview {
+		t.Errorf("startReview set %+v", event)
+	}
+}
+
+func TestFailedInvokesSetNoEvent(t *testing.T) {
+	stub := newTestStub(t)
+
+	_, err := stub.invoke("deletePerson", "missing")
+	if err == nil {
+		t.Fatal("deleting a missing person succeeded")
+	}
+	if len(stub.events.Events) != 0 {
+		t.Errorf("failed invoke set %d events", len(stub.events.Events))
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+// Object type of the single key the fee schedule is stored under
+const feeScheduleObjectType = "FeeSchedule"
+
+// Who a request fee is paid to
+const (
+	FeePayeeDataOwner = "DATA_OWNER"
+	FeePayeeVerifier  = "VERIFIER"
+)
+
+// FeeSchedule sets what an institution pays for each request it submits.
+// Amounts are whole units of the balances kept by LedgerChaincode, in
+// which institutions, persons and verifiers hold accounts under their ids.
+// Fees are moved with the certificate of the invoking institution, so the
+// ledger has to let only the owner of an account, or an admin, debit it, the
+// way test_chaincode does.
+// InstitutionFees overrides RequestFee per institution id. Version is bumped
+// by every setFeeSchedule.
+type FeeSchedule struct {
+	Version         int            `json:"version"`
+	UpdatedOn       string         `json:"updatedOn"`
+	TxId            string         `json:"txId"`
+	LedgerChaincode string         `json:"ledgerChaincode"`
+	RequestFee      int            `json:"requestFee"`
+	InstitutionFees map[string]int `json:"institutionFees"`
+	Payee           string         `json:"payee"`
+}
+
+// FeeCharge records the fee paid for a request
+type FeeCharge struct {
+	Payer     string        `json:"payer"`
+	Amount    int           `json:"amount"`
+	Transfers []FeeTransfer `json:"transfers"`
+	Schedule  int           `json:"scheduleVersion"`
+	ChargedOn string        `json:"chargedOn"`
+	TxId      string        `json:"txId"`
+}
+
+// FeeTransfer is one transfer of a fee to a payee account
+type FeeTransfer struct {
+	Account string `json:"account"`
+	Amount  int    `json:"amount"`
+}
+
+func validateFeeSchedule(schedule FeeSchedule) error {
+	if schedule.LedgerChaincode == "" {
+		return ccerror.New(ccerror.InvalidArgument, "ledgerChaincode", "Fee schedule must name the chaincode holding balances")
+	}
+	if schedule.Payee != FeePayeeDataOwner && schedule.Payee != FeePayeeVerifier {
+		return ccerror.New(ccerror.InvalidArgument, "payee", "Fee payee must be %s or %s", FeePayeeDataOwner, FeePayeeVerifier)
+	}
+	if schedule.RequestFee < 0 {
+		return ccerror.New(ccerror.InvalidArgument, "requestFee", "Request fee must not be negative")
+	}
+	institutionIds := []string{}
+	for institutionId := range schedule.InstitutionFees {
+		institutionIds = append(institutionIds, institutionId)
+	}
+	sort.Strings(institutionIds)
+	for _, institutionId := range institutionIds {
+		if fee := schedule.InstitutionFees[institutionId]; fee < 0 {
+			return ccerror.New(ccerror.InvalidArgument, "institutionFees", "Fee of institution %s must not be negative", institutionId)
+		}
+	}
+	return nil
+}
+
+// Replaces the fee schedule. A schedule with no fees switches charging off.
+func (kyc *KYCChaincode) setFeeSchedule(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: setFeeSchedule called")
+
+	if len(args) != 1 {
+		return nil, ccerror.IncorrectArgs("1")
+	}
+
+	schedule := FeeSchedule{}
+	err := json.Unmarshal([]byte(args[0]), &schedule)
+	if err != nil {
+		return nil, ccerror.New(ccerror.InvalidArgument, "feeSchedule", "Failed to unmarshal fee schedule: %s", err.Error())
+	}
+	err = validateFeeSchedule(schedule)
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := getFeeSchedule(stub)
+	if err != nil {
+		return nil, err
+	}
+	now, err := getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	schedule.Version = 1
+	if current != nil {
+		schedule.Version = current.Version + 1
+	}
+	schedule.UpdatedOn = now.Format(time.RFC3339)
+	schedule.TxId = stub.GetTxID()
+
+	key, err := createCompositeKey(feeScheduleObjectType, []string{})
+	if err != nil {
+		return nil, err
+	}
+	jsonAsBytes, _ := json.Marshal(schedule)
+	err = stub.PutState(key, jsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return jsonAsBytes, nil
+}
+
+func (kyc *KYCChaincode) queryFeeSchedule(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: queryFeeSchedule called")
+
+	if len(args) != 0 {
+		return nil, ccerror.IncorrectArgs("0")
+	}
+
+	schedule, err := getFeeSchedule(stub)
+	if err != nil {
+		return nil, err
+	}
+	if schedule == nil {
+		return nil, ccerror.New(ccerror.NotFound, "feeSchedule", "No fee schedule has been set")
+	}
+
+	jsonAsBytes, _ := json.Marshal(schedule)
+	return jsonAsBytes, nil
+}
+
+// Reads the fee schedule, returning nil if none was set
+func getFeeSchedule(stub shim.ChaincodeStubInterface) (*FeeSchedule, error) {
+	key, err := createCompositeKey(feeScheduleObjectType, []string{})
+	if err != nil {
+		return nil, err
+	}
+
+	scheduleJSONAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, ccerror.New(ccerror.Internal, "", "Failed to get fee schedule")
+	}
+	if scheduleJSONAsBytes == nil {
+		return nil, nil
+	}
+
+	schedule := FeeSchedule{}
+	err = json.Unmarshal(scheduleJSONAsBytes, &schedule)
+	if err != nil {
+		return nil, ccerror.New(ccerror.Internal, "", "Failed to unmarshal fee schedule: %s", err.Error())
+	}
+	return &schedule, nil
+}
+
+// Returns the fee the institution pays per request
+func (schedule FeeSchedule) feeFor(institutionId string) int {
+	if fee, ok := schedule.InstitutionFees[institutionId]; ok {
+		return fee
+	}
+	return schedule.RequestFee
+}
+
+// Splits a fee between its payee accounts. Verifier fees are shared evenly
+// between the distinct verifiers of the snapshot, the first in id order taking
+// the remainder, and go to the data owner when nothing was verified. The payer
+// is never one of its own payees.
+func (schedule FeeSchedule) transfers(person Person, amount int, payer string) ([]FeeTransfer, error) {
+	accounts := []string{}
+	if schedule.Payee == FeePayeeVerifier {
+		for _, infoElement := range person.InfoElements {
+			if infoElement.VerifiedBy != "" && infoElement.VerifiedBy != payer && !containsString(accounts, infoElement.VerifiedBy) {
+				accounts = append(accounts, infoElement.VerifiedBy)
+			}
+		}
+		sort.Strings(accounts)
+	}
+	if len(accounts) == 0 && person.Id != payer {
+		accounts = []string{person.Id}
+	}
+	if len(accounts) == 0 {
+		return nil, ccerror.New(ccerror.Conflict, "fee", "The request fee has no payee other than %s", payer)
+	}
+
+	transfers := []FeeTransfer{}
+	share := amount / len(accounts)
+	for i, account := range accounts {
+		transfer := FeeTransfer{Account: account, Amount: share}
+		if i == 0 {
+			transfer.Amount += amount % len(accounts)
+		}
+		if transfer.Amount > 0 {
+			transfers = append(transfers, transfer)
+		}
+	}
+	return transfers, nil
+}
+
+// Charges the fee of a newly submitted request to the institution submitting
+// it. The payer is always the invoker, never an account named in the request,
+// and only institutions can submit requests while a fee is due. The balance
+// is checked before anything is moved, so fees are never paid out of an
+// overdraft. Transfers made through InvokeChaincode belong to this
+// transaction, so a later failure of the request rolls them back too.
+// Returns nil when no fee is due.
+func (kyc *KYCChaincode) chargeRequestFee(stub shim.ChaincodeStubInterface, request SubmittedRequest) (*FeeCharge, error) {
+	schedule, err := getFeeSchedule(stub)
+	if err != nil || schedule == nil {
+		return nil, err
+	}
+	invoker, err := getInvoker(stub)
+	if err != nil {
+		return nil, err
+	}
+	amount := schedule.feeFor(invoker.Id)
+	if amount == 0 {
+		return nil, nil
+	}
+	if invoker.Role != RoleInstitution {
+		return nil, ccerror.New(ccerror.Forbidden, "fee", "Only institutions can submit requests while fees are charged")
+	}
+	payer := invoker.Id
+
+	balanceAsBytes, err := stub.QueryChaincode(schedule.LedgerChaincode, [][]byte{[]byte("query"), []byte(payer)})
+	if err != nil {
+		return nil, ccerror.New(ccerror.Conflict, "fee", "Failed to read the balance of %s from %s: %s", payer, schedule.LedgerChaincode, err.Error())
+	}
+	balance, err := strconv.Atoi(string(balanceAsBytes))
+	if err != nil {
+		return nil, ccerror.New(ccerror.Internal, "", "Balance of %s in %s is not a number", payer, schedule.LedgerChaincode)
+	}
+	if balance < amount {
+		return nil, ccerror.New(ccerror.Conflict, "fee", "Institution %s has insufficient funds for the request fee of %d", payer, amount)
+	}
+
+	transfers, err := schedule.transfers(request.Person, amount, payer)
+	if err != nil {
+		return nil, err
+	}
+	now, err := getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	charge := FeeCharge{
+		Payer:     payer,
+		Amount:    amount,
+		Transfers: transfers,
+		Schedule:  schedule.Version,
+		ChargedOn: now.Format(time.RFC3339),
+		TxId:      stub.GetTxID(),
+	}
+
+	for _, transfer := range charge.Transfers {
+		_, err = stub.InvokeChaincode(schedule.LedgerChaincode, [][]byte{[]byte("invoke"), []byte(charge.Payer), []byte(transfer.Account), []byte(strconv.Itoa(transfer.Amount))})
+		if err != nil {
+			return nil, ccerror.New(ccerror.Conflict, "fee", "Failed to transfer %d from %s to %s: %s", transfer.Amount, charge.Payer, transfer.Account, err.Error())
+		}
+	}
+
+	return &charge, nil
+}
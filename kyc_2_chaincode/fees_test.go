@@ -0,0 +1,143 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+// ledgerChaincode keeps balances the way test_chaincode does. Init takes
+// account and balance pairs, invoke moves an amount between two accounts and
+// query reads a balance.
+type ledgerChaincode struct{}
+
+func (cc ledgerChaincode) Init(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	for i := 0; i+1 < len(args); i += 2 {
+		err := stub.PutState(args[i], []byte(args[i+1]))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+func (cc ledgerChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	amount, _ := strconv.Atoi(args[2])
+	from, _ := cc.Query(stub, "query", args[:1])
+	to, _ := cc.Query(stub, "query", args[1:2])
+	fromBalance, _ := strconv.Atoi(string(from))
+	toBalance, _ := strconv.Atoi(string(to))
+	err := stub.PutState(args[0], []byte(strconv.Itoa(fromBalance-amount)))
+	if err != nil {
+		return nil, err
+	}
+	return nil, stub.PutState(args[1], []byte(strconv.Itoa(toBalance+amount)))
+}
+
+func (cc ledgerChaincode) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	balance, err := stub.GetState(args[0])
+	if err != nil || balance == nil {
+		return []byte("0"), err
+	}
+	return balance, nil
+}
+
+// Starts a ledger chaincode with the given balances and charges a request fee
+// of 5 to the verifiers. c1 consents to bank1, so bank1 can submit its requests.
+func chargeVerifiers(stub *testStub, balances ...string) *shim.MockStub {
+	stub.t.Helper()
+	stub.mustInvoke("grantConsent", "c1", jsonArg(Consent{Id: "k1", InstitutionId: "bank1", ElementTypes: []string{"PASSPORT", "ADDRESS"}, Purpose: "onboarding", ExpiresOn: "2026-06-01"}))
+	ledger := shim.NewMockStub("ledger", ledgerChaincode{})
+	ledger.MockInit("init", "init", balances)
+	stub.MockPeerChaincode("ledger", ledger)
+	stub.mustInvoke("setFeeSchedule", jsonArg(FeeSchedule{LedgerChaincode: "ledger", RequestFee: 5, Payee: FeePayeeVerifier}))
+	return ledger
+}
+
+// Reads a balance from the ledger chaincode
+func balanceOf(ledger *shim.MockStub, account string) int {
+	balance, _ := strconv.Atoi(string(ledger.State[account]))
+	return balance
+}
+
+func TestRequestFeeIsSplitBetweenVerifiers(t *testing.T) {
+	stub := newTestStub(t)
+	createConsentingPerson(stub)
+	stub.registerInstitution("bank1")
+	stub.registerVerifier("v1")
+	stub.registerVerifier("v2")
+	stub.as(RoleVerifier, "v1").mustInvoke("verifyInfoElement", "c1", "e1", ElementStatusVerified, "proof")
+	stub.as(RoleVerifier, "v2").mustInvoke("verifyInfoElement", "c1", "e2", ElementStatusVerified, "proof")
+	ledger := chargeVerifiers(stub.as(RoleAdmin, "admin"), "bank1", "20", "c1", "0")
+
+	stub.as(RoleInstitution, "bank1").mustInvoke("saveRequestState", "r1", "c1", "bank1")
+	fee := stub.request("r1").Fee
+	if fee == nil || fee.Payer != "bank1" || fee.Amount != 5 || len(fee.Transfers) != 2 {
+		t.Fatalf("fee = %+v", fee)
+	}
+	for account, expected := range map[string]int{"bank1": 15, "v1": 3, "v2": 2, "c1": 0} {
+		if balance := balanceOf(ledger, account); balance != expected {
+			t.Errorf("balance of %s = %d, expected %d", account, balance, expected)
+		}
+	}
+}
+
+func TestRequestFeeIsPaidByTheInvokingInstitution(t *testing.T) {
+	stub := newTestStub(t)
+	createConsentingPerson(stub)
+	stub.registerInstitution("bank1")
+	ledger := chargeVerifiers(stub.as(RoleAdmin, "admin"), "bank1", "20", "c1", "0")
+
+	// The customer names bank1 as the target, but is not charged and cannot
+	// charge bank1 either
+	_, err := stub.as(RoleCustomer, "c1").invoke("saveRequestState", "r1", "c1", "bank1")
+	expectCode(t, err, ccerror.Forbidden)
+	if balance := balanceOf(ledger, "bank1"); balance != 20 {
+		t.Errorf("balance of bank1 = %d after a customer submission", balance)
+	}
+
+	stub.as(RoleInstitution, "bank1").mustInvoke("saveRequestState", "r1", "c1", "bank1")
+	if fee := stub.request("r1").Fee; fee == nil || len(fee.Transfers) != 1 || fee.Transfers[0].Account != "c1" {
+		t.Errorf("fee of an unverified person = %+v", fee)
+	}
+}
+
+func TestRequestFeeNeedsFunds(t *testing.T) {
+	stub := newTestStub(t)
+	createConsentingPerson(stub)
+	stub.registerInstitution("bank1")
+	ledger := chargeVerifiers(stub.as(RoleAdmin, "admin"), "bank1", "4")
+
+	_, err := stub.as(RoleInstitution, "bank1").invoke("saveRequestState", "r1", "c1", "bank1")
+	expectCode(t, err, ccerror.Conflict)
+	if balance := balanceOf(ledger, "bank1"); balance != 4 {
+		t.Errorf("balance of bank1 = %d after a failed charge", balance)
+	}
+	_, err = stub.as(RoleAdmin, "admin").query("queryRequestState", "r1")
+	expectCode(t, err, ccerror.NotFound)
+}
+
+func TestRequestFeeIsNeverPaidToThePayer(t *testing.T) {
+	schedule := FeeSchedule{Payee: FeePayeeVerifier}
+	person := Person{Id: "c1", InfoElements: []InfoElement{{Id: "e1", VerifiedBy: "bank1"}, {Id: "e2", VerifiedBy: "v1"}}}
+
+	transfers, err := schedule.transfers(person, 5, "bank1")
+	if err != nil || len(transfers) != 1 || transfers[0].Account != "v1" || transfers[0].Amount != 5 {
+		t.Errorf("transfers = %+v, %v", transfers, err)
+	}
+	_, err = schedule.transfers(Person{Id: "bank1"}, 5, "bank1")
+	expectCode(t, err, ccerror.Conflict)
+}
+
+func TestNegativeInstitutionFeesAreReportedInOrder(t *testing.T) {
+	schedule := FeeSchedule{LedgerChaincode: "ledger", Payee: FeePayeeVerifier, InstitutionFees: map[string]int{"bank3": -1, "bank1": 2, "bank2": -1}}
+	for i := 0; i < 20; i++ {
+		err := validateFeeSchedule(schedule)
+		if err == nil || !strings.Contains(err.Error(), "bank2") {
+			t.Fatalf("validation error = %v, expected bank2", err)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+// Object type of the composite key every written version of a person is kept
+// under, keyed by person id and transaction time. The v0.6 shim has no key
+// history API, so the chaincode records the history itself.
+const personHistoryObjectType = "PersonHistory"
+
+// PersonVersion is the state of a person as written by one transaction
+type PersonVersion struct {
+	TxId      string        `json:"txId"`
+	Timestamp string        `json:"timestamp"`
+	Creator   string        `json:"creator"`
+	Deleted   bool          `json:"deleted"`
+	Person    Person        `json:"person"`
+	Diff      []FieldChange `json:"diff"`
+}
+
+// InfoElementVersion is the state of one InfoElement as written by one transaction
+type InfoElementVersion struct {
+	TxId        string        `json:"txId"`
+	Timestamp   string        `json:"timestamp"`
+	Creator     string        `json:"creator"`
+	Deleted     bool          `json:"deleted"`
+	InfoElement *InfoElement  `json:"infoElement"`
+	Diff        []FieldChange `json:"diff"`
+}
+
+// FieldChange is one field that differs from the previous version
+type FieldChange struct {
+	Path string      `json:"path"`
+	Old  interface{} `json:"old"`
+	New  interface{} `json:"new"`
+}
+
+// Records the person as written by the current transaction. Deleted persons
+// are recorded with only their id.
+func (kyc *KYCChaincode) recordPersonVersion(stub shim.ChaincodeStubInterface, person Person, deleted bool) error {
+	now, err := getTxTime(stub)
+	if err != nil {
+		return err
+	}
+	creator, err := getActor(stub)
+	if err != nil {
+		return err
+	}
+
+	key, err := createCompositeKey(personHistoryObjectType, []string{person.Id, fmt.Sprintf("%019d", now.UnixNano()), stub.GetTxID()})
+	if err != nil {
+		return err
+	}
+
+	version := PersonVersion{
+		TxId:      stub.GetTxID(),
+		Timestamp: now.Format(time.RFC3339Nano),
+		Creator:   creator,
+		Deleted:   deleted,
+		Person:    person,
+	}
+
+	jsonAsBytes, _ := json.Marshal(version)
+	return stub.PutState(key, jsonAsBytes)
+}
+
+// Reads every recorded version of a person, oldest first
+func (kyc *KYCChaincode) getPersonVersions(stub shim.ChaincodeStubInterface, personId string) ([]PersonVersion, error) {
+	startKey, endKey, err := compositeKeyRange(personHistoryObjectType, []string{personId})
+	if err != nil {
+		return nil, err
+	}
+
+	iterator, err := stub.RangeQueryState(startKey, endKey)
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	versions := []PersonVersion{}
+	for iterator.HasNext() {
+		_, versionJSONAsBytes, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		version := PersonVersion{}
+		err = json.Unmarshal(versionJSONAsBytes, &version)
+		if err != nil {
+			return nil, ccerror.New(ccerror.Internal, "", "Failed to unmarshal person version: %s", err.Error())
+		}
+		versions = append(versions, version)
+	}
+
+	return versions, nil
+}
+
+// Returns every version of a person with the fields changed since the version before
+func (kyc *KYCChaincode) queryPersonHistory(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: queryPersonHistory called")
+
+	if len(args) != 1 {
+		return nil, ccerror.IncorrectArgs("1")
+	}
+
+	versions, err := kyc.getPersonVersions(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	previous := Person{}
+	for i := range versions {
+		versions[i].Diff = diffPersons(previous, versions[i].Person)
+		previous = versions[i].Person
+	}
+
+	jsonAsBytes, _ := json.Marshal(versions)
+	return jsonAsBytes, nil
+}
+
+// Returns the versions of a person in which one InfoElement changed
+func (kyc *KYCChaincode) queryInfoElementHistory(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: queryInfoElementHistory called")
+
+	if len(args) != 2 {
+		return nil, ccerror.IncorrectArgs("2")
+	}
+
+	versions, err := kyc.getPersonVersions(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	elementVersions := []InfoElementVersion{}
+	var previous *InfoElement
+	for _, version := range versions {
+		current := findInfoElement(version.Person, args[1])
+		diff := diffValues("infoElements["+args[1]+"]", previous, current)
+		if len(diff) == 0 {
+			continue
+		}
+
+		elementVersions = append(elementVersions, InfoElementVersion{
+			TxId:        version.TxId,
+			Timestamp:   version.Timestamp,
+			Creator:     version.Creator,
+			Deleted:     current == nil,
+			InfoElement: current,
+			Diff:        diff,
+		})
+		previous = current
+	}
+
+	jsonAsBytes, _ := json.Marshal(elementVersions)
+	return jsonAsBytes, nil
+}
+
+func findInfoElement(person Person, elementId string) *InfoElement {
+	for _, infoElement := range person.InfoElements {
+		if infoElement.Id == elementId {
+			found := infoElement
+			return &found
+		}
+	}
+	return nil
+}
+
+// Lists the InfoElement fields that differ between two versions of a person,
+// matching elements by id
+func diffPersons(old Person, new Person) []FieldChange {
+	changes := []FieldChange{}
+	if old.Id != new.Id {
+		changes = append(changes, FieldChange{Path: "id", Old: old.Id, New: new.Id})
+	}
+
+	elementIds := []string{}
+	seen := map[string]bool{}
+	for _, person := range []Person{old, new} {
+		for _, infoElement := range person.InfoElements {
+			if !seen[infoElement.Id] {
+				seen[infoElement.Id] = true
+				elementIds = append(elementIds, infoElement.Id)
+			}
+		}
+	}
+	sort.Strings(elementIds)
+
+	for _, elementId := range elementIds {
+		changes = append(changes, diffValues("infoElements["+elementId+"]", findInfoElement(old, elementId), findInfoElement(new, elementId))...)
+	}
+
+	return changes
+}
+
+// Compares two values by their JSON fields. A nil value counts as absent.
+func diffValues(path string, old interface{}, new interface{}) []FieldChange {
+	oldFields := jsonFields(old)
+	newFields := jsonFields(new)
+	if oldFields == nil && newFields == nil {
+		return nil
+	}
+	if oldFields == nil || newFields == nil {
+		return []FieldChange{{Path: path, Old: oldFields, New: newFields}}
+	}
+
+	names := []string{}
+	for name := range oldFields {
+		names = append(names, name)
+	}
+	for name := range newFields {
+		if _, ok := oldFields[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	changes := []FieldChange{}
+	for _, name := range names {
+		if !reflect.DeepEqual(oldFields[name], newFields[name]) {
+			changes = append(changes, FieldChange{Path: path + "." + name, Old: oldFields[name], New: newFields[name]})
+		}
+	}
+	return changes
+}
+
+func jsonFields(value interface{}) map[string]interface{} {
+	if value == nil || reflect.ValueOf(value).IsNil() {
+		return nil
+	}
+	jsonAsBytes, _ := json.Marshal(value)
+	fields := map[string]interface{}{}
+	json.Unmarshal(jsonAsBytes, &fields)
+	return fields
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+// Object types of the institution registry, keyed by institution id, and of
+// the inbox index of requests by target institution
+const institutionObjectType = "Institution"
+const requestByInstitutionObjectType = "SubmittedRequest~institution"
+
+// Statuses of a registered institution. Suspended institutions keep their
+// inbox but cannot be sent new requests.
+const (
+	InstitutionStatusActive    = "ACTIVE"
+	InstitutionStatusSuspended = "SUSPENDED"
+)
+
+// Institution is a participant requests can be addressed to. Id is the id
+// attribute of the institution's certificates. The v0.6 membership service
+// has no MSPs, so MspId is recorded for the move to a later Fabric rather
+// than checked.
+type Institution struct {
+	Id           string `json:"id"`
+	MspId        string `json:"mspId"`
+	DisplayName  string `json:"displayName"`
+	Status       string `json:"status"`
+	RegisteredOn string `json:"registeredOn"`
+	UpdatedOn    string `json:"updatedOn"`
+	TxId         string `json:"txId"`
+}
+
+func validateInstitution(institution Institution) error {
+	if institution.Id == "" {
+		return ccerror.New(ccerror.InvalidArgument, "id", "Institution id must not be empty")
+	}
+	if err := validateCompositeKeyAttribute(institution.Id); err != nil {
+		return err
+	}
+	if institution.MspId == "" {
+		return ccerror.New(ccerror.InvalidArgument, "mspId", "Institution %s needs an MSP id", institution.Id)
+	}
+	if institution.DisplayName == "" {
+		return ccerror.New(ccerror.InvalidArgument, "displayName", "Institution %s needs a display name", institution.Id)
+	}
+	if institution.Status != InstitutionStatusActive && institution.Status != InstitutionStatusSuspended {
+		return ccerror.New(ccerror.InvalidArgument, "status", "Institution status must be %s or %s", InstitutionStatusActive, InstitutionStatusSuspended)
+	}
+	return nil
+}
+
+// Adds an institution to the registry. New institutions are ACTIVE unless
+// another status is given.
+func (kyc *KYCChaincode) registerInstitution(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: registerInstitution called")
+
+	if len(args) != 1 {
+		return nil, ccerror.IncorrectArgs("1")
+	}
+
+	institution := Institution{}
+	err := json.Unmarshal([]byte(args[0]), &institution)
+	if err != nil {
+		return nil, ccerror.New(ccerror.InvalidArgument, "institution", "Failed to unmarshal institution: %s", err.Error())
+	}
+	if institution.Status == "" {
+		institution.Status = InstitutionStatusActive
+	}
+	err = validateInstitution(institution)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := getInstitution(stub, institution.Id)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, ccerror.New(ccerror.AlreadyExists, "id", "Institution %s is already registered", institution.Id)
+	}
+
+	now, err := getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	institution.RegisteredOn = now.Format(time.RFC3339)
+
+	return putInstitution(stub, institution)
+}
+
+// Replaces the MSP id, display name and status of a registered institution
+func (kyc *KYCChaincode) updateInstitution(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: updateInstitution called")
+
+	if len(args) != 1 {
+		return nil, ccerror.IncorrectArgs("1")
+	}
+
+	institution := Institution{}
+	err := json.Unmarshal([]byte(args[0]), &institution)
+	if err != nil {
+		return nil, ccerror.New(ccerror.InvalidArgument, "institution", "Failed to unmarshal institution: %s", err.Error())
+	}
+	err = validateInstitution(institution)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := mustGetInstitution(stub, institution.Id)
+	if err != nil {
+		return nil, err
+	}
+	institution.RegisteredOn = existing.RegisteredOn
+
+	return putInstitution(stub, institution)
+}
+
+func putInstitution(stub shim.ChaincodeStubInterface, institution Institution) ([]byte, error) {
+	now, err := getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	institution.UpdatedOn = now.Format(time.RFC3339)
+	institution.TxId = stub.GetTxID()
+
+	key, err := createCompositeKey(institutionObjectType, []string{institution.Id})
+	if err != nil {
+		return nil, err
+	}
+	jsonAsBytes, _ := json.Marshal(institution)
+	err = stub.PutState(key, jsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
+	return jsonAsBytes, nil
+}
+
+// Reads a registered institution, returning nil if the id is not registered
+func getInstitution(stub shim.ChaincodeStubInterface, institutionId string) (*Institution, error) {
+	key, err := createCompositeKey(institutionObjectType, []string{institutionId})
+	if err != nil {
+		return nil, err
+	}
+
+	institutionJSONAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, ccerror.New(ccerror.Internal, "", "Failed to get institution %s", institutionId)
+	}
+	if institutionJSONAsBytes == nil {
+		return nil, nil
+	}
+
+	institution := Institution{}
+	err = json.Unmarshal(institutionJSONAsBytes, &institution)
+	if err != nil {
+		return nil, ccerror.New(ccerror.Internal, "", "Failed to unmarshal institution %s: %s", institutionId, err.Error())
+	}
+	return &institution, nil
+}
+
+func mustGetInstitution(stub shim.ChaincodeStubInterface, institutionId string) (Institution, error) {
+	institution, err := getInstitution(stub, institutionId)
+	if err != nil {
+		return Institution{}, err
+	}
+	if institution == nil {
+		return Institution{}, ccerror.New(ccerror.NotFound, "institutionId", "Institution %s is not registered", institutionId)
+	}
+	return *institution, nil
+}
+
+func (kyc *KYCChaincode) queryInstitution(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: queryInstitution called")
+
+	if len(args) != 1 {
+		return nil, ccerror.IncorrectArgs("1")
+	}
+
+	institution, err := mustGetInstitution(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	jsonAsBytes, _ := json.Marshal(institution)
+	return jsonAsBytes, nil
+}
+
+// Lists registered institutions in id order. Arguments are the page size and
+// the bookmark of the previous page.
+func (kyc *KYCChaincode) listInstitutions(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: listInstitutions called")
+
+	if len(args) != 2 {
+		return nil, ccerror.IncorrectArgs("2")
+	}
+
+	pageSize, lastKey, err := parsePageArgs(args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	startKey, endKey, err := compositeKeyRange(institutionObjectType, []string{})
+	if err != nil {
+		return nil, err
+	}
+
+	page, err := pageKeys(stub, startKey, endKey, pageSize, lastKey, func(key string, value []byte) (interface{}, bool, error) {
+		institution := Institution{}
+		err := json.Unmarshal(value, &institution)
+		if err != nil {
+			return nil, false, ccerror.New(ccerror.Internal, "", "Failed to unmarshal institution: %s", err.Error())
+		}
+		return institution, true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	jsonAsBytes, _ := json.Marshal(page)
+	return jsonAsBytes, nil
+}
+
+// Resolves the institution a request is addressed to, so saveRequestState can
+// reject targets that are unknown or suspended
+func checkRequestTarget(stub shim.ChaincodeStubInterface, institutionId string) error {
+	institution, err := mustGetInstitution(stub, institutionId)
+	if err != nil {
+		return err
+	}
+	if institution.Status != InstitutionStatusActive {
+		return ccerror.New(ccerror.Conflict, "institutionId", "Institution %s is %s", institutionId, institution.Status)
+	}
+	return nil
+}
+
+// Lists the requests addressed to the calling institution in request id
+// order. Arguments are a comma separated list of statuses, empty for all, the
+// page size and the bookmark of the previous page.
+func (kyc *KYCChaincode) queryInbox(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: queryInbox called")
+
+	if len(args) != 3 {
+		return nil, ccerror.IncorrectArgs("3")
+	}
+
+	statuses := []string{}
+	for _, status := range strings.Split(args[0], ",") {
+		status = strings.TrimSpace(status)
+		if status == "" {
+			continue
+		}
+		statuses = append(statuses, status)
+	}
+
+	pageSize, lastKey, err := parsePageArgs(args[1], args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	invoker, err := getInvoker(stub)
+	if err != nil {
+		return nil, err
+	}
+	_, err = mustGetInstitution(stub, invoker.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	startKey, endKey, err := compositeKeyRange(requestByInstitutionObjectType, []string{invoker.Id})
+	if err != nil {
+		return nil, err
+	}
+
+	page, err := pageKeys(stub, startKey, endKey, pageSize, lastKey, func(key string, value []byte) (interface{}, bool, error) {
+		_, keyParts, err := splitCompositeKey(key)
+		if err != nil {
+			return nil, false, err
+		}
+		request, err := kyc.getRequest(stub, keyParts[1])
+		if err != nil || request == nil {
+			return nil, false, err
+		}
+		if len(statuses) > 0 && !containsString(statuses, request.currentStatus()) {
+			return nil, false, nil
+		}
+		return request, true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	jsonAsBytes, _ := json.Marshal(page)
+	return jsonAsBytes, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+// The v0.6 shim has no composite key support, so keys are built the same way
+// later Fabric releases do: a null byte, the object type and each attribute,
+// every part terminated by a null byte. Plain person ids never start with a
+// null byte, so composite keys cannot collide with them.
+const compositeKeyNamespace = "\x00"
+const compositeKeySeparator = "\x00"
+const maxUnicodeRune = "\U0010FFFF"
+
+// createCompositeKey joins an object type and its attributes into one key
+func createCompositeKey(objectType string, attributes []string) (string, error) {
+	if err := validateCompositeKeyAttribute(objectType); err != nil {
+		return "", err
+	}
+	key := compositeKeyNamespace + objectType + compositeKeySeparator
+	for _, attribute := range attributes {
+		if err := validateCompositeKeyAttribute(attribute); err != nil {
+			return "", err
+		}
+		key += attribute + compositeKeySeparator
+	}
+	return key, nil
+}
+
+// splitCompositeKey returns the object type and attributes of a composite key
+func splitCompositeKey(compositeKey string) (string, []string, error) {
+	if !strings.HasPrefix(compositeKey, compositeKeyNamespace) {
+		return "", nil, ccerror.New(ccerror.Internal, "", "Not a composite key: %q", compositeKey)
+	}
+	components := []string{}
+	componentIndex := 1
+	for i := 1; i < len(compositeKey); i++ {
+		if compositeKey[i] == compositeKeySeparator[0] {
+			components = append(components, compositeKey[componentIndex:i])
+			componentIndex = i + 1
+		}
+	}
+	if len(components) == 0 {
+		return "", nil, ccerror.New(ccerror.Internal, "", "Not a composite key: %q", compositeKey)
+	}
+	return components[0], components[1:], nil
+}
+
+// compositeKeyRange returns the start and end keys that cover every composite
+// key beginning with the given object type and leading attributes
+func compositeKeyRange(objectType string, attributes []string) (string, string, error) {
+	startKey, err := createCompositeKey(objectType, attributes)
+	if err != nil {
+		return "", "", err
+	}
+	return startKey, startKey + maxUnicodeRune, nil
+}
+
+// compositeKeyPrefixRange returns the start and end keys that cover every
+// composite key of an object type whose first attribute starts with prefix
+func compositeKeyPrefixRange(objectType string, prefix string) (string, string, error) {
+	startKey, err := createCompositeKey(objectType, []string{})
+	if err != nil {
+		return "", "", err
+	}
+	if err := validateCompositeKeyAttribute(prefix); err != nil {
+		return "", "", err
+	}
+	startKey += prefix
+	return startKey, startKey + maxUnicodeRune, nil
+}
+
+func validateCompositeKeyAttribute(attribute string) error {
+	if strings.Contains(attribute, compositeKeySeparator) {
+		return ccerror.New(ccerror.InvalidArgument, "", "Key component must not contain a null byte")
+	}
+	return nil
+}
@@ -18,11 +18,12 @@ under the License.
 package main
 
 import (
-	"errors"
 	"fmt"
 	// "strconv"
 	"encoding/json"
+	"strings"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
 )
 
 // KYCChaincode structure.
@@ -35,19 +36,46 @@ type KYCChaincode struct {
 // }
 
 var SubmittedRequests []SubmittedRequest
+
+// Legacy key holding every submitted request in one array. Only read by
+// migrateSubmittedRequests.
 var submittedRequestsListId string = "SUBMITTED_REQUESTS_ID"
 
+// Object types of the composite keys requests and their indexes are stored under
+const requestObjectType = "SubmittedRequest"
+const requestByPersonObjectType = "SubmittedRequest~person"
+
+// Object type of the index listing every person id. Persons themselves are
+// stored under their plain id.
+const personObjectType = "Person"
+
 // SubmittedRequest structure
 type SubmittedRequest struct {
     Id string `json:"id"`;
 		Version string `json:"version"`;
 		SubmittedOn string `json:"submittedOn"`;
+		TxId string `json:"txId"`;
     Person Person `json:"person"`;
+    InstitutionId string `json:"institutionId,omitempty"`;
+    Status string `json:"status"`;
+    StatusHistory []StatusChange `json:"statusHistory"`;
+    Alerts []ScreeningAlert `json:"alerts,omitempty"`;
+    Fee *FeeCharge `json:"fee,omitempty"`;
+}
+
+// Result of splitting the legacy submitted requests array
+type RequestMigrationReport struct {
+    Migrated []string `json:"migrated"`;
+    Skipped []string `json:"skipped"`;
 }
 
 // Person structure
 type Person struct {
     Id string `json:"id"`;
+    SchemaVersion int `json:"schemaVersion,omitempty"`;
+    EncryptionKeyIds []string `json:"encryptionKeyIds,omitempty"`;
+    ErasedOn string `json:"erasedOn,omitempty"`;
+    RiskAssessment *RiskAssessment `json:"riskAssessment,omitempty"`;
     InfoElements []InfoElement `json:"infoElements"`;
 }
 
@@ -57,9 +85,11 @@ type InfoElement struct {
 		Title string `json:"title"`;
 		ElementType string `json:"elementType"`;
 		ElementValue string `json:"elementValue"`;
+		ValueHash string `json:"valueHash,omitempty"`;
 		ValidTill string `json:"validTill"`;
     Hash string `json:"hash"`;
 		VerifiedOn string `json:"verifiedOn"`;
+		VerifiedBy string `json:"verifiedBy"`;
 		VerificationProof string `json:"verificationProof"`;
     Status string `json:"status"`;
 		Comments string `json:"comments"`;
@@ -71,16 +101,9 @@ type InfoElement struct {
 
 func (kyc *KYCChaincode) Init(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 	fmt.Println("Init called, initializing chaincode")
-	var err error
-
-	l_submittedRequests := []SubmittedRequest{}
 
-	fmt.Println("CHAINCODE: Writing l_submittedRequests back to ledger")
-	submittedRequestsJSONAsBytes_write, _ := json.Marshal(l_submittedRequests)
-	err = stub.PutState(submittedRequestsListId, submittedRequestsJSONAsBytes_write)
-	if err != nil {
-		return nil, err
-	}
+	// Submitted requests live under their own keys, so there is no shared
+	// list to reset here. Legacy lists are split by migrateSubmittedRequests.
 
 	return nil, nil
 }
@@ -90,8 +113,25 @@ func (kyc *KYCChaincode) createPerson(stub shim.ChaincodeStubInterface, args []s
 
 	var err error
 
-	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	if len(args) != 1 && len(args) != 2 {
+		return nil, ccerror.IncorrectArgs("1 or 2")
+	}
+
+	upsert, err := parseUpsert(args, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	existingPerson, err := kyc.getPerson(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if existingPerson != nil {
+		if upsert {
+			// The person is already there and keeps its InfoElements
+			return nil, nil
+		}
+		return nil, ccerror.New(ccerror.AlreadyExists, "personId", "Person with id %s already exists", args[0])
 	}
 
 	person := Person{}
@@ -100,8 +140,12 @@ func (kyc *KYCChaincode) createPerson(stub shim.ChaincodeStubInterface, args []s
 	infoElements := []InfoElement{}
 	person.InfoElements = infoElements
 
-	jsonAsBytes, _ := json.Marshal(person)
-	err = stub.PutState(person.Id, jsonAsBytes)
+	err = kyc.putPerson(stub, person)
+	if err != nil {
+		return nil, err
+	}
+
+	err = emitEvent(stub, KYCEvent{Type: EventPersonCreated, PersonId: person.Id})
 	if err != nil {
 		return nil, err
 	}
@@ -110,48 +154,149 @@ func (kyc *KYCChaincode) createPerson(stub shim.ChaincodeStubInterface, args []s
 
 }
 
+// Returns a person with only the InfoElements the caller may read. Callers
+// other than the person, admins and regulators pass the purpose of the read.
 func (kyc *KYCChaincode) queryPerson(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	fmt.Println("CHAINCODE: queryPerson called")
 
 	var err error
+	var purpose string
 
-	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	if len(args) != 1 && len(args) != 2 {
+		return nil, ccerror.IncorrectArgs("1 or 2")
+	}
+	if len(args) == 2 {
+		purpose = args[1]
+	}
+
+	person, err := kyc.mustGetPerson(stub, args[0])
+	if err != nil {
+		return nil, err
 	}
 
-	Avalbytes, err := stub.GetState(args[0])
+	err = kyc.filterConsented(stub, &person, purpose)
 	if err != nil {
-		jsonResp := "{\"Error\":\"Failed to get state for " + args[0] + "\"}"
-		return nil, errors.New(jsonResp)
+		return nil, err
 	}
 
-	return Avalbytes, nil
+	now, err := getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	reportExpired(person.InfoElements, now)
+
+	jsonAsBytes, _ := json.Marshal(person)
+	return jsonAsBytes, nil
 
 }
 
 func (kyc *KYCChaincode) updateInfoElement(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	fmt.Println("CHAINCODE: updateInfoElement called")
 	var err error
-	var elementReplaced bool = false;
 
-	if len(args) != 2 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	if len(args) != 2 && len(args) != 3 {
+		return nil, ccerror.IncorrectArgs("2 or 3")
 	}
 
-	personJSONAsBytes, err := stub.GetState(args[0])
+	upsert, err := parseUpsert(args, 2)
 	if err != nil {
-		jsonResp := "{\"Error\":\"Failed to get state for " + args[0] + "\"}"
-		return nil, errors.New(jsonResp)
+		return nil, err
 	}
 
-	person := Person{}
-	json.Unmarshal(personJSONAsBytes, &person)
+	storedPerson, err := kyc.getPerson(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if storedPerson == nil && !upsert {
+		return nil, personNotFound(args[0])
+	}
+	created := storedPerson == nil
+	if created {
+		storedPerson = &Person{Id: args[0], InfoElements: []InfoElement{}}
+	}
+	person := *storedPerson
 	fmt.Println("CHAINCODE: After Unmarshalling person")
 
 	infoElement := InfoElement{}
-	json.Unmarshal([]byte(args[1]), &infoElement)
+	err = json.Unmarshal([]byte(args[1]), &infoElement)
+	if err != nil {
+		return nil, ccerror.New(ccerror.InvalidArgument, "infoElement", "Failed to unmarshal infoElement: %s", err.Error())
+	}
 	fmt.Println("CHAINCODE: After Unmarshalling infoElement")
 
+	privateValue, err := applyPrivateValue(&infoElement)
+	if err != nil {
+		return nil, err
+	}
+
+	infoElement, err = kyc.applyInfoElement(stub, &person, infoElement, privateValue)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("CHAINCODE: Writing person back to ledger")
+	err = kyc.putPerson(stub, person)
+	if err != nil {
+		return nil, err
+	}
+
+	event := KYCEvent{
+		Type:         EventInfoElementUpdated,
+		PersonId:     person.Id,
+		ElementId:    infoElement.Id,
+		ElementType:  infoElement.ElementType,
+		Status:       infoElement.Status,
+		DocumentHash: infoElement.Hash,
+		ValueHash:    infoElement.ValueHash,
+	}
+	if created {
+		event.Type = EventPersonCreated
+	}
+	err = emitEvent(stub, event)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("CHAINCODE: Returning from updateInfoElement")
+
+	return nil, nil
+
+}
+
+// Validates an InfoElement against its element type and the person's keys and
+// puts it on the person, replacing any element with the same id. Returns the
+// element as stored.
+func (kyc *KYCChaincode) applyInfoElement(stub shim.ChaincodeStubInterface, person *Person, infoElement InfoElement, privateValue bool) (InfoElement, error) {
+	var err error
+
+	carryVerification(findInfoElement(*person, infoElement.Id), &infoElement)
+
+	err = kyc.conformInfoElement(stub, &infoElement, privateValue)
+	if err != nil {
+		return infoElement, err
+	}
+
+	if privateValue {
+		err = checkValueHashUnique(*person, infoElement)
+		if err != nil {
+			return infoElement, err
+		}
+	}
+
+	err = checkSealedInfoElement(stub, *person, infoElement)
+	if err != nil {
+		return infoElement, err
+	}
+
+	setInfoElement(person, infoElement)
+
+	return infoElement, nil
+}
+
+// Puts an element on the person, replacing any element with the same id
+func setInfoElement(person *Person, infoElement InfoElement) {
+	var elementReplaced bool = false;
+
 	alteredInfoElements := []InfoElement{}
 
 	if len(person.InfoElements) > 0 {
@@ -173,100 +318,436 @@ func (kyc *KYCChaincode) updateInfoElement(stub shim.ChaincodeStubInterface, arg
 			fmt.Println("CHAINCODE: Appending info element")
 			person.InfoElements = append(person.InfoElements, infoElement)
 	}
+}
 
-	fmt.Println("CHAINCODE: Writing person back to ledger")
-	jsonAsBytes, _ := json.Marshal(person)
-	err = stub.PutState(person.Id, jsonAsBytes)
+// Submits a request for a person. Arguments are the request id, the person id
+// and optionally the id of the institution the request is addressed to.
+func (kyc *KYCChaincode) saveRequestState(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	if len(args) != 2 && len(args) != 3 {
+		return nil, ccerror.IncorrectArgs("2 or 3")
+	}
+
+	l_submittedRequest := SubmittedRequest{}
+
+	existingRequest, err := kyc.getRequest(stub, args[0])
 	if err != nil {
 		return nil, err
 	}
+	if existingRequest != nil && existingRequest.currentStatus() != RequestStatusInfoRequested {
+		return nil, ccerror.New(ccerror.AlreadyExists, "requestId", "Request id already submitted")
+	}
+	if existingRequest != nil && existingRequest.Person.Id != args[1] {
+		return nil, ccerror.New(ccerror.Conflict, "personId", "Request id was submitted for another person")
+	}
 
-	fmt.Println("CHAINCODE: Returning from updateInfoElement")
+	// The target institution is fixed when the request is first submitted
+	institutionId := ""
+	if len(args) == 3 {
+		institutionId = args[2]
+	}
+	if existingRequest != nil && institutionId != "" && existingRequest.InstitutionId != institutionId {
+		return nil, ccerror.New(ccerror.Conflict, "institutionId", "Request id was submitted to another institution")
+	}
+	if existingRequest == nil && institutionId != "" {
+		err = checkRequestTarget(stub, institutionId)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	person, err := kyc.mustGetPerson(stub, args[1])
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("CHAINCODE: After Unmarshalling person")
+
+	if existingRequest != nil {
+		// Submitting a request again after more information was asked for
+		// resubmits it as a new version
+		l_submittedRequest = *existingRequest
+		err = kyc.transitionRequest(stub, &l_submittedRequest, RequestStatusResubmitted, "")
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		submittedChange, err := newStatusChange(stub, "", RequestStatusSubmitted, "")
+		if err != nil {
+			return nil, err
+		}
+		l_submittedRequest.Id = args[0]
+		l_submittedRequest.InstitutionId = institutionId
+		l_submittedRequest.Status = RequestStatusSubmitted
+		l_submittedRequest.StatusHistory = []StatusChange{submittedChange}
+	}
+
+	err = kyc.snapshotRequest(stub, &l_submittedRequest, person)
+	if err != nil {
+		return nil, err
+	}
+
+	err = kyc.screenRequest(stub, &l_submittedRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the first submission of a request is charged
+	if existingRequest == nil {
+		l_submittedRequest.Fee, err = kyc.chargeRequestFee(stub, l_submittedRequest)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fmt.Println("CHAINCODE: Writing l_submittedRequest back to ledger")
+	err = kyc.putRequest(stub, l_submittedRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	err = emitEvent(stub, KYCEvent{
+		Type:         EventRequestSubmitted,
+		PersonId:     person.Id,
+		RequestId:    l_submittedRequest.Id,
+		Status:       l_submittedRequest.Status,
+		SnapshotHash: snapshotHash(l_submittedRequest.Person),
+	})
+	if err != nil {
+		return nil, err
+	}
 
 	return nil, nil
+}
+
+func (kyc *KYCChaincode) queryRequestState(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: queryRequestState called")
+
+	if len(args) != 1 {
+		return nil, ccerror.IncorrectArgs("1")
+	}
+
+	submittedRequestJSONAsBytes, err := stub.GetState(requestKey(args[0]))
+	if err != nil {
+		return nil, ccerror.New(ccerror.Internal, "", "Failed to get state for request %s", args[0])
+	}
+	if submittedRequestJSONAsBytes == nil {
+		return nil, ccerror.New(ccerror.NotFound, "requestId", "Request not found")
+	}
+
+	invoker, err := getInvoker(stub)
+	if err != nil {
+		return nil, err
+	}
+	if invoker.Role == RoleVerifier {
+		l_submittedRequest := SubmittedRequest{}
+		err = json.Unmarshal(submittedRequestJSONAsBytes, &l_submittedRequest)
+		if err != nil {
+			return nil, ccerror.New(ccerror.Internal, "", "Failed to unmarshal request %s: %s", args[0], err.Error())
+		}
+		err = scopeRequestToVerifier(stub, &l_submittedRequest, invoker.Id)
+		if err != nil {
+			return nil, err
+		}
+		submittedRequestJSONAsBytes, _ = json.Marshal(l_submittedRequest)
+	}
 
+	return submittedRequestJSONAsBytes, nil
 }
 
-func (kyc *KYCChaincode) saveRequestState(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+// Lists the requests submitted for a person using the person index
+func (kyc *KYCChaincode) queryRequestsByPerson(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: queryRequestsByPerson called")
 
-	if len(args) != 2 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	if len(args) != 1 {
+		return nil, ccerror.IncorrectArgs("1")
+	}
+
+	startKey, endKey, err := compositeKeyRange(requestByPersonObjectType, []string{args[0]})
+	if err != nil {
+		return nil, err
+	}
+
+	iterator, err := stub.RangeQueryState(startKey, endKey)
+	if err != nil {
+		return nil, err
 	}
+	defer iterator.Close()
 
 	l_submittedRequests := []SubmittedRequest{}
-	l_submittedRequest := SubmittedRequest{}
+	for iterator.HasNext() {
+		indexKey, _, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, keyParts, err := splitCompositeKey(indexKey)
+		if err != nil {
+			return nil, err
+		}
+
+		l_submittedRequest, err := kyc.getRequest(stub, keyParts[1])
+		if err != nil {
+			return nil, err
+		}
+		if l_submittedRequest != nil {
+			l_submittedRequests = append(l_submittedRequests, *l_submittedRequest)
+		}
+	}
+
+	jsonAsBytes, _ := json.Marshal(l_submittedRequests)
+	return jsonAsBytes, nil
+}
+
+// Splits the legacy SUBMITTED_REQUESTS_ID array into one key per request.
+// Requests that already have their own key are left alone, so the migration
+// can be run again safely.
+func (kyc *KYCChaincode) migrateSubmittedRequests(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: migrateSubmittedRequests called")
+
+	if len(args) != 0 {
+		return nil, ccerror.IncorrectArgs("0")
+	}
 
 	submittedRequestsJSONAsBytes, err := stub.GetState(submittedRequestsListId)
 	if err != nil {
-		jsonResp := "{\"Error\":\"Failed to get state for " + submittedRequestsListId + "\"}"
-		return nil, errors.New(jsonResp)
+		return nil, ccerror.New(ccerror.Internal, "", "Failed to get state for %s", submittedRequestsListId)
+	}
+
+	report := RequestMigrationReport{}
+	if submittedRequestsJSONAsBytes == nil {
+		jsonAsBytes, _ := json.Marshal(report)
+		return jsonAsBytes, nil
+	}
+
+	l_submittedRequests := []SubmittedRequest{}
+	err = json.Unmarshal(submittedRequestsJSONAsBytes, &l_submittedRequests)
+	if err != nil {
+		return nil, ccerror.New(ccerror.Internal, "", "Failed to unmarshal legacy submitted requests: %s", err.Error())
 	}
 
-	json.Unmarshal(submittedRequestsJSONAsBytes, &l_submittedRequests)
-	fmt.Println("CHAINCODE: After Unmarshalling submitted requests")
+	for _, l_submittedRequest := range l_submittedRequests {
+		existingRequest, err := kyc.getRequest(stub, l_submittedRequest.Id)
+		if err != nil {
+			return nil, err
+		}
+		if existingRequest != nil {
+			report.Skipped = append(report.Skipped, l_submittedRequest.Id)
+			continue
+		}
 
-	for _, l_submittedRequest_loop := range l_submittedRequests {
-		if l_submittedRequest_loop.Id == args[0] {
-			return nil, errors.New("Request id already submitted")
+		err = kyc.putRequest(stub, l_submittedRequest)
+		if err != nil {
+			return nil, err
 		}
+		report.Migrated = append(report.Migrated, l_submittedRequest.Id)
 	}
 
-	l_submittedRequest.Id = args[0]
-	l_submittedRequest.Version = "v1"
-	l_submittedRequest.SubmittedOn = "Unknown"
+	fmt.Println("CHAINCODE: Removing legacy submitted requests list")
+	err = stub.DelState(submittedRequestsListId)
+	if err != nil {
+		return nil, ccerror.New(ccerror.Internal, "", "Failed to delete state")
+	}
+
+	jsonAsBytes, _ := json.Marshal(report)
+	return jsonAsBytes, nil
+}
+
+// Returns the key a submitted request is stored under
+func requestKey(requestId string) string {
+	key, _ := createCompositeKey(requestObjectType, []string{requestId})
+	return key
+}
 
-	personJSONAsBytes, err := stub.GetState(args[1])
+// Reads a submitted request, returning nil if it does not exist
+func (kyc *KYCChaincode) getRequest(stub shim.ChaincodeStubInterface, requestId string) (*SubmittedRequest, error) {
+	if err := validateCompositeKeyAttribute(requestId); err != nil {
+		return nil, err
+	}
+
+	submittedRequestJSONAsBytes, err := stub.GetState(requestKey(requestId))
 	if err != nil {
-		jsonResp := "{\"Error\":\"Failed to get state for " + args[1] + "\"}"
-		return nil, errors.New(jsonResp)
+		return nil, ccerror.New(ccerror.Internal, "", "Failed to get state for request %s", requestId)
+	}
+	if submittedRequestJSONAsBytes == nil {
+		return nil, nil
 	}
 
-	person := Person{}
-	json.Unmarshal(personJSONAsBytes, &person)
-	fmt.Println("CHAINCODE: After Unmarshalling person")
+	l_submittedRequest := SubmittedRequest{}
+	err = json.Unmarshal(submittedRequestJSONAsBytes, &l_submittedRequest)
+	if err != nil {
+		return nil, ccerror.New(ccerror.Internal, "", "Failed to unmarshal request %s: %s", requestId, err.Error())
+	}
 
-	l_submittedRequest.Person = person
-	l_submittedRequests = append(l_submittedRequests, l_submittedRequest)
+	return &l_submittedRequest, nil
+}
 
-	fmt.Println("CHAINCODE: Writing l_submittedRequests back to ledger")
-	submittedRequestsJSONAsBytes_write, _ := json.Marshal(l_submittedRequests)
-	err = stub.PutState(submittedRequestsListId, submittedRequestsJSONAsBytes_write)
+// Writes a submitted request under its own key together with its person and
+// institution index entries
+func (kyc *KYCChaincode) putRequest(stub shim.ChaincodeStubInterface, l_submittedRequest SubmittedRequest) error {
+	if err := validateCompositeKeyAttribute(l_submittedRequest.Id); err != nil {
+		return err
+	}
+
+	jsonAsBytes, _ := json.Marshal(l_submittedRequest)
+	err := stub.PutState(requestKey(l_submittedRequest.Id), jsonAsBytes)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return nil, nil
+	personIndexKey, err := createCompositeKey(requestByPersonObjectType, []string{l_submittedRequest.Person.Id, l_submittedRequest.Id})
+	if err != nil {
+		return err
+	}
+
+	err = stub.PutState(personIndexKey, []byte{0x00})
+	if err != nil {
+		return err
+	}
+
+	if l_submittedRequest.InstitutionId == "" {
+		return nil
+	}
+	institutionIndexKey, err := createCompositeKey(requestByInstitutionObjectType, []string{l_submittedRequest.InstitutionId, l_submittedRequest.Id})
+	if err != nil {
+		return err
+	}
+
+	return stub.PutState(institutionIndexKey, []byte{0x00})
 }
 
-func (kyc *KYCChaincode) queryRequestState(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	fmt.Println("CHAINCODE: queryRequestState called")
+// Writes a person under its id and records it in the person index
+func (kyc *KYCChaincode) putPerson(stub shim.ChaincodeStubInterface, person Person) error {
+	personIndexKey, err := createCompositeKey(personObjectType, []string{person.Id})
+	if err != nil {
+		return err
+	}
 
-	var err error
+	person.SchemaVersion = personSchemaVersion
+	jsonAsBytes, _ := json.Marshal(person)
+	err = stub.PutState(person.Id, jsonAsBytes)
+	if err != nil {
+		return err
+	}
 
-	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	err = stub.PutState(personIndexKey, []byte{0x00})
+	if err != nil {
+		return err
 	}
 
-	submittedRequestsJSONAsBytes, err := stub.GetState(submittedRequestsListId)
+	return kyc.recordPersonVersion(stub, person, false)
+}
+
+// Calls visit for every indexed person in id order
+func (kyc *KYCChaincode) forEachPerson(stub shim.ChaincodeStubInterface, visit func(Person) error) error {
+	startKey, endKey, err := compositeKeyRange(personObjectType, []string{})
 	if err != nil {
-		jsonResp := "{\"Error\":\"Failed to get state for " + submittedRequestsListId + "\"}"
-		return nil, errors.New(jsonResp)
+		return err
 	}
 
-	l_submittedRequests := []SubmittedRequest{}
-	json.Unmarshal(submittedRequestsJSONAsBytes, &l_submittedRequests)
-	fmt.Println("CHAINCODE: After Unmarshalling l_submittedRequests")
+	iterator, err := stub.RangeQueryState(startKey, endKey)
+	if err != nil {
+		return err
+	}
+	defer iterator.Close()
 
-	for _, submittedRequest_loop := range l_submittedRequests {
-		if submittedRequest_loop.Id == args[0] {
+	for iterator.HasNext() {
+		indexKey, _, err := iterator.Next()
+		if err != nil {
+			return err
+		}
 
-			fmt.Println("CHAINCODE: Writing submittedRequest_loop back to ledger")
-			jsonAsBytes, _ := json.Marshal(submittedRequest_loop)
-			return jsonAsBytes, nil
+		person, err := kyc.getIndexedPerson(stub, indexKey)
+		if err != nil {
+			return err
+		}
+		if person == nil {
+			continue
 		}
+
+		err = visit(*person)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Reads the person a person index key points at, returning nil if it no longer exists
+func (kyc *KYCChaincode) getIndexedPerson(stub shim.ChaincodeStubInterface, indexKey string) (*Person, error) {
+	_, keyParts, err := splitCompositeKey(indexKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return kyc.getPerson(stub, keyParts[0])
+}
+
+// Reads a person, returning nil if it does not exist. Erased persons are
+// reported as NOT_FOUND so their ids cannot be reused.
+func (kyc *KYCChaincode) getPerson(stub shim.ChaincodeStubInterface, personId string) (*Person, error) {
+	err := validatePersonId(personId)
+	if err != nil {
+		return nil, err
+	}
+
+	personJSONAsBytes, err := stub.GetState(personId)
+	if err != nil {
+		return nil, ccerror.New(ccerror.Internal, "", "Failed to get state for %s", personId)
+	}
+	if personJSONAsBytes == nil {
+		return nil, nil
 	}
 
-	return nil, errors.New("Request not found")
+	person := Person{}
+	err = json.Unmarshal(personJSONAsBytes, &person)
+	if err != nil {
+		return nil, ccerror.New(ccerror.Internal, "", "Failed to unmarshal person %s: %s", personId, err.Error())
+	}
+	if person.ErasedOn != "" {
+		return nil, ccerror.New(ccerror.NotFound, "personId", "Person with id %s was erased on %s", personId, person.ErasedOn)
+	}
+
+	return &person, nil
+}
+
+// Reads a person, failing with NOT_FOUND if it does not exist
+func (kyc *KYCChaincode) mustGetPerson(stub shim.ChaincodeStubInterface, personId string) (Person, error) {
+	person, err := kyc.getPerson(stub, personId)
+	if err != nil {
+		return Person{}, err
+	}
+	if person == nil {
+		return Person{}, personNotFound(personId)
+	}
+	return *person, nil
+}
+
+func personNotFound(personId string) error {
+	return ccerror.New(ccerror.NotFound, "personId", "Person with id %s does not exist", personId)
+}
+
+// Person ids are stored as plain keys, so they must not look like composite keys
+func validatePersonId(personId string) error {
+	if personId == "" {
+		return ccerror.New(ccerror.InvalidArgument, "personId", "Person id is required")
+	}
+	if strings.HasPrefix(personId, compositeKeyNamespace) {
+		return ccerror.New(ccerror.InvalidArgument, "personId", "Person id must not start with a null byte")
+	}
+	return nil
+}
+
+// Reads the optional "upsert" flag at the given argument position. With it,
+// writes create a missing person instead of failing with NOT_FOUND, and
+// creating an existing person is a no-op instead of ALREADY_EXISTS.
+func parseUpsert(args []string, index int) (bool, error) {
+	if len(args) <= index {
+		return false, nil
+	}
+	if args[index] != "upsert" {
+		return false, ccerror.New(ccerror.InvalidArgument, "mode", "Unknown mode %s, expecting upsert", args[index])
+	}
+	return true, nil
 }
 
 func (kyc *KYCChaincode) deleteInfoElement(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
@@ -274,39 +755,27 @@ func (kyc *KYCChaincode) deleteInfoElement(stub shim.ChaincodeStubInterface, arg
 	var err error
 
 	if len(args) != 2 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+		return nil, ccerror.IncorrectArgs("2")
 	}
 
-	personJSONAsBytes, err := stub.GetState(args[0])
+	person, err := kyc.mustGetPerson(stub, args[0])
 	if err != nil {
-		jsonResp := "{\"Error\":\"Failed to get state for " + args[0] + "\"}"
-		return nil, errors.New(jsonResp)
+		return nil, err
 	}
-
-	person := Person{}
-	json.Unmarshal(personJSONAsBytes, &person)
 	fmt.Println("CHAINCODE: After Unmarshalling person")
 
-	alteredInfoElements := []InfoElement{}
-
-	if len(person.InfoElements) > 0 {
-		for _, infoElement1 := range person.InfoElements {
-			if infoElement1.Id != args[1] {
-				fmt.Println("CHAINCODE: Keeping the old element")
-				alteredInfoElements = append(alteredInfoElements, infoElement1)
-			} else {
-				fmt.Println("CHAINCODE: Removing info element with id" + infoElement1.Id)
-			}
-		}
-		fmt.Println("CHAINCODE: Replacing the infoElementsList with the altered one")
-		person.InfoElements = alteredInfoElements;
-	} else {
-		return nil, nil
+	err = removeInfoElement(&person, args[1])
+	if err != nil {
+		return nil, err
 	}
 
 	fmt.Println("CHAINCODE: Writing person back to ledger")
-	jsonAsBytes, _ := json.Marshal(person)
-	err = stub.PutState(person.Id, jsonAsBytes)
+	err = kyc.putPerson(stub, person)
+	if err != nil {
+		return nil, err
+	}
+
+	err = emitEvent(stub, KYCEvent{Type: EventInfoElementDeleted, PersonId: person.Id, ElementId: args[1]})
 	if err != nil {
 		return nil, err
 	}
@@ -317,25 +786,47 @@ func (kyc *KYCChaincode) deleteInfoElement(stub shim.ChaincodeStubInterface, arg
 
 }
 
+// Takes the element with the given id off the person
+func removeInfoElement(person *Person, elementId string) error {
+	if findInfoElement(*person, elementId) == nil {
+		return ccerror.New(ccerror.NotFound, "elementId", "InfoElement with id %s does not exist", elementId)
+	}
+
+	alteredInfoElements := []InfoElement{}
+
+	for _, infoElement1 := range person.InfoElements {
+		if infoElement1.Id != elementId {
+			fmt.Println("CHAINCODE: Keeping the old element")
+			alteredInfoElements = append(alteredInfoElements, infoElement1)
+		} else {
+			fmt.Println("CHAINCODE: Removing info element with id" + infoElement1.Id)
+		}
+	}
+	fmt.Println("CHAINCODE: Replacing the infoElementsList with the altered one")
+	person.InfoElements = alteredInfoElements;
+
+	return nil
+}
+
 func (kyc *KYCChaincode) queryInfoElement(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	fmt.Println("CHAINCODE: queryInfoElement called")
 
 	var err error
 	var infoElementExists bool = false
 	var fetchedInfoElement InfoElement
+	var purpose string
 
-	if len(args) != 2 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	if len(args) != 2 && len(args) != 3 {
+		return nil, ccerror.IncorrectArgs("2 or 3")
+	}
+	if len(args) == 3 {
+		purpose = args[2]
 	}
 
-	personJSONAsBytes, err := stub.GetState(args[0])
+	person, err := kyc.mustGetPerson(stub, args[0])
 	if err != nil {
-		jsonResp := "{\"Error\":\"Failed to get state for " + args[0] + "\"}"
-		return nil, errors.New(jsonResp)
+		return nil, err
 	}
-
-	person := Person{}
-	json.Unmarshal(personJSONAsBytes, &person)
 	fmt.Println("CHAINCODE: After Unmarshalling person")
 
 	for _, infoElement := range person.InfoElements {
@@ -347,8 +838,23 @@ func (kyc *KYCChaincode) queryInfoElement(stub shim.ChaincodeStubInterface, args
 	}
 
 	if infoElementExists == false {
-		jsonResp := "{\"Error\":\"InfoElement with id " + args[1] + " does not exist \"}"
-		return nil, errors.New(jsonResp)
+		return nil, ccerror.New(ccerror.NotFound, "elementId", "InfoElement with id %s does not exist", args[1])
+	}
+
+	consented, err := kyc.consentFilter(stub, args[0], purpose)
+	if err != nil {
+		return nil, err
+	}
+	if consented != nil && !consented(fetchedInfoElement) {
+		return nil, ccerror.New(ccerror.Forbidden, "elementId", "No consent to read InfoElement with id %s", args[1])
+	}
+
+	now, err := getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	if isLapsed(fetchedInfoElement, now) {
+		fetchedInfoElement.Status = ElementStatusExpired
 	}
 
 	infoElementAsJSONBytes, _ := json.Marshal(fetchedInfoElement)
@@ -362,13 +868,37 @@ func (kyc *KYCChaincode) deletePerson(stub shim.ChaincodeStubInterface, args []s
 	fmt.Println("CHAINCODE: Running deletePerson")
 
 	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+		return nil, ccerror.IncorrectArgs("1")
+	}
+
+	_, err := kyc.mustGetPerson(stub, args[0])
+	if err != nil {
+		return nil, err
 	}
 
 	// Delete the key from the state in ledger
-	err := stub.DelState(args[0])
+	err = stub.DelState(args[0])
+	if err != nil {
+		return nil, ccerror.New(ccerror.Internal, "", "Failed to delete state")
+	}
+
+	personIndexKey, err := createCompositeKey(personObjectType, []string{args[0]})
+	if err != nil {
+		return nil, err
+	}
+	err = stub.DelState(personIndexKey)
+	if err != nil {
+		return nil, ccerror.New(ccerror.Internal, "", "Failed to delete state")
+	}
+
+	err = kyc.recordPersonVersion(stub, Person{Id: args[0], InfoElements: []InfoElement{}}, true)
+	if err != nil {
+		return nil, err
+	}
+
+	err = emitEvent(stub, KYCEvent{Type: EventPersonDeleted, PersonId: args[0]})
 	if err != nil {
-		return nil, errors.New("Failed to delete state")
+		return nil, err
 	}
 
 	return nil, nil
@@ -376,9 +906,19 @@ func (kyc *KYCChaincode) deletePerson(stub shim.ChaincodeStubInterface, args []s
 
 // Invoke callback representing the invocation of a chaincode
 // This chaincode will manage two accounts A and B and will transfer X units from A to B upon invoke
-func (kyc *KYCChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+func (kyc *KYCChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) (payload []byte, err error) {
 	fmt.Println("Invoke called, determining function")
 
+	// Every error leaves the chaincode as a structured error carrying the tx id
+	defer func() {
+		err = ccerror.WithTx(err, stub.GetTxID())
+	}()
+
+	err = kyc.authorize(stub, function, args)
+	if err != nil {
+		return nil, err
+	}
+
 	// Handle different functions
 	if function == "createPerson" {
 		fmt.Printf("Function is createPerson")
@@ -389,6 +929,48 @@ func (kyc *KYCChaincode) Invoke(stub shim.ChaincodeStubInterface, function strin
 	} else if function == "updateInfoElement" {
 		fmt.Printf("Function is updateInfoElement")
 		return kyc.updateInfoElement(stub, args)
+	} else if function == "updateInfoElements" {
+		fmt.Printf("Function is updateInfoElements")
+		return kyc.updateInfoElements(stub, args)
+	} else if function == "registerPersonKey" {
+		fmt.Printf("Function is registerPersonKey")
+		return kyc.registerPersonKey(stub, args)
+	} else if function == "rotatePersonKey" {
+		fmt.Printf("Function is rotatePersonKey")
+		return kyc.rotatePersonKey(stub, args)
+	} else if function == "setRiskConfig" {
+		fmt.Printf("Function is setRiskConfig")
+		return kyc.setRiskConfig(stub, args)
+	} else if function == "computeRiskScore" {
+		fmt.Printf("Function is computeRiskScore")
+		return kyc.computeRiskScore(stub, args)
+	} else if function == "loadWatchList" {
+		fmt.Printf("Function is loadWatchList")
+		return kyc.loadWatchList(stub, args)
+	} else if function == "updateWatchList" {
+		fmt.Printf("Function is updateWatchList")
+		return kyc.updateWatchList(stub, args)
+	} else if function == "clearAlert" {
+		fmt.Printf("Function is clearAlert")
+		return kyc.clearAlert(stub, args)
+	} else if function == "registerInstitution" {
+		fmt.Printf("Function is registerInstitution")
+		return kyc.registerInstitution(stub, args)
+	} else if function == "updateInstitution" {
+		fmt.Printf("Function is updateInstitution")
+		return kyc.updateInstitution(stub, args)
+	} else if function == "registerVerifier" {
+		fmt.Printf("Function is registerVerifier")
+		return kyc.registerVerifier(stub, args)
+	} else if function == "updateVerifier" {
+		fmt.Printf("Function is updateVerifier")
+		return kyc.updateVerifier(stub, args)
+	} else if function == "setFeeSchedule" {
+		fmt.Printf("Function is setFeeSchedule")
+		return kyc.setFeeSchedule(stub, args)
+	} else if function == "erasePerson" {
+		fmt.Printf("Function is erasePerson")
+		return kyc.erasePerson(stub, args)
 	} else if function == "deletePerson" {
 		fmt.Printf("Function is deletePerson")
 		return kyc.deletePerson(stub, args)
@@ -398,15 +980,69 @@ func (kyc *KYCChaincode) Invoke(stub shim.ChaincodeStubInterface, function strin
 	} else if function == "saveRequestState" {
 		fmt.Printf("Function is saveRequestState")
 		return kyc.saveRequestState(stub, args)
+	} else if function == "migrateSubmittedRequests" {
+		fmt.Printf("Function is migrateSubmittedRequests")
+		return kyc.migrateSubmittedRequests(stub, args)
+	} else if function == "migrateLegacyPersons" {
+		fmt.Printf("Function is migrateLegacyPersons")
+		return kyc.migrateLegacyPersons(stub, args)
+	} else if function == "startReview" {
+		fmt.Printf("Function is startReview")
+		return kyc.startReview(stub, args)
+	} else if function == "approveRequest" {
+		fmt.Printf("Function is approveRequest")
+		return kyc.approveRequest(stub, args)
+	} else if function == "rejectRequest" {
+		fmt.Printf("Function is rejectRequest")
+		return kyc.rejectRequest(stub, args)
+	} else if function == "requestInfo" {
+		fmt.Printf("Function is requestInfo")
+		return kyc.requestInfo(stub, args)
+	} else if function == "resubmitRequest" {
+		fmt.Printf("Function is resubmitRequest")
+		return kyc.resubmitRequest(stub, args)
+	} else if function == "withdrawRequest" {
+		fmt.Printf("Function is withdrawRequest")
+		return kyc.withdrawRequest(stub, args)
+	} else if function == "expireRequest" {
+		fmt.Printf("Function is expireRequest")
+		return kyc.expireRequest(stub, args)
+	} else if function == "grantConsent" {
+		fmt.Printf("Function is grantConsent")
+		return kyc.grantConsent(stub, args)
+	} else if function == "revokeConsent" {
+		fmt.Printf("Function is revokeConsent")
+		return kyc.revokeConsent(stub, args)
+	} else if function == "sweepExpired" {
+		fmt.Printf("Function is sweepExpired")
+		return kyc.sweepExpired(stub, args)
+	} else if function == "registerElementType" {
+		fmt.Printf("Function is registerElementType")
+		return kyc.registerElementType(stub, args)
+	} else if function == "removeElementType" {
+		fmt.Printf("Function is removeElementType")
+		return kyc.removeElementType(stub, args)
+	} else if function == "verifyInfoElement" {
+		fmt.Printf("Function is verifyInfoElement")
+		return kyc.verifyInfoElement(stub, args)
 	}
 
-	return nil, errors.New("Received unknown function invocation")
+	return nil, ccerror.New(ccerror.InvalidArgument, "function", "Received unknown function invocation")
 }
 
 // Query callback representing the query of a chaincode
-func (kyc *KYCChaincode) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+func (kyc *KYCChaincode) Query(stub shim.ChaincodeStubInterface, function string, args []string) (payload []byte, err error) {
 	fmt.Println("Query called, determining function")
 
+	defer func() {
+		err = ccerror.WithTx(err, stub.GetTxID())
+	}()
+
+	err = kyc.authorize(stub, function, args)
+	if err != nil {
+		return nil, err
+	}
+
 	// Handle different functions
 	if function == "queryPerson" {
 		// Deletes an entity from its state
@@ -415,12 +1051,87 @@ func (kyc *KYCChaincode) Query(stub shim.ChaincodeStubInterface, function string
 	} else if function == "queryInfoElement" {
 		fmt.Printf("Function is queryInfoElement")
 		return kyc.queryInfoElement(stub, args)
+	} else if function == "queryPersonDecrypted" {
+		fmt.Printf("Function is queryPersonDecrypted")
+		return kyc.queryPersonDecrypted(stub, args)
+	} else if function == "queryInfoElementDecrypted" {
+		fmt.Printf("Function is queryInfoElementDecrypted")
+		return kyc.queryInfoElementDecrypted(stub, args)
 	} else if function == "queryRequestState" {
 		fmt.Printf("Function is queryRequestState")
 		return kyc.queryRequestState(stub, args)
+	} else if function == "queryRequestsByPerson" {
+		fmt.Printf("Function is queryRequestsByPerson")
+		return kyc.queryRequestsByPerson(stub, args)
+	} else if function == "listConsents" {
+		fmt.Printf("Function is listConsents")
+		return kyc.listConsents(stub, args)
+	} else if function == "verifyInfoElementValue" {
+		fmt.Printf("Function is verifyInfoElementValue")
+		return kyc.verifyInfoElementValue(stub, args)
+	} else if function == "verifyInfoElementHash" {
+		fmt.Printf("Function is verifyInfoElementHash")
+		return kyc.verifyInfoElementHash(stub, args)
+	} else if function == "queryExpiringElements" {
+		fmt.Printf("Function is queryExpiringElements")
+		return kyc.queryExpiringElements(stub, args)
+	} else if function == "queryRiskConfig" {
+		fmt.Printf("Function is queryRiskConfig")
+		return kyc.queryRiskConfig(stub, args)
+	} else if function == "queryRiskAssessment" {
+		fmt.Printf("Function is queryRiskAssessment")
+		return kyc.queryRiskAssessment(stub, args)
+	} else if function == "queryWatchList" {
+		fmt.Printf("Function is queryWatchList")
+		return kyc.queryWatchList(stub, args)
+	} else if function == "queryInstitution" {
+		fmt.Printf("Function is queryInstitution")
+		return kyc.queryInstitution(stub, args)
+	} else if function == "listInstitutions" {
+		fmt.Printf("Function is listInstitutions")
+		return kyc.listInstitutions(stub, args)
+	} else if function == "queryInbox" {
+		fmt.Printf("Function is queryInbox")
+		return kyc.queryInbox(stub, args)
+	} else if function == "queryVerifier" {
+		fmt.Printf("Function is queryVerifier")
+		return kyc.queryVerifier(stub, args)
+	} else if function == "listVerifiers" {
+		fmt.Printf("Function is listVerifiers")
+		return kyc.listVerifiers(stub, args)
+	} else if function == "queryFeeSchedule" {
+		fmt.Printf("Function is queryFeeSchedule")
+		return kyc.queryFeeSchedule(stub, args)
+	} else if function == "queryErasureReceipt" {
+		fmt.Printf("Function is queryErasureReceipt")
+		return kyc.queryErasureReceipt(stub, args)
+	} else if function == "queryPersonHistory" {
+		fmt.Printf("Function is queryPersonHistory")
+		return kyc.queryPersonHistory(stub, args)
+	} else if function == "queryInfoElementHistory" {
+		fmt.Printf("Function is queryInfoElementHistory")
+		return kyc.queryInfoElementHistory(stub, args)
+	} else if function == "queryPersonsByElement" {
+		fmt.Printf("Function is queryPersonsByElement")
+		return kyc.queryPersonsByElement(stub, args)
+	} else if function == "listPersons" {
+		fmt.Printf("Function is listPersons")
+		return kyc.listPersons(stub, args)
+	} else if function == "listRequests" {
+		fmt.Printf("Function is listRequests")
+		return kyc.listRequests(stub, args)
+	} else if function == "queryRequestVersions" {
+		fmt.Printf("Function is queryRequestVersions")
+		return kyc.queryRequestVersions(stub, args)
+	} else if function == "queryMigrationReport" {
+		fmt.Printf("Function is queryMigrationReport")
+		return kyc.queryMigrationReport(stub, args)
+	} else if function == "queryElementTypes" {
+		fmt.Printf("Function is queryElementTypes")
+		return kyc.queryElementTypes(stub, args)
 	}
 
-	return nil, errors.New("Received unknown function invocation")
+	return nil, ccerror.New(ccerror.InvalidArgument, "function", "Received unknown function invocation")
 
 }
 
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+// Lists persons in id order. Arguments are the page size, the bookmark of the
+// previous page and an optional id prefix.
+func (kyc *KYCChaincode) listPersons(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: listPersons called")
+
+	var idPrefix string
+
+	if len(args) != 2 && len(args) != 3 {
+		return nil, ccerror.IncorrectArgs("2 or 3")
+	}
+	if len(args) == 3 {
+		idPrefix = args[2]
+	}
+
+	pageSize, lastKey, err := parsePageArgs(args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	startKey, endKey, err := compositeKeyPrefixRange(personObjectType, idPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	page, err := pageKeys(stub, startKey, endKey, pageSize, lastKey, func(key string, value []byte) (interface{}, bool, error) {
+		person, err := kyc.getIndexedPerson(stub, key)
+		if err != nil || person == nil {
+			return nil, false, err
+		}
+		reportExpired(person.InfoElements, now)
+		return person, true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	jsonAsBytes, _ := json.Marshal(page)
+	return jsonAsBytes, nil
+}
+
+// Lists submitted requests in id order. Arguments are the page size, the
+// bookmark of the previous page, an optional status and an optional id prefix.
+func (kyc *KYCChaincode) listRequests(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: listRequests called")
+
+	var status string
+	var idPrefix string
+
+	if len(args) < 2 || len(args) > 4 {
+		return nil, ccerror.IncorrectArgs("2 to 4")
+	}
+	if len(args) >= 3 {
+		status = args[2]
+	}
+	if len(args) == 4 {
+		idPrefix = args[3]
+	}
+
+	pageSize, lastKey, err := parsePageArgs(args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	startKey, endKey, err := compositeKeyPrefixRange(requestObjectType, idPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	page, err := pageKeys(stub, startKey, endKey, pageSize, lastKey, func(key string, value []byte) (interface{}, bool, error) {
+		l_submittedRequest := SubmittedRequest{}
+		err := json.Unmarshal(value, &l_submittedRequest)
+		if err != nil {
+			return nil, false, ccerror.New(ccerror.Internal, "", "Failed to unmarshal request: %s", err.Error())
+		}
+		if status != "" && l_submittedRequest.currentStatus() != status {
+			return nil, false, nil
+		}
+		return l_submittedRequest, true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	jsonAsBytes, _ := json.Marshal(page)
+	return jsonAsBytes, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+type personPage struct {
+	Results  []Person `json:"results"`
+	Count    int      `json:"count"`
+	Bookmark string   `json:"bookmark"`
+}
+
+type requestPage struct {
+	Results  []SubmittedRequest `json:"results"`
+	Count    int                `json:"count"`
+	Bookmark string             `json:"bookmark"`
+}
+
+func TestListPersonsPagesInIdOrder(t *testing.T) {
+	stub := newTestStub(t)
+	for _, personId := range []string{"p4", "p2", "q1", "p1", "p3"} {
+		stub.mustInvoke("createPerson", personId)
+	}
+
+	listed := []string{}
+	bookmark := ""
+	pages := 0
+	for {
+		page := personPage{}
+		stub.mustQuery(&page, "listPersons", "2", bookmark)
+		pages++
+		if page.Count != len(page.Results) {
+			t.Errorf("page %d counts %d of %d results", pages, page.Count, len(page.Results))
+		}
+		for _, person := range page.Results {
+			listed = append(listed, person.Id)
+		}
+		if page.Bookmark == "" {
+			break
+		}
+		bookmark = page.Bookmark
+	}
+
+	expected := []string{"p1", "p2", "p3", "p4", "q1"}
+	if pages != 3 || len(listed) != len(expected) {
+		t.Fatalf("listed %v in %d pages", listed, pages)
+	}
+	for i := range expected {
+		if listed[i] != expected[i] {
+			t.Fatalf("listed %v, expected %v", listed, expected)
+		}
+	}
+
+	page := personPage{}
+	stub.mustQuery(&page, "listPersons", "10", "", "p")
+	if page.Count != 4 || page.Bookmark != "" {
+		t.Errorf("prefix p listed %d persons, bookmark %q", page.Count, page.Bookmark)
+	}
+	stub.mustQuery(&page, "listPersons", "4", "")
+	if page.Count != 4 || page.Bookmark == "" {
+		t.Errorf("a full page before the last person has no bookmark: %+v", page)
+	}
+}
+
+func TestListRequestsFiltersByStatus(t *testing.T) {
+	stub := newTestStub(t)
+	stub.mustInvoke("createPerson", "c1")
+	for _, requestId := range []string{"r1", "r2", "r3", "r4"} {
+		stub.mustInvoke("saveRequestState", requestId, "c1")
+	}
+	stub.mustInvoke("startReview", "r2", "")
+	stub.mustInvoke("startReview", "r4", "")
+
+	page := requestPage{}
+	stub.mustQuery(&page, "listRequests", "1", "", RequestStatusUnderReview)
+	if page.Count != 1 || page.Results[0].Id != "r2" || page.Bookmark == "" {
+		t.Fatalf("first page = %+v", page)
+	}
+	bookmark := page.Bookmark
+	page = requestPage{}
+	stub.mustQuery(&page, "listRequests", "1", bookmark, RequestStatusUnderReview)
+	if page.Count != 1 || page.Results[0].Id != "r4" {
+		t.Fatalf("second page = %+v", page)
+	}
+
+	page = requestPage{}
+	stub.mustQuery(&page, "listRequests", "10", "", RequestStatusSubmitted)
+	if page.Count != 2 || page.Results[0].Id != "r1" || page.Results[1].Id != "r3" || page.Bookmark != "" {
+		t.Errorf("submitted requests = %+v", page)
+	}
+}
+
+func TestPageArgumentsAreChecked(t *testing.T) {
+	stub := newTestStub(t)
+	stub.mustInvoke("createPerson", "p1")
+	stub.mustInvoke("createPerson", "p2")
+	stub.mustInvoke("saveRequestState", "r1", "p1")
+	stub.mustInvoke("saveRequestState", "r2", "p1")
+
+	for _, pageSize := range []string{"0", "101", "ten"} {
+		_, err := stub.query("listPersons", pageSize, "")
+		expectCode(t, err, ccerror.InvalidArgument)
+	}
+	_, err := stub.query("listPersons", "1", "not base64!")
+	expectCode(t, err, ccerror.InvalidArgument)
+
+	page := requestPage{}
+	stub.mustQuery(&page, "listRequests", "1", "")
+	_, err = stub.query("listPersons", "1", page.Bookmark)
+	expectCode(t, err, ccerror.InvalidArgument)
+}
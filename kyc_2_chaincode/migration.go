@@ -0,0 +1,420 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+// Schema version stamped on every Person this chaincode writes. Persons of
+// the original kyc_chaincode, with DocsMetaData instead of InfoElements, are
+// version 1.
+const personSchemaVersion = 2
+
+// Object types of the per-person migration records and of the stored reports
+const personMigrationObjectType = "LegacyMigration"
+const migrationReportObjectType = "LegacyMigrationReport"
+
+// Element id prefix used when the config does not name one
+const defaultLegacyElementIdPrefix = "doc-"
+
+// LegacyPerson is a Person as stored by kyc_chaincode
+type LegacyPerson struct {
+	Id           string              `json:"id"`
+	DocsMetaData []LegacyDocMetaData `json:"docsMetaData"`
+}
+
+// LegacyDocMetaData is a document entry of a kyc_chaincode Person
+type LegacyDocMetaData struct {
+	Id     uint   `json:"id"`
+	Hash   string `json:"hash"`
+	Status string `json:"status"`
+}
+
+// MigrationConfig maps legacy documents onto InfoElements. Titles and Types
+// are keyed by the legacy document id, Statuses by the legacy status.
+// Documents without a type mapping get DefaultType; statuses without a
+// mapping become PENDING. Legacy decisions carried over as VERIFIED or
+// REJECTED are recorded as made by Verifier, a registered verifier vouching
+// for them, at the time of the migration.
+type MigrationConfig struct {
+	ElementIdPrefix string            `json:"elementIdPrefix"`
+	Titles          map[string]string `json:"titles"`
+	Types           map[string]string `json:"types"`
+	Statuses        map[string]string `json:"statuses"`
+	DefaultType     string            `json:"defaultType"`
+	Verifier        string            `json:"verifier"`
+}
+
+// MigrationSource names the legacy persons to migrate: either the records
+// themselves, or the ids to read from a deployed kyc_chaincode.
+type MigrationSource struct {
+	Persons         []LegacyPerson `json:"persons"`
+	SourceChaincode string         `json:"sourceChaincode"`
+	PersonIds       []string       `json:"personIds"`
+}
+
+// PersonMigration records that a person was migrated, so reruns with the same
+// input can skip it. InputHash covers the legacy record and the config.
+type PersonMigration struct {
+	PersonId      string   `json:"personId"`
+	SchemaVersion int      `json:"schemaVersion"`
+	InputHash     string   `json:"inputHash"`
+	ElementIds    []string `json:"elementIds"`
+	MigratedOn    string   `json:"migratedOn"`
+	TxId          string   `json:"txId"`
+}
+
+// MigratedPerson is a person written by one migration run
+type MigratedPerson struct {
+	PersonId   string   `json:"personId"`
+	ElementIds []string `json:"elementIds"`
+}
+
+// MigrationFailure is a person a migration run could not write
+type MigrationFailure struct {
+	PersonId string         `json:"personId"`
+	Error    *ccerror.Error `json:"error"`
+}
+
+// MigrationReport is the outcome of one migrateLegacyPersons transaction
+type MigrationReport struct {
+	TxId            string             `json:"txId"`
+	RanOn           string             `json:"ranOn"`
+	SchemaVersion   int                `json:"schemaVersion"`
+	SourceChaincode string             `json:"sourceChaincode,omitempty"`
+	Migrated        []MigratedPerson   `json:"migrated"`
+	Unchanged       []string           `json:"unchanged"`
+	Failed          []MigrationFailure `json:"failed"`
+}
+
+// Migrates kyc_chaincode persons to InfoElements. Arguments are the
+// MigrationConfig and the MigrationSource as JSON. Persons already migrated
+// from the same input are left alone, so a run can be repeated safely. The
+// report is stored under the transaction id and returned.
+func (kyc *KYCChaincode) migrateLegacyPersons(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: migrateLegacyPersons called")
+
+	if len(args) != 2 {
+		return nil, ccerror.IncorrectArgs("2")
+	}
+
+	config := MigrationConfig{}
+	err := json.Unmarshal([]byte(args[0]), &config)
+	if err != nil {
+		return nil, ccerror.New(ccerror.InvalidArgument, "config", "Failed to unmarshal migration config: %s", err.Error())
+	}
+	if config.ElementIdPrefix == "" {
+		config.ElementIdPrefix = defaultLegacyElementIdPrefix
+	}
+	err = validateMigrationStatuses(config)
+	if err != nil {
+		return nil, err
+	}
+
+	source := MigrationSource{}
+	err = json.Unmarshal([]byte(args[1]), &source)
+	if err != nil {
+		return nil, ccerror.New(ccerror.InvalidArgument, "source", "Failed to unmarshal migration source: %s", err.Error())
+	}
+
+	legacyPersons, err := readLegacyPersons(stub, source)
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	report := MigrationReport{
+		TxId:            stub.GetTxID(),
+		RanOn:           now.Format(time.RFC3339),
+		SchemaVersion:   personSchemaVersion,
+		SourceChaincode: source.SourceChaincode,
+		Migrated:        []MigratedPerson{},
+		Unchanged:       []string{},
+		Failed:          []MigrationFailure{},
+	}
+
+	for _, legacyPerson := range legacyPersons {
+		migrated, err := kyc.migrateLegacyPerson(stub, config, legacyPerson)
+		if err != nil {
+			ccErr, ok := err.(*ccerror.Error)
+			if !ok {
+				return nil, err
+			}
+			report.Failed = append(report.Failed, MigrationFailure{PersonId: legacyPerson.Id, Error: ccErr})
+		} else if migrated == nil {
+			report.Unchanged = append(report.Unchanged, legacyPerson.Id)
+		} else {
+			report.Migrated = append(report.Migrated, *migrated)
+		}
+	}
+
+	reportKey, err := createCompositeKey(migrationReportObjectType, []string{report.TxId})
+	if err != nil {
+		return nil, err
+	}
+	jsonAsBytes, _ := json.Marshal(report)
+	err = stub.PutState(reportKey, jsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("CHAINCODE: Returning from migrateLegacyPersons")
+
+	return jsonAsBytes, nil
+}
+
+// Checks the status mapping in legacy status order, so every peer reports
+// the same entry when several are wrong
+func validateMigrationStatuses(config MigrationConfig) error {
+	legacyStatuses := []string{}
+	for legacyStatus := range config.Statuses {
+		legacyStatuses = append(legacyStatuses, legacyStatus)
+	}
+	sort.Strings(legacyStatuses)
+
+	for _, legacyStatus := range legacyStatuses {
+		status := config.Statuses[legacyStatus]
+		if status != ElementStatusPending && status != ElementStatusVerified && status != ElementStatusRejected {
+			return ccerror.New(ccerror.InvalidArgument, "statuses", "Legacy status %s maps to unknown status %s", legacyStatus, status)
+		}
+		if status != ElementStatusPending && config.Verifier == "" {
+			return ccerror.New(ccerror.InvalidArgument, "verifier", "Legacy status %s maps to %s, which needs a verifier to vouch for it", legacyStatus, status)
+		}
+	}
+	return nil
+}
+
+// Returns the legacy persons of a source, reading them from the source
+// chaincode when only ids are given
+func readLegacyPersons(stub shim.ChaincodeStubInterface, source MigrationSource) ([]LegacyPerson, error) {
+	if (len(source.Persons) > 0) == (source.SourceChaincode != "") {
+		return nil, ccerror.New(ccerror.InvalidArgument, "source", "Migration source needs either persons or sourceChaincode")
+	}
+	if len(source.Persons)+len(source.PersonIds) > maxBatchSize {
+		return nil, ccerror.New(ccerror.InvalidArgument, "source", "Migration source has more than %d persons", maxBatchSize)
+	}
+	if source.SourceChaincode == "" {
+		return source.Persons, nil
+	}
+	if len(source.PersonIds) == 0 {
+		return nil, ccerror.New(ccerror.InvalidArgument, "personIds", "personIds are required with sourceChaincode")
+	}
+
+	legacyPersons := []LegacyPerson{}
+	for _, personId := range source.PersonIds {
+		personJSONAsBytes, err := stub.QueryChaincode(source.SourceChaincode, [][]byte{[]byte("queryPerson"), []byte(personId)})
+		if err != nil {
+			return nil, ccerror.New(ccerror.Internal, "sourceChaincode", "Failed to query person %s from %s: %s", personId, source.SourceChaincode, err.Error())
+		}
+		if len(personJSONAsBytes) == 0 {
+			return nil, ccerror.New(ccerror.NotFound, "personIds", "Person %s does not exist in %s", personId, source.SourceChaincode)
+		}
+
+		legacyPerson := LegacyPerson{}
+		err = json.Unmarshal(personJSONAsBytes, &legacyPerson)
+		if err != nil {
+			return nil, ccerror.New(ccerror.InvalidArgument, "personIds", "Person %s of %s is not a legacy person: %s", personId, source.SourceChaincode, err.Error())
+		}
+		legacyPersons = append(legacyPersons, legacyPerson)
+	}
+
+	return legacyPersons, nil
+}
+
+// Migrates one legacy person. Returns nil when it was already migrated from
+// the same input. Elements of an earlier migration of the person are replaced;
+// elements added since through this chaincode are kept.
+func (kyc *KYCChaincode) migrateLegacyPerson(stub shim.ChaincodeStubInterface, config MigrationConfig, legacyPerson LegacyPerson) (*MigratedPerson, error) {
+	inputHash := migrationInputHash(config, legacyPerson)
+
+	record, err := getPersonMigration(stub, legacyPerson.Id)
+	if err != nil {
+		return nil, err
+	}
+	if record != nil && record.InputHash == inputHash && record.SchemaVersion == personSchemaVersion {
+		return nil, nil
+	}
+
+	storedPerson, err := kyc.getPerson(stub, legacyPerson.Id)
+	if err != nil {
+		return nil, err
+	}
+	if storedPerson != nil && record == nil {
+		return nil, ccerror.New(ccerror.Conflict, "personId", "Person with id %s already exists and was not migrated", legacyPerson.Id)
+	}
+	if storedPerson == nil {
+		storedPerson = &Person{Id: legacyPerson.Id, InfoElements: []InfoElement{}}
+	}
+	person := *storedPerson
+
+	if record != nil {
+		for _, elementId := range record.ElementIds {
+			if findInfoElement(person, elementId) != nil {
+				removeInfoElement(&person, elementId)
+			}
+		}
+	}
+
+	elementIds := []string{}
+	for _, docMetaData := range legacyPerson.DocsMetaData {
+		infoElement, err := kyc.mapDocMetaData(stub, config, docMetaData)
+		if err != nil {
+			return nil, err
+		}
+		if findInfoElement(person, infoElement.Id) != nil {
+			return nil, ccerror.New(ccerror.Conflict, "elementId", "InfoElement %s already exists on person %s", infoElement.Id, legacyPerson.Id)
+		}
+		setInfoElement(&person, infoElement)
+		elementIds = append(elementIds, infoElement.Id)
+	}
+
+	err = kyc.putPerson(stub, person)
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = putPersonMigration(stub, PersonMigration{
+		PersonId:      person.Id,
+		SchemaVersion: personSchemaVersion,
+		InputHash:     inputHash,
+		ElementIds:    elementIds,
+		MigratedOn:    now.Format(time.RFC3339),
+		TxId:          stub.GetTxID(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &MigratedPerson{PersonId: person.Id, ElementIds: elementIds}, nil
+}
+
+// Maps one legacy document onto an InfoElement and validates it against its
+// element type
+func (kyc *KYCChaincode) mapDocMetaData(stub shim.ChaincodeStubInterface, config MigrationConfig, docMetaData LegacyDocMetaData) (InfoElement, error) {
+	legacyId := strconv.FormatUint(uint64(docMetaData.Id), 10)
+
+	elementType, ok := config.Types[legacyId]
+	if !ok {
+		elementType = config.DefaultType
+	}
+	if elementType == "" {
+		return InfoElement{}, ccerror.New(ccerror.InvalidArgument, "types", "No element type for legacy document %s and no defaultType", legacyId)
+	}
+
+	status, ok := config.Statuses[docMetaData.Status]
+	if !ok {
+		status = ElementStatusPending
+	}
+
+	infoElement := InfoElement{
+		Id:          config.ElementIdPrefix + legacyId,
+		Title:       config.Titles[legacyId],
+		ElementType: elementType,
+		Hash:        docMetaData.Hash,
+		Status:      status,
+	}
+
+	err := kyc.conformInfoElement(stub, &infoElement, false)
+	if err != nil {
+		return infoElement, err
+	}
+
+	if status != ElementStatusPending {
+		err = checkVerifier(stub, config.Verifier, elementType)
+		if err != nil {
+			return infoElement, err
+		}
+		now, err := getTxTime(stub)
+		if err != nil {
+			return infoElement, err
+		}
+		infoElement.VerifiedOn = now.Format(time.RFC3339)
+		infoElement.VerifiedBy = config.Verifier
+		infoElement.VerificationProof = "legacy:" + legacyId + ":" + docMetaData.Status
+	}
+
+	return infoElement, nil
+}
+
+func migrationInputHash(config MigrationConfig, legacyPerson LegacyPerson) string {
+	configJSONAsBytes, _ := json.Marshal(config)
+	personJSONAsBytes, _ := json.Marshal(legacyPerson)
+
+	digest := sha256.New()
+	digest.Write(configJSONAsBytes)
+	digest.Write(personJSONAsBytes)
+	return hex.EncodeToString(digest.Sum(nil))
+}
+
+func getPersonMigration(stub shim.ChaincodeStubInterface, personId string) (*PersonMigration, error) {
+	key, err := createCompositeKey(personMigrationObjectType, []string{personId})
+	if err != nil {
+		return nil, err
+	}
+
+	recordJSONAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, ccerror.New(ccerror.Internal, "", "Failed to get migration record for %s", personId)
+	}
+	if recordJSONAsBytes == nil {
+		return nil, nil
+	}
+
+	record := PersonMigration{}
+	err = json.Unmarshal(recordJSONAsBytes, &record)
+	if err != nil {
+		return nil, ccerror.New(ccerror.Internal, "", "Failed to unmarshal migration record for %s", personId)
+	}
+	return &record, nil
+}
+
+func putPersonMigration(stub shim.ChaincodeStubInterface, record PersonMigration) error {
+	key, err := createCompositeKey(personMigrationObjectType, []string{record.PersonId})
+	if err != nil {
+		return err
+	}
+
+	jsonAsBytes, _ := json.Marshal(record)
+	return stub.PutState(key, jsonAsBytes)
+}
+
+// Returns the report of a migration run. The argument is the transaction id
+// of the run.
+func (kyc *KYCChaincode) queryMigrationReport(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: queryMigrationReport called")
+
+	if len(args) != 1 {
+		return nil, ccerror.IncorrectArgs("1")
+	}
+
+	key, err := createCompositeKey(migrationReportObjectType, []string{args[0]})
+	if err != nil {
+		return nil, err
+	}
+
+	reportJSONAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, ccerror.New(ccerror.Internal, "", "Failed to get migration report %s", args[0])
+	}
+	if reportJSONAsBytes == nil {
+		return nil, ccerror.New(ccerror.NotFound, "txId", "No migration report for transaction %s", args[0])
+	}
+
+	return reportJSONAsBytes, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+// legacyChaincode answers queryPerson the way kyc_chaincode does
+type legacyChaincode struct{}
+
+func (cc legacyChaincode) Init(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	return nil, nil
+}
+
+func (cc legacyChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	return nil, stub.PutState(args[0], []byte(args[1]))
+}
+
+func (cc legacyChaincode) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	return stub.GetState(args[0])
+}
+
+var legacyPersons = []LegacyPerson{
+	{Id: "l1", DocsMetaData: []LegacyDocMetaData{{Id: 1, Hash: "h1", Status: "OK"}, {Id: 2, Hash: "h2", Status: "NEW"}}},
+	{Id: "l2", DocsMetaData: []LegacyDocMetaData{{Id: 1, Hash: "h3", Status: "BAD"}}},
+}
+
+func migrationConfig() MigrationConfig {
+	return MigrationConfig{
+		Titles:      map[string]string{"1": "Passport"},
+		Types:       map[string]string{"1": "PASSPORT"},
+		Statuses:    map[string]string{"OK": ElementStatusVerified, "BAD": ElementStatusRejected},
+		DefaultType: "ADDRESS",
+		Verifier:    "legacy-kyc",
+	}
+}
+
+func TestMigrateLegacyPersons(t *testing.T) {
+	stub := newTestStub(t)
+	stub.registerElementType("PASSPORT")
+	stub.registerElementType("ADDRESS")
+	stub.registerVerifier("legacy-kyc")
+
+	report := MigrationReport{}
+	json.Unmarshal(stub.mustInvoke("migrateLegacyPersons", jsonArg(migrationConfig()), jsonArg(MigrationSource{Persons: legacyPersons})), &report)
+	if len(report.Migrated) != 2 || len(report.Failed) != 0 || report.SchemaVersion != personSchemaVersion {
+		t.Fatalf("report = %+v", report)
+	}
+
+	person := storedPerson(stub, "l1")
+	if person.SchemaVersion != personSchemaVersion || len(person.InfoElements) != 2 {
+		t.Fatalf("migrated person = %+v", person)
+	}
+	passport := findInfoElement(person, "doc-1")
+	if passport.ElementType != "PASSPORT" || passport.Title != "Passport" || passport.Hash != "h1" || passport.Status != ElementStatusVerified ||
+		passport.VerifiedBy != "legacy-kyc" || passport.VerifiedOn == "" || passport.VerificationProof != "legacy:1:OK" {
+		t.Errorf("migrated passport = %+v", *passport)
+	}
+	address := findInfoElement(person, "doc-2")
+	if address.ElementType != "ADDRESS" || address.Status != ElementStatusPending || address.VerifiedBy != "" || address.VerifiedOn != "" {
+		t.Errorf("migrated address = %+v", *address)
+	}
+	if rejected := findInfoElement(storedPerson(stub, "l2"), "doc-1"); rejected.Status != ElementStatusRejected || rejected.VerifiedBy != "legacy-kyc" {
+		t.Errorf("migrated rejected document = %+v", *rejected)
+	}
+
+	stored := MigrationReport{}
+	stub.mustQuery(&stored, "queryMigrationReport", report.TxId)
+	if len(stored.Migrated) != 2 {
+		t.Errorf("stored report = %+v", stored)
+	}
+
+	report = MigrationReport{}
+	json.Unmarshal(stub.mustInvoke("migrateLegacyPersons", jsonArg(migrationConfig()), jsonArg(MigrationSource{Persons: legacyPersons})), &report)
+	if len(report.Migrated) != 0 || len(report.Unchanged) != 2 {
+		t.Errorf("rerun report = %+v", report)
+	}
+}
+
+func TestMigrationNeedsARegisteredVerifierForDecisions(t *testing.T) {
+	stub := newTestStub(t)
+	stub.registerElementType("PASSPORT")
+	stub.registerElementType("ADDRESS")
+
+	config := migrationConfig()
+	config.Verifier = ""
+	_, err := stub.invoke("migrateLegacyPersons", jsonArg(config), jsonArg(MigrationSource{Persons: legacyPersons}))
+	expectCode(t, err, ccerror.InvalidArgument)
+
+	report := MigrationReport{}
+	json.Unmarshal(stub.mustInvoke("migrateLegacyPersons", jsonArg(migrationConfig()), jsonArg(MigrationSource{Persons: legacyPersons})), &report)
+	if len(report.Failed) != 2 || report.Failed[0].Error.Code != ccerror.Forbidden {
+		t.Errorf("migration vouched for by an unregistered verifier = %+v", report)
+	}
+
+	config.Statuses = nil
+	json.Unmarshal(stub.mustInvoke("migrateLegacyPersons", jsonArg(config), jsonArg(MigrationSource{Persons: legacyPersons})), &report)
+	if len(report.Migrated) != 2 || findInfoElement(storedPerson(stub, "l1"), "doc-1").Status != ElementStatusPending {
+		t.Errorf("migration without status mapping = %+v", report)
+	}
+}
+
+func TestMigrationStatusErrorsAreDeterministic(t *testing.T) {
+	stub := newTestStub(t)
+	config := migrationConfig()
+	config.Statuses = map[string]string{"Z": "DONE", "A": "CHECKED", "M": "OK", "B": ElementStatusVerified}
+
+	for i := 0; i < 20; i++ {
+		_, err := stub.invoke("migrateLegacyPersons", jsonArg(config), jsonArg(MigrationSource{Persons: legacyPersons}))
+		expectCode(t, err, ccerror.InvalidArgument)
+		if message := err.(*ccerror.Error).Message; message != "Legacy status A maps to unknown status CHECKED" {
+			t.Fatalf("run %d reported %q", i, message)
+		}
+	}
+}
+
+func TestMigrateFromSourceChaincode(t *testing.T) {
+	stub := newTestStub(t)
+	stub.registerElementType("PASSPORT")
+	stub.registerElementType("ADDRESS")
+
+	legacy := shim.NewMockStub("kyc_chaincode", legacyChaincode{})
+	_, err := legacy.MockInvoke("legacy-tx", "createPerson", []string{"l1", jsonArg(legacyPersons[0])})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub.MockPeerChaincode("kyc_chaincode", legacy)
+
+	config := migrationConfig()
+	config.Statuses = nil
+	report := MigrationReport{}
+	json.Unmarshal(stub.mustInvoke("migrateLegacyPersons", jsonArg(config), jsonArg(MigrationSource{SourceChaincode: "kyc_chaincode", PersonIds: []string{"l1"}})), &report)
+	if len(report.Migrated) != 1 || report.SourceChaincode != "kyc_chaincode" || len(storedPerson(stub, "l1").InfoElements) != 2 {
+		t.Errorf("report = %+v", report)
+	}
+
+	_, err = stub.invoke("migrateLegacyPersons", jsonArg(config), jsonArg(MigrationSource{SourceChaincode: "kyc_chaincode", PersonIds: []string{"missing"}}))
+	expectCode(t, err, ccerror.NotFound)
+}
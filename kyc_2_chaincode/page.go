@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/base64"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+// Largest page a paginated query returns
+const maxPageSize = 100
+
+// Page is the envelope of every paginated query. Bookmark is empty on the last page.
+type Page struct {
+	Results  []interface{} `json:"results"`
+	Count    int           `json:"count"`
+	Bookmark string        `json:"bookmark"`
+}
+
+// Parses the page size and bookmark arguments of a paginated query
+func parsePageArgs(pageSizeArg string, bookmark string) (int, string, error) {
+	pageSize, err := strconv.Atoi(pageSizeArg)
+	if err != nil || pageSize < 1 || pageSize > maxPageSize {
+		return 0, "", ccerror.New(ccerror.InvalidArgument, "pageSize", "Page size must be a number between 1 and %d", maxPageSize)
+	}
+
+	lastKey := ""
+	if bookmark != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(bookmark)
+		if err != nil {
+			return 0, "", ccerror.New(ccerror.InvalidArgument, "bookmark", "Invalid bookmark")
+		}
+		lastKey = string(decoded)
+	}
+
+	return pageSize, lastKey, nil
+}
+
+// Walks the keys between startKey and endKey in key order, starting after the
+// key a bookmark points at, and collects up to pageSize results returned by
+// match. Keys match skips do not count towards the page.
+func pageKeys(stub shim.ChaincodeStubInterface, startKey string, endKey string, pageSize int, lastKey string,
+	match func(key string, value []byte) (interface{}, bool, error)) (Page, error) {
+
+	if lastKey != "" {
+		if lastKey < startKey || lastKey >= endKey {
+			return Page{}, ccerror.New(ccerror.InvalidArgument, "bookmark", "Bookmark does not belong to this query")
+		}
+		// The smallest key sorting after the bookmarked one
+		startKey = lastKey + compositeKeySeparator
+	}
+
+	iterator, err := stub.RangeQueryState(startKey, endKey)
+	if err != nil {
+		return Page{}, err
+	}
+	defer iterator.Close()
+
+	page := Page{Results: []interface{}{}}
+	for iterator.HasNext() {
+		key, value, err := iterator.Next()
+		if err != nil {
+			return Page{}, err
+		}
+
+		result, ok, err := match(key, value)
+		if err != nil {
+			return Page{}, err
+		}
+		if !ok {
+			continue
+		}
+
+		page.Results = append(page.Results, result)
+		if len(page.Results) == pageSize {
+			if iterator.HasNext() {
+				page.Bookmark = base64.RawURLEncoding.EncodeToString([]byte(key))
+			}
+			break
+		}
+	}
+	page.Count = len(page.Results)
+
+	return page, nil
+}
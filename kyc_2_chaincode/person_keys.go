@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+// KeyRotation is the result of rotatePersonKey
+type KeyRotation struct {
+	PersonId      string   `json:"personId"`
+	KeyId         string   `json:"keyId"`
+	Reencrypted   []string `json:"reencrypted"`
+	RetiredKeyIds []string `json:"retiredKeyIds"`
+}
+
+// Same as queryPerson, with element values and comments decrypted using the
+// keys passed as personKeys in the transient inputs. Queries are not recorded
+// on the ledger, so the keys are not either. Values stored in clear are
+// returned as they are.
+func (kyc *KYCChaincode) queryPersonDecrypted(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: queryPersonDecrypted called")
+
+	personJSONAsBytes, err := kyc.queryPerson(stub, args)
+	if err != nil {
+		return nil, err
+	}
+
+	person := Person{}
+	json.Unmarshal(personJSONAsBytes, &person)
+
+	ring, err := kyc.getReadKeyring(stub, person)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range person.InfoElements {
+		person.InfoElements[i], err = openInfoElement(person.InfoElements[i], ring)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	jsonAsBytes, _ := json.Marshal(person)
+	return jsonAsBytes, nil
+}
+
+// Same as queryInfoElement, with the value and comments decrypted using the
+// keys passed as personKeys in the transient inputs
+func (kyc *KYCChaincode) queryInfoElementDecrypted(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: queryInfoElementDecrypted called")
+
+	infoElementJSONAsBytes, err := kyc.queryInfoElement(stub, args)
+	if err != nil {
+		return nil, err
+	}
+
+	infoElement := InfoElement{}
+	json.Unmarshal(infoElementJSONAsBytes, &infoElement)
+
+	person, err := kyc.mustGetPerson(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	ring, err := kyc.getReadKeyring(stub, person)
+	if err != nil {
+		return nil, err
+	}
+
+	infoElement, err = openInfoElement(infoElement, ring)
+	if err != nil {
+		return nil, err
+	}
+
+	jsonAsBytes, _ := json.Marshal(infoElement)
+	return jsonAsBytes, nil
+}
+
+// ResealedElement carries the value and comments of an element sealed by the
+// client under the new key of a rotation
+type ResealedElement struct {
+	Id           string `json:"id"`
+	ElementValue string `json:"elementValue"`
+	Comments     string `json:"comments"`
+}
+
+// Moves every element of a person to a new key and retires the person's
+// other keys. Arguments are the person id, the new key id, its fingerprint
+// and a JSON array of ResealedElement. The client decrypts and reseals the
+// elements itself, so every element holding a value or comments must be
+// listed, sealed with the new key. The chaincode cannot see that the
+// plaintext is unchanged, so verifications are kept on the word of the data
+// controller, the only caller allowed. Retired keys should be destroyed
+// off-chain once the rotation is committed.
+func (kyc *KYCChaincode) rotatePersonKey(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: rotatePersonKey called")
+
+	if len(args) != 4 {
+		return nil, ccerror.IncorrectArgs("4")
+	}
+	keyId := args[1]
+	fingerprint := args[2]
+	if !keyIdPattern.MatchString(keyId) {
+		return nil, ccerror.New(ccerror.InvalidArgument, "keyId", "Key id must be 1 to 64 letters, digits, dots, dashes or underscores")
+	}
+	if !fingerprintPattern.MatchString(fingerprint) {
+		return nil, ccerror.New(ccerror.InvalidArgument, "fingerprint", "Fingerprint must be 64 lowercase hex digits")
+	}
+
+	resealedElements := []ResealedElement{}
+	err := json.Unmarshal([]byte(args[3]), &resealedElements)
+	if err != nil {
+		return nil, ccerror.New(ccerror.InvalidArgument, "elements", "Failed to unmarshal elements: %s", err.Error())
+	}
+
+	person, err := kyc.mustGetPerson(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	record, err := getPersonKey(stub, person.Id, keyId)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		err = putPersonKey(stub, person.Id, keyId, fingerprint)
+		if err != nil {
+			return nil, err
+		}
+	} else if record.Fingerprint != fingerprint {
+		return nil, ccerror.New(ccerror.Forbidden, "fingerprint", "Fingerprint does not match key id %s", keyId)
+	} else if record.RetiredOn != "" {
+		return nil, ccerror.New(ccerror.InvalidArgument, "keyId", "Key %s was retired on %s", keyId, record.RetiredOn)
+	}
+
+	resealed := map[string]ResealedElement{}
+	for _, resealedElement := range resealedElements {
+		if findInfoElement(person, resealedElement.Id) == nil {
+			return nil, ccerror.New(ccerror.NotFound, "elementId", "InfoElement with id %s does not exist", resealedElement.Id)
+		}
+		if _, ok := resealed[resealedElement.Id]; ok {
+			return nil, ccerror.New(ccerror.InvalidArgument, "elements", "InfoElement %s is listed more than once", resealedElement.Id)
+		}
+		resealed[resealedElement.Id] = resealedElement
+	}
+
+	rotation := KeyRotation{PersonId: person.Id, KeyId: keyId, Reencrypted: []string{}, RetiredKeyIds: []string{}}
+
+	for i, infoElement := range person.InfoElements {
+		resealedElement, ok := resealed[infoElement.Id]
+		if infoElement.ElementValue == "" && infoElement.Comments == "" {
+			if ok {
+				return nil, ccerror.New(ccerror.InvalidArgument, "elements", "InfoElement %s holds no value or comments to reseal", infoElement.Id)
+			}
+			continue
+		}
+		if !ok {
+			return nil, ccerror.New(ccerror.InvalidArgument, "elements", "InfoElement %s must be resealed with key %s", infoElement.Id, keyId)
+		}
+
+		err = checkResealed(infoElement.Id, "elementValue", infoElement.ElementValue, resealedElement.ElementValue, keyId)
+		if err != nil {
+			return nil, err
+		}
+		err = checkResealed(infoElement.Id, "comments", infoElement.Comments, resealedElement.Comments, keyId)
+		if err != nil {
+			return nil, err
+		}
+
+		person.InfoElements[i].ElementValue = resealedElement.ElementValue
+		person.InfoElements[i].Comments = resealedElement.Comments
+		rotation.Reencrypted = append(rotation.Reencrypted, infoElement.Id)
+	}
+
+	now, err := getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	for _, retiredKeyId := range person.EncryptionKeyIds {
+		if retiredKeyId == keyId {
+			continue
+		}
+		err = retirePersonKey(stub, person.Id, retiredKeyId, now)
+		if err != nil {
+			return nil, err
+		}
+		rotation.RetiredKeyIds = append(rotation.RetiredKeyIds, retiredKeyId)
+	}
+	person.EncryptionKeyIds = []string{keyId}
+
+	err = kyc.putPerson(stub, person)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("CHAINCODE: Returning from rotatePersonKey")
+
+	jsonAsBytes, _ := json.Marshal(rotation)
+	return jsonAsBytes, nil
+}
+
+// Checks that a field was resealed with the new key, and only if it was set
+func checkResealed(elementId string, field string, stored string, resealed string, keyId string) error {
+	if stored == "" {
+		if resealed != "" {
+			return ccerror.New(ccerror.InvalidArgument, field, "%s of element %s is empty and cannot be set by a rotation", field, elementId)
+		}
+		return nil
+	}
+
+	if !isSealed(resealed) {
+		return ccerror.New(ccerror.InvalidArgument, field, "%s of element %s must be sealed with key %s", field, elementId, keyId)
+	}
+	resealedKeyId, err := parseSealedValue(elementId, field, resealed)
+	if err != nil {
+		return err
+	}
+	if resealedKeyId != keyId {
+		return ccerror.New(ccerror.InvalidArgument, field, "%s of element %s is sealed with key %s instead of %s", field, elementId, resealedKeyId, keyId)
+	}
+	return nil
+}
+
+func retirePersonKey(stub shim.ChaincodeStubInterface, personId string, keyId string, now time.Time) error {
+	record, err := getPersonKey(stub, personId, keyId)
+	if err != nil {
+		return err
+	}
+	if record == nil || record.RetiredOn != "" {
+		return nil
+	}
+
+	key, err := personKeyKey(personId, keyId)
+	if err != nil {
+		return err
+	}
+
+	record.RetiredOn = now.Format(time.RFC3339)
+	jsonAsBytes, _ := json.Marshal(record)
+	return stub.PutState(key, jsonAsBytes)
+}
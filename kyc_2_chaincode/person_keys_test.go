@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+var rotatedKey = []byte("fedcba9876543210fedcba9876543210")
+
+// Passes keys to the following queries the way a client does
+func (stub *testStub) withKeys(keys map[string][]byte) *testStub {
+	keysAsJSON, _ := json.Marshal(keys)
+	stub.metadata, _ = json.Marshal(map[string][]byte{transientPersonKeys: keysAsJSON})
+	return stub
+}
+
+// Creates c1 with a sealed element e1 and an element e2 without content
+func createSealedPerson(stub *testStub) {
+	stub.t.Helper()
+	stub.registerElementType("PASSPORT")
+	stub.mustInvoke("createPerson", "c1")
+	stub.mustInvoke("registerPersonKey", "c1", "k1", keyFingerprint(testKey))
+	stub.mustInvoke("updateInfoElement", "c1", jsonArg(InfoElement{
+		Id:           "e1",
+		ElementType:  "PASSPORT",
+		ElementValue: clientSeal(testKey, "k1", "e1", "elementValue", "X1"),
+		Comments:     clientSeal(testKey, "k1", "e1", "comments", "original seen"),
+	}))
+	stub.mustInvoke("updateInfoElement", "c1", jsonArg(InfoElement{Id: "e2", ElementType: "PASSPORT", Hash: "ab"}))
+}
+
+func TestQueryPersonDecrypted(t *testing.T) {
+	stub := newTestStub(t)
+	createSealedPerson(stub)
+
+	_, err := stub.query("queryPersonDecrypted", "c1")
+	expectCode(t, err, ccerror.InvalidArgument)
+	_, err = stub.withKeys(map[string][]byte{"k1": rotatedKey}).query("queryPersonDecrypted", "c1")
+	expectCode(t, err, ccerror.Forbidden)
+	_, err = stub.withKeys(map[string][]byte{"k2": rotatedKey}).query("queryPersonDecrypted", "c1")
+	expectCode(t, err, ccerror.NotFound)
+
+	person := Person{}
+	stub.withKeys(map[string][]byte{"k1": testKey}).mustQuery(&person, "queryPersonDecrypted", "c1")
+	if e1 := findInfoElement(person, "e1"); e1.ElementValue != "X1" || e1.Comments != "original seen" {
+		t.Errorf("decrypted e1 = %+v", *e1)
+	}
+	infoElement := InfoElement{}
+	stub.mustQuery(&infoElement, "queryInfoElementDecrypted", "c1", "e1")
+	if infoElement.ElementValue != "X1" {
+		t.Errorf("decrypted element = %+v", infoElement)
+	}
+}
+
+func TestRotatePersonKeyTakesResealedElements(t *testing.T) {
+	stub := newTestStub(t)
+	createSealedPerson(stub)
+	stub.registerVerifier("v1")
+	stub.as(RoleVerifier, "v1").mustInvoke("verifyInfoElement", "c1", "e1", ElementStatusVerified, "proof")
+	stub.as(RoleAdmin, "admin")
+
+	fingerprint := keyFingerprint(rotatedKey)
+	resealed := ResealedElement{
+		Id:           "e1",
+		ElementValue: clientSeal(rotatedKey, "k2", "e1", "elementValue", "X1"),
+		Comments:     clientSeal(rotatedKey, "k2", "e1", "comments", "original seen"),
+	}
+
+	_, err := stub.as(RoleCustomer, "c1").invoke("rotatePersonKey", "c1", "k2", fingerprint, jsonArg([]ResealedElement{resealed}))
+	expectCode(t, err, ccerror.Forbidden)
+	stub.as(RoleAdmin, "admin")
+
+	for _, elements := range [][]ResealedElement{
+		{},
+		{{Id: "e1", ElementValue: resealed.ElementValue}},
+		{{Id: "e1", ElementValue: clientSeal(testKey, "k1", "e1", "elementValue", "X1"), Comments: resealed.Comments}},
+		{resealed, {Id: "e2", Comments: clientSeal(rotatedKey, "k2", "e2", "comments", "new")}},
+	} {
+		_, err = stub.invoke("rotatePersonKey", "c1", "k2", fingerprint, jsonArg(elements))
+		expectCode(t, err, ccerror.InvalidArgument)
+	}
+	_, err = stub.invoke("rotatePersonKey", "c1", "k2", fingerprint, jsonArg([]ResealedElement{resealed, {Id: "e9"}}))
+	expectCode(t, err, ccerror.NotFound)
+	_, err = stub.invoke("rotatePersonKey", "c1", "k1", keyFingerprint(rotatedKey), jsonArg([]ResealedElement{resealed}))
+	expectCode(t, err, ccerror.Forbidden)
+
+	rotation := KeyRotation{}
+	json.Unmarshal(stub.mustInvoke("rotatePersonKey", "c1", "k2", fingerprint, jsonArg([]ResealedElement{resealed})), &rotation)
+	if rotation.KeyId != "k2" || len(rotation.Reencrypted) != 1 || len(rotation.RetiredKeyIds) != 1 || rotation.RetiredKeyIds[0] != "k1" {
+		t.Errorf("rotation = %+v", rotation)
+	}
+
+	person := storedPerson(stub, "c1")
+	e1 := findInfoElement(person, "e1")
+	if e1.ElementValue != resealed.ElementValue || e1.Status != ElementStatusVerified || len(person.EncryptionKeyIds) != 1 || person.EncryptionKeyIds[0] != "k2" {
+		t.Errorf("rotated person = %+v", person)
+	}
+	if record, _ := getPersonKey(stub, "c1", "k1"); record == nil || record.RetiredOn == "" {
+		t.Errorf("k1 = %+v, expected it retired", record)
+	}
+
+	_, err = stub.invoke("updateInfoElement", "c1", jsonArg(InfoElement{Id: "e3", ElementType: "PASSPORT", ElementValue: clientSeal(testKey, "k1", "e3", "elementValue", "X3")}))
+	expectCode(t, err, ccerror.InvalidArgument)
+	decrypted := Person{}
+	stub.withKeys(map[string][]byte{"k2": rotatedKey}).mustQuery(&decrypted, "queryPersonDecrypted", "c1")
+	if findInfoElement(decrypted, "e1").Comments != "original seen" {
+		t.Errorf("decrypted = %+v", decrypted)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+// A value hash is a hex encoded SHA-256 digest
+var valueHashPattern = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// Private data collections are not available in the v0.6 shim, and everything
+// an invoke receives, arguments and caller metadata alike, is written into
+// the block. Sensitive values are therefore never sent to the chaincode: the
+// submitting institution keeps each value and a random salt of at least 16
+// bytes drawn for that value off-chain, and sends only valueHash, the hex
+// SHA-256 of the salt followed by the value, with an empty elementValue. The
+// chaincode cannot return such values. Parties given the value and salt
+// off-chain check them against the ledger with verifyInfoElementValue.
+// Element types registered as private refuse values sent in clear text.
+
+// Checks the salted hash sent in place of a private ElementValue. Returns
+// false when the element carries its value in clear text.
+func applyPrivateValue(infoElement *InfoElement) (bool, error) {
+	if infoElement.ValueHash == "" {
+		return false, nil
+	}
+	if infoElement.ElementValue != "" {
+		return false, ccerror.New(ccerror.InvalidArgument, "elementValue", "elementValue must be empty when a valueHash is sent")
+	}
+	if !valueHashPattern.MatchString(infoElement.ValueHash) {
+		return false, ccerror.New(ccerror.InvalidArgument, "valueHash", "valueHash must be a lowercase hex SHA-256 digest")
+	}
+	return true, nil
+}
+
+// Every private value is hashed with its own salt. Two elements of a person
+// with the same hash share a salt and a value, which tells anyone reading the
+// ledger that the values are equal.
+func checkValueHashUnique(person Person, infoElement InfoElement) error {
+	for _, other := range person.InfoElements {
+		if other.Id != infoElement.Id && other.ValueHash == infoElement.ValueHash {
+			return ccerror.New(ccerror.InvalidArgument, "valueHash", "valueHash of %s is already used by %s, hash every value with its own salt", infoElement.Id, other.Id)
+		}
+	}
+	return nil
+}
+
+// Checks a salted hash, computed off-chain from a candidate value and its
+// salt, against the hash stored on the InfoElement. Arguments are the person
+// id, the element id, the candidate hash and the purpose of the read.
+func (kyc *KYCChaincode) verifyInfoElementValue(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: verifyInfoElementValue called")
+
+	var purpose string
+
+	if len(args) != 3 && len(args) != 4 {
+		return nil, ccerror.IncorrectArgs("3 or 4")
+	}
+	if len(args) == 4 {
+		purpose = args[3]
+	}
+	if !valueHashPattern.MatchString(args[2]) {
+		return nil, ccerror.New(ccerror.InvalidArgument, "valueHash", "valueHash must be a lowercase hex SHA-256 digest")
+	}
+
+	infoElementAsJSONBytes, err := kyc.queryInfoElement(stub, []string{args[0], args[1], purpose})
+	if err != nil {
+		return nil, err
+	}
+
+	infoElement := InfoElement{}
+	json.Unmarshal(infoElementAsJSONBytes, &infoElement)
+	if infoElement.ValueHash == "" {
+		return nil, ccerror.New(ccerror.Conflict, "elementId", "InfoElement with id %s has no private value", args[1])
+	}
+
+	result := ValueVerification{
+		PersonId:  args[0],
+		ElementId: args[1],
+		Matches:   subtle.ConstantTimeCompare([]byte(args[2]), []byte(infoElement.ValueHash)) == 1,
+	}
+
+	jsonAsBytes, _ := json.Marshal(result)
+	return jsonAsBytes, nil
+}
+
+// Result of checking a candidate value against the public hash
+type ValueVerification struct {
+	PersonId  string `json:"personId"`
+	ElementId string `json:"elementId"`
+	Matches   bool   `json:"matches"`
+}
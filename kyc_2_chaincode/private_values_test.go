@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+// Hashes a value the way clients do before sending it
+func saltedHash(salt string, value string) string {
+	digest := sha256.Sum256([]byte(salt + value))
+	return hex.EncodeToString(digest[:])
+}
+
+const testSalt = "0123456789abcdef"
+
+func TestPrivateValueKeepsOnlyTheHash(t *testing.T) {
+	stub := newTestStub(t)
+	stub.mustInvoke("registerElementType", jsonArg(ElementTypeSpec{Name: "PASSPORT", ValuePattern: "^[A-Z0-9]+$"}))
+	stub.as(RoleCustomer, "c1").mustInvoke("createPerson", "c1")
+
+	valueHash := saltedHash(testSalt, "P1234567")
+	stub.mustInvoke("updateInfoElement", "c1", jsonArg(InfoElement{Id: "e1", ElementType: "PASSPORT", ValueHash: valueHash}))
+
+	stored := findInfoElement(stub.person("c1"), "e1")
+	if stored.ElementValue != "" || stored.ValueHash != valueHash {
+		t.Errorf("stored element = %+v", *stored)
+	}
+	for key, value := range stub.State {
+		if strings.Contains(string(value), "P1234567") || strings.Contains(string(value), testSalt) {
+			t.Errorf("value or salt written under %q", key)
+		}
+	}
+
+	_, err := stub.invoke("updateInfoElement", "c1", jsonArg(InfoElement{Id: "e1", ElementType: "PASSPORT", ElementValue: "P1234567", ValueHash: valueHash}))
+	expectCode(t, err, ccerror.InvalidArgument)
+	_, err = stub.invoke("updateInfoElement", "c1", jsonArg(InfoElement{Id: "e1", ElementType: "PASSPORT", ValueHash: "P1234567"}))
+	expectCode(t, err, ccerror.InvalidArgument)
+
+	batch := jsonArg(map[string]interface{}{"elements": []InfoElement{{Id: "e2", ElementType: "PASSPORT", ValueHash: saltedHash("fedcba9876543210", "P7654321")}}})
+	stub.mustInvoke("updateInfoElements", "c1", batch)
+	if stored := findInfoElement(stub.person("c1"), "e2"); stored.ValueHash != saltedHash("fedcba9876543210", "P7654321") {
+		t.Errorf("batch stored %+v", *stored)
+	}
+}
+
+func TestVerifyInfoElementValue(t *testing.T) {
+	stub := newTestStub(t)
+	stub.registerElementType("PASSPORT")
+	stub.as(RoleCustomer, "c1").mustInvoke("createPerson", "c1")
+	stub.mustInvoke("updateInfoElement", "c1", jsonArg(InfoElement{Id: "e1", ElementType: "PASSPORT", ValueHash: saltedHash(testSalt, "P1234567")}))
+	stub.mustInvoke("updateInfoElement", "c1", jsonArg(InfoElement{Id: "e2", ElementType: "PASSPORT", ElementValue: "P7654321"}))
+	stub.mustInvoke("grantConsent", "c1", jsonArg(Consent{Id: "k1", InstitutionId: "bank1", ElementIds: []string{"e1"}, Purpose: "onboarding", ExpiresOn: "2026-06-01"}))
+
+	result := ValueVerification{}
+	stub.as(RoleInstitution, "bank1").mustQuery(&result, "verifyInfoElementValue", "c1", "e1", saltedHash(testSalt, "P1234567"), "onboarding")
+	if !result.Matches {
+		t.Error("the hash of the stored value does not match")
+	}
+	stub.mustQuery(&result, "verifyInfoElementValue", "c1", "e1", saltedHash(testSalt, "P1234568"), "onboarding")
+	if result.Matches {
+		t.Error("the hash of another value matches")
+	}
+
+	_, err := stub.query("verifyInfoElementValue", "c1", "e1", "P1234567", "onboarding")
+	expectCode(t, err, ccerror.InvalidArgument)
+	_, err = stub.as(RoleInstitution, "bank2").query("verifyInfoElementValue", "c1", "e1", saltedHash(testSalt, "P1234567"), "onboarding")
+	expectCode(t, err, ccerror.Forbidden)
+	_, err = stub.as(RoleCustomer, "c1").query("verifyInfoElementValue", "c1", "e2", saltedHash(testSalt, "P7654321"))
+	expectCode(t, err, ccerror.Conflict)
+}
+
+func TestPrivateElementTypesRefuseClearValues(t *testing.T) {
+	stub := newTestStub(t)
+	stub.mustInvoke("registerElementType", jsonArg(ElementTypeSpec{Name: "PASSPORT", Private: true}))
+	stub.mustInvoke("createPerson", "c1")
+
+	_, err := stub.invoke("updateInfoElement", "c1", jsonArg(InfoElement{Id: "e1", ElementType: "PASSPORT", ElementValue: "P1234567"}))
+	expectCode(t, err, ccerror.InvalidArgument)
+	_, err = stub.invoke("updateInfoElements", "c1", jsonArg(map[string]interface{}{
+		"elements": []InfoElement{{Id: "e1", ElementType: "PASSPORT", ElementValue: "P1234567"}},
+	}))
+	if results := batchErrors(t, err); results[0].Error == nil {
+		t.Errorf("results = %+v", results)
+	}
+
+	stub.mustInvoke("updateInfoElement", "c1", jsonArg(InfoElement{Id: "e1", ElementType: "PASSPORT", ValueHash: saltedHash(testSalt, "P1234567")}))
+	stub.mustInvoke("updateInfoElement", "c1", jsonArg(InfoElement{Id: "e2", ElementType: "PASSPORT", Hash: "ab"}))
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+// Lifecycle states of a SubmittedRequest
+const (
+	RequestStatusSubmitted     = "SUBMITTED"
+	RequestStatusUnderReview   = "UNDER_REVIEW"
+	RequestStatusApproved      = "APPROVED"
+	RequestStatusRejected      = "REJECTED"
+	RequestStatusInfoRequested = "INFO_REQUESTED"
+	RequestStatusResubmitted   = "RESUBMITTED"
+	RequestStatusWithdrawn     = "WITHDRAWN"
+	RequestStatusExpired       = "EXPIRED"
+)
+
+// requestTransitions lists the states each state may move to. States without
+// an entry are final.
+var requestTransitions = map[string][]string{
+	RequestStatusSubmitted:     {RequestStatusUnderReview, RequestStatusWithdrawn, RequestStatusExpired},
+	RequestStatusUnderReview:   {RequestStatusApproved, RequestStatusRejected, RequestStatusInfoRequested, RequestStatusWithdrawn, RequestStatusExpired},
+	RequestStatusInfoRequested: {RequestStatusResubmitted, RequestStatusWithdrawn, RequestStatusExpired},
+	RequestStatusResubmitted:   {RequestStatusUnderReview, RequestStatusWithdrawn, RequestStatusExpired},
+	RequestStatusApproved:      {RequestStatusExpired},
+}
+
+// StatusChange records one move of a request through its lifecycle
+type StatusChange struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Actor     string `json:"actor"`
+	Reason    string `json:"reason"`
+	Timestamp string `json:"timestamp"`
+	TxId      string `json:"txId"`
+}
+
+// Returns the status of a request, treating requests stored before the
+// lifecycle existed as SUBMITTED
+func (request *SubmittedRequest) currentStatus() string {
+	if request.Status == "" {
+		return RequestStatusSubmitted
+	}
+	return request.Status
+}
+
+// Checks whether a request may move from one state to another
+func canTransition(from string, to string) bool {
+	for _, allowed := range requestTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Moves a request to a new state and records who did it, why and when
+func (kyc *KYCChaincode) transitionRequest(stub shim.ChaincodeStubInterface, request *SubmittedRequest, to string, reason string) error {
+	from := request.currentStatus()
+	if !canTransition(from, to) {
+		return ccerror.New(ccerror.Conflict, "status", "Illegal status transition for request %s: %s -> %s", request.Id, from, to)
+	}
+
+	change, err := newStatusChange(stub, from, to, reason)
+	if err != nil {
+		return err
+	}
+
+	request.Status = to
+	request.StatusHistory = append(request.StatusHistory, change)
+	return nil
+}
+
+func newStatusChange(stub shim.ChaincodeStubInterface, from string, to string, reason string) (StatusChange, error) {
+	actor, err := getActor(stub)
+	if err != nil {
+		return StatusChange{}, err
+	}
+
+	timestamp, err := getTxTime(stub)
+	if err != nil {
+		return StatusChange{}, err
+	}
+
+	return StatusChange{
+		From:      from,
+		To:        to,
+		Actor:     actor,
+		Reason:    reason,
+		Timestamp: timestamp.Format(time.RFC3339),
+		TxId:      stub.GetTxID(),
+	}, nil
+}
+
+// Loads a request, applies a transition and writes it back. When refreshPerson
+// is set the Person snapshot is taken again from the current state as a new version.
+func (kyc *KYCChaincode) changeRequestStatus(stub shim.ChaincodeStubInterface, args []string, to string, refreshPerson bool) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, ccerror.IncorrectArgs("2")
+	}
+
+	request, err := kyc.getRequest(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if request == nil {
+		return nil, ccerror.New(ccerror.NotFound, "requestId", "Request not found")
+	}
+
+	if to == RequestStatusApproved {
+		open := openAlerts(*request)
+		if len(open) > 0 {
+			return nil, ccerror.New(ccerror.Conflict, "requestId", "Request %s has %d open screening alerts", request.Id, len(open)).WithDetails(open)
+		}
+	}
+
+	err = kyc.transitionRequest(stub, request, to, args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	if refreshPerson {
+		person, err := kyc.mustGetPerson(stub, request.Person.Id)
+		if err != nil {
+			return nil, err
+		}
+		err = kyc.snapshotRequest(stub, request, person)
+		if err != nil {
+			return nil, err
+		}
+		err = kyc.screenRequest(stub, request)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = kyc.putRequest(stub, *request)
+	if err != nil {
+		return nil, err
+	}
+
+	err = emitEvent(stub, KYCEvent{
+		Type:         EventRequestStatusChanged,
+		PersonId:     request.Person.Id,
+		RequestId:    request.Id,
+		Status:       request.Status,
+		SnapshotHash: snapshotHash(request.Person),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (kyc *KYCChaincode) startReview(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: startReview called")
+	return kyc.changeRequestStatus(stub, args, RequestStatusUnderReview, false)
+}
+
+func (kyc *KYCChaincode) approveRequest(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: approveRequest called")
+	return kyc.changeRequestStatus(stub, args, RequestStatusApproved, false)
+}
+
+func (kyc *KYCChaincode) rejectRequest(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: rejectRequest called")
+	return kyc.changeRequestStatus(stub, args, RequestStatusRejected, false)
+}
+
+func (kyc *KYCChaincode) requestInfo(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: requestInfo called")
+	return kyc.changeRequestStatus(stub, args, RequestStatusInfoRequested, false)
+}
+
+func (kyc *KYCChaincode) resubmitRequest(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: resubmitRequest called")
+	return kyc.changeRequestStatus(stub, args, RequestStatusResubmitted, true)
+}
+
+func (kyc *KYCChaincode) withdrawRequest(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: withdrawRequest called")
+	return kyc.changeRequestStatus(stub, args, RequestStatusWithdrawn, false)
+}
+
+func (kyc *KYCChaincode) expireRequest(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: expireRequest called")
+	return kyc.changeRequestStatus(stub, args, RequestStatusExpired, false)
+}
+
+// Identifies the invoker recorded against a change
+func getActor(stub shim.ChaincodeStubInterface) (string, error) {
+	invoker, err := getInvoker(stub)
+	if err != nil {
+		return "", err
+	}
+	return invoker.Id, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+var allRequestStatuses = []string{
+	RequestStatusSubmitted, RequestStatusUnderReview, RequestStatusApproved, RequestStatusRejected,
+	RequestStatusInfoRequested, RequestStatusResubmitted, RequestStatusWithdrawn, RequestStatusExpired,
+}
+
+func TestCanTransition(t *testing.T) {
+	allowed := map[string][]string{
+		RequestStatusSubmitted:     {RequestStatusUnderReview, RequestStatusWithdrawn, RequestStatusExpired},
+		RequestStatusUnderReview:   {RequestStatusApproved, RequestStatusRejected, RequestStatusInfoRequested, RequestStatusWithdrawn, RequestStatusExpired},
+		RequestStatusInfoRequested: {RequestStatusResubmitted, RequestStatusWithdrawn, RequestStatusExpired},
+		RequestStatusResubmitted:   {RequestStatusUnderReview, RequestStatusWithdrawn, RequestStatusExpired},
+		RequestStatusApproved:      {RequestStatusExpired},
+	}
+
+	for _, from := range allRequestStatuses {
+		for _, to := range allRequestStatuses {
+			expected := containsString(allowed[from], to)
+			if canTransition(from, to) != expected {
+				t.Errorf("canTransition(%s, %s) = %v, expected %v", from, to, !expected, expected)
+			}
+		}
+	}
+}
+
+// Submits request r1 of customer c1 to institution bank1
+func submitRequest(stub *testStub) {
+	stub.t.Helper()
+	stub.registerInstitution("bank1")
+	stub.as(RoleCustomer, "c1").mustInvoke("createPerson", "c1")
+	stub.mustInvoke("saveRequestState", "r1", "c1", "bank1")
+}
+
+func TestRequestLifecycle(t *testing.T) {
+	stub := newTestStub(t)
+	submitRequest(stub)
+
+	stub.as(RoleInstitution, "bank1").mustInvoke("startReview", "r1", "")
+	stub.mustInvoke("requestInfo", "r1", "proof of address missing")
+	stub.as(RoleCustomer, "c1").mustInvoke("saveRequestState", "r1", "c1")
+	stub.as(RoleInstitution, "bank1").mustInvoke("startReview", "r1", "")
+	stub.mustInvoke("approveRequest", "r1", "")
+
+	request := stub.request("r1")
+	if request.Status != RequestStatusApproved {
+		t.Fatalf("status = %s, expected %s", request.Status, RequestStatusApproved)
+	}
+	if request.Version != formatRequestVersion(2) {
+		t.Errorf("version = %s, expected the resubmission to be version 2", request.Version)
+	}
+
+	expected := []StatusChange{
+		{From: "", To: RequestStatusSubmitted, Actor: "c1"},
+		{From: RequestStatusSubmitted, To: RequestStatusUnderReview, Actor: "bank1"},
+		{From: RequestStatusUnderReview, To: RequestStatusInfoRequested, Actor: "bank1", Reason: "proof of address missing"},
+		{From: RequestStatusInfoRequested, To: RequestStatusResubmitted, Actor: "c1"},
+		{From: RequestStatusResubmitted, To: RequestStatusUnderReview, Actor: "bank1"},
+		{From: RequestStatusUnderReview, To: RequestStatusApproved, Actor: "bank1"},
+	}
+	if len(request.StatusHistory) != len(expected) {
+		t.Fatalf("status history has %d changes, expected %d", len(request.StatusHistory), len(expected))
+	}
+	for i, change := range request.StatusHistory {
+		if change.From != expected[i].From || change.To != expected[i].To || change.Actor != expected[i].Actor || change.Reason != expected[i].Reason {
+			t.Errorf("change %d = %+v, expected %+v", i, change, expected[i])
+		}
+		if change.TxId == "" || change.Timestamp == "" {
+			t.Errorf("change %d has no tx id or timestamp", i)
+		}
+	}
+}
+
+func TestIllegalTransitionsAreRejected(t *testing.T) {
+	stub := newTestStub(t)
+	submitRequest(stub)
+	stub.as(RoleInstitution, "bank1")
+
+	_, err := stub.invoke("approveRequest", "r1", "")
+	expectCode(t, err, ccerror.Conflict)
+	_, err = stub.invoke("requestInfo", "r1", "")
+	expectCode(t, err, ccerror.Conflict)
+
+	stub.mustInvoke("startReview", "r1", "")
+	stub.mustInvoke("rejectRequest", "r1", "incomplete")
+
+	for _, function := range []string{"startReview", "approveRequest", "requestInfo", "expireRequest", "withdrawRequest"} {
+		_, err = stub.invoke(function, "r1", "")
+		expectCode(t, err, ccerror.Conflict)
+	}
+	if status := stub.request("r1").Status; status != RequestStatusRejected {
+		t.Errorf("status = %s after rejected transitions, expected %s", status, RequestStatusRejected)
+	}
+
+	_, err = stub.as(RoleCustomer, "c1").invoke("saveRequestState", "r1", "c1")
+	expectCode(t, err, ccerror.AlreadyExists)
+}
+
+func TestTransitionOfUnknownRequest(t *testing.T) {
+	stub := newTestStub(t)
+
+	_, err := stub.invoke("startReview", "missing", "")
+	expectCode(t, err, ccerror.NotFound)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+// Object type of the composite key each submitted version of a request is
+// kept under, keyed by request id and zero padded version number
+const requestVersionObjectType = "SubmittedRequest~version"
+
+// RequestVersion is the Person snapshot of a request as submitted by one transaction
+type RequestVersion struct {
+	Version     string `json:"version"`
+	SubmittedOn string `json:"submittedOn"`
+	TxId        string `json:"txId"`
+	Person      Person `json:"person"`
+}
+
+// RequestVersions is the result of queryRequestVersions
+type RequestVersions struct {
+	RequestId string           `json:"requestId"`
+	Versions  []RequestVersion `json:"versions"`
+	From      string           `json:"from"`
+	To        string           `json:"to"`
+	Diff      []FieldChange    `json:"diff"`
+}
+
+// Parses a version such as "v3" into its number. An empty version is 0.
+func parseRequestVersion(version string) (int, error) {
+	if version == "" {
+		return 0, nil
+	}
+	number, err := strconv.Atoi(strings.TrimPrefix(version, "v"))
+	if err != nil || number < 1 || !strings.HasPrefix(version, "v") {
+		return 0, ccerror.New(ccerror.InvalidArgument, "version", "Invalid request version %s", version)
+	}
+	return number, nil
+}
+
+func formatRequestVersion(number int) string {
+	return "v" + strconv.Itoa(number)
+}
+
+func requestVersionKey(requestId string, number int) (string, error) {
+	return createCompositeKey(requestVersionObjectType, []string{requestId, fmt.Sprintf("%010d", number)})
+}
+
+// Takes a new snapshot of the person into the request, bumping its version and
+// stamping it with the transaction time and id, and records the new version
+func (kyc *KYCChaincode) snapshotRequest(stub shim.ChaincodeStubInterface, request *SubmittedRequest, person Person) error {
+	current, err := parseRequestVersion(request.Version)
+	if err != nil {
+		return err
+	}
+
+	// Requests stored before versions were recorded only exist as their
+	// current state, which is kept as a version before it is replaced
+	if current > 0 {
+		key, err := requestVersionKey(request.Id, current)
+		if err != nil {
+			return err
+		}
+		existingVersion, err := stub.GetState(key)
+		if err != nil {
+			return err
+		}
+		if existingVersion == nil {
+			err = kyc.putRequestVersion(stub, *request, current)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	now, err := getTxTime(stub)
+	if err != nil {
+		return err
+	}
+
+	// Risk assessments stay on the Person, where reads apply consent
+	person.RiskAssessment = nil
+	request.Person = person
+	request.Version = formatRequestVersion(current + 1)
+	request.SubmittedOn = now.Format(time.RFC3339)
+	request.TxId = stub.GetTxID()
+
+	return kyc.putRequestVersion(stub, *request, current+1)
+}
+
+func (kyc *KYCChaincode) putRequestVersion(stub shim.ChaincodeStubInterface, request SubmittedRequest, number int) error {
+	key, err := requestVersionKey(request.Id, number)
+	if err != nil {
+		return err
+	}
+
+	version := RequestVersion{
+		Version:     formatRequestVersion(number),
+		SubmittedOn: request.SubmittedOn,
+		TxId:        request.TxId,
+		Person:      request.Person,
+	}
+
+	jsonAsBytes, _ := json.Marshal(version)
+	return stub.PutState(key, jsonAsBytes)
+}
+
+// Returns every submitted version of a request and the diff of the Person
+// snapshot between two of them. Arguments are the request id and optionally
+// the two versions to compare, which default to the first and the latest.
+func (kyc *KYCChaincode) queryRequestVersions(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: queryRequestVersions called")
+
+	if len(args) != 1 && len(args) != 3 {
+		return nil, ccerror.IncorrectArgs("1 or 3")
+	}
+
+	request, err := kyc.getRequest(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if request == nil {
+		return nil, ccerror.New(ccerror.NotFound, "requestId", "Request not found")
+	}
+
+	startKey, endKey, err := compositeKeyRange(requestVersionObjectType, []string{args[0]})
+	if err != nil {
+		return nil, err
+	}
+
+	iterator, err := stub.RangeQueryState(startKey, endKey)
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	result := RequestVersions{RequestId: args[0], Versions: []RequestVersion{}, Diff: []FieldChange{}}
+	for iterator.HasNext() {
+		_, versionJSONAsBytes, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		version := RequestVersion{}
+		err = json.Unmarshal(versionJSONAsBytes, &version)
+		if err != nil {
+			return nil, ccerror.New(ccerror.Internal, "", "Failed to unmarshal request version: %s", err.Error())
+		}
+		result.Versions = append(result.Versions, version)
+	}
+
+	if len(result.Versions) == 0 {
+		result.Versions = append(result.Versions, RequestVersion{
+			Version:     request.Version,
+			SubmittedOn: request.SubmittedOn,
+			TxId:        request.TxId,
+			Person:      request.Person,
+		})
+	}
+
+	result.From = result.Versions[0].Version
+	result.To = result.Versions[len(result.Versions)-1].Version
+	if len(args) == 3 {
+		result.From = args[1]
+		result.To = args[2]
+	}
+
+	var from, to *RequestVersion
+	for i := range result.Versions {
+		if result.Versions[i].Version == result.From {
+			from = &result.Versions[i]
+		}
+		if result.Versions[i].Version == result.To {
+			to = &result.Versions[i]
+		}
+	}
+	if from == nil || to == nil {
+		return nil, ccerror.New(ccerror.NotFound, "version", "Request version not found")
+	}
+	result.Diff = diffPersons(from.Person, to.Person)
+
+	jsonAsBytes, _ := json.Marshal(result)
+	return jsonAsBytes, nil
+}
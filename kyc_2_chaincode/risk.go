@@ -0,0 +1,651 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+// Object type of the single key the risk config is stored under
+const riskConfigObjectType = "RiskConfig"
+
+// Object type of the assessments institutions compute over the elements they
+// have consent for, keyed by person and institution id. Only assessments over
+// every element are stored on the Person.
+const riskAssessmentObjectType = "RiskAssessment"
+
+// Risk bands
+const (
+	RiskBandLow    = "LOW"
+	RiskBandMedium = "MEDIUM"
+	RiskBandHigh   = "HIGH"
+)
+
+// Names of the factors in a risk breakdown
+const (
+	RiskFactorCountry         = "country"
+	RiskFactorOccupation      = "occupation"
+	RiskFactorMissing         = "missingElements"
+	RiskFactorExpired         = "expiredElements"
+	RiskFactorVerificationAge = "verificationAge"
+)
+
+// Every factor scores 0 to maxFactorPoints and contributes
+// weight * points / maxFactorPoints to the total. Only integer arithmetic is
+// used so every peer computes the same score.
+const maxFactorPoints = 100
+
+// RiskConfig holds the weights and tables of the risk score. Version is bumped
+// by every setRiskConfig so assessments can tell which config they used.
+type RiskConfig struct {
+	Version              int              `json:"version"`
+	UpdatedOn            string           `json:"updatedOn"`
+	TxId                 string           `json:"txId"`
+	Country              RiskLookupFactor `json:"country"`
+	Occupation           RiskLookupFactor `json:"occupation"`
+	RequiredElementTypes []string         `json:"requiredElementTypes"`
+	MissingWeight        int              `json:"missingWeight"`
+	ExpiredWeight        int              `json:"expiredWeight"`
+	VerificationAge      RiskAgeFactor    `json:"verificationAge"`
+	MediumFrom           int              `json:"mediumFrom"`
+	HighFrom             int              `json:"highFrom"`
+}
+
+// RiskLookupFactor scores the value of the first element of ElementType, or of
+// one Field of it for structured values, by looking it up in Scores. Unknown,
+// unreadable and missing values score DefaultScore.
+type RiskLookupFactor struct {
+	ElementType  string         `json:"elementType"`
+	Field        string         `json:"field"`
+	Weight       int            `json:"weight"`
+	Scores       map[string]int `json:"scores"`
+	DefaultScore int            `json:"defaultScore"`
+}
+
+// RiskAgeFactor scores how long ago elements were verified, reaching full
+// points at MaxDays. Unverified elements count as MaxDays old.
+type RiskAgeFactor struct {
+	Weight  int `json:"weight"`
+	MaxDays int `json:"maxDays"`
+}
+
+// RiskAssessment is the score of a person, stored on the Person when computed
+// by an admin and per institution otherwise. ElementIds are the elements the
+// assessor was allowed to read and scored.
+type RiskAssessment struct {
+	Score         int               `json:"score"`
+	Band          string            `json:"band"`
+	Factors       []RiskFactorScore `json:"factors"`
+	ElementIds    []string          `json:"elementIds"`
+	ConfigVersion int               `json:"configVersion"`
+	ElementsHash  string            `json:"elementsHash"`
+	AssessedOn    string            `json:"assessedOn"`
+	AssessedBy    string            `json:"assessedBy"`
+	TxId          string            `json:"txId"`
+}
+
+// RiskFactorScore is one line of the breakdown. Explanations never quote
+// element values, which may be encrypted on the ledger.
+type RiskFactorScore struct {
+	Factor       string `json:"factor"`
+	Weight       int    `json:"weight"`
+	Points       int    `json:"points"`
+	Contribution int    `json:"contribution"`
+	Explanation  string `json:"explanation"`
+}
+
+// RiskExplanation is the result of queryRiskAssessment. The assessment is
+// stale when the person's elements or the risk config changed since.
+type RiskExplanation struct {
+	PersonId     string          `json:"personId"`
+	Assessment   *RiskAssessment `json:"assessment"`
+	Stale        bool            `json:"stale"`
+	StaleReasons []string        `json:"staleReasons"`
+}
+
+func validateRiskConfig(config RiskConfig) error {
+	for _, name := range []string{RiskFactorCountry, RiskFactorOccupation} {
+		factor := config.Country
+		if name == RiskFactorOccupation {
+			factor = config.Occupation
+		}
+		if factor.Weight > 0 && factor.ElementType == "" {
+			return ccerror.New(ccerror.InvalidArgument, name, "%s needs an elementType when weighted", name)
+		}
+		if !isFactorPoints(factor.DefaultScore) {
+			return ccerror.New(ccerror.InvalidArgument, name, "%s defaultScore must be between 0 and %d", name, maxFactorPoints)
+		}
+		for _, points := range factor.Scores {
+			if !isFactorPoints(points) {
+				return ccerror.New(ccerror.InvalidArgument, name, "%s scores must be between 0 and %d", name, maxFactorPoints)
+			}
+		}
+	}
+	if config.Country.Weight < 0 || config.Occupation.Weight < 0 || config.MissingWeight < 0 || config.ExpiredWeight < 0 || config.VerificationAge.Weight < 0 {
+		return ccerror.New(ccerror.InvalidArgument, "weight", "Weights must not be negative")
+	}
+	if config.VerificationAge.Weight > 0 && config.VerificationAge.MaxDays <= 0 {
+		return ccerror.New(ccerror.InvalidArgument, "verificationAge", "verificationAge needs a positive maxDays when weighted")
+	}
+	if config.MediumFrom <= 0 || config.HighFrom < config.MediumFrom {
+		return ccerror.New(ccerror.InvalidArgument, "bands", "Expecting 0 < mediumFrom <= highFrom")
+	}
+	return nil
+}
+
+// Table keys are matched the same way values are looked up: trimmed and upper
+// case. Keys are visited in order so every peer reports the same duplicate.
+func normalizeRiskScores(name string, scores map[string]int) (map[string]int, error) {
+	values := []string{}
+	for value := range scores {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+
+	normalized := map[string]int{}
+	for _, value := range values {
+		if _, ok := normalized[normalizeRiskValue(value)]; ok {
+			return nil, ccerror.New(ccerror.InvalidArgument, name, "%s table has more than one entry for %s", name, normalizeRiskValue(value))
+		}
+		normalized[normalizeRiskValue(value)] = scores[value]
+	}
+	return normalized, nil
+}
+
+func normalizeRiskValue(value string) string {
+	return strings.ToUpper(strings.TrimSpace(value))
+}
+
+func isFactorPoints(points int) bool {
+	return points >= 0 && points <= maxFactorPoints
+}
+
+// Replaces the risk config
+func (kyc *KYCChaincode) setRiskConfig(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: setRiskConfig called")
+
+	if len(args) != 1 {
+		return nil, ccerror.IncorrectArgs("1")
+	}
+
+	config := RiskConfig{}
+	err := json.Unmarshal([]byte(args[0]), &config)
+	if err != nil {
+		return nil, ccerror.New(ccerror.InvalidArgument, "riskConfig", "Failed to unmarshal risk config: %s", err.Error())
+	}
+	err = validateRiskConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	config.Country.Scores, err = normalizeRiskScores(RiskFactorCountry, config.Country.Scores)
+	if err != nil {
+		return nil, err
+	}
+	config.Occupation.Scores, err = normalizeRiskScores(RiskFactorOccupation, config.Occupation.Scores)
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := getRiskConfig(stub)
+	if err != nil {
+		return nil, err
+	}
+	now, err := getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	config.Version = 1
+	if current != nil {
+		config.Version = current.Version + 1
+	}
+	config.UpdatedOn = now.Format(time.RFC3339)
+	config.TxId = stub.GetTxID()
+
+	key, err := createCompositeKey(riskConfigObjectType, []string{})
+	if err != nil {
+		return nil, err
+	}
+	jsonAsBytes, _ := json.Marshal(config)
+	err = stub.PutState(key, jsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return jsonAsBytes, nil
+}
+
+func (kyc *KYCChaincode) queryRiskConfig(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: queryRiskConfig called")
+
+	if len(args) != 0 {
+		return nil, ccerror.IncorrectArgs("0")
+	}
+
+	config, err := mustGetRiskConfig(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	jsonAsBytes, _ := json.Marshal(config)
+	return jsonAsBytes, nil
+}
+
+// Reads the risk config, returning nil if none was set
+func getRiskConfig(stub shim.ChaincodeStubInterface) (*RiskConfig, error) {
+	key, err := createCompositeKey(riskConfigObjectType, []string{})
+	if err != nil {
+		return nil, err
+	}
+
+	configJSONAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, ccerror.New(ccerror.Internal, "", "Failed to get risk config")
+	}
+	if configJSONAsBytes == nil {
+		return nil, nil
+	}
+
+	config := RiskConfig{}
+	err = json.Unmarshal(configJSONAsBytes, &config)
+	if err != nil {
+		return nil, ccerror.New(ccerror.Internal, "", "Failed to unmarshal risk config: %s", err.Error())
+	}
+	return &config, nil
+}
+
+func mustGetRiskConfig(stub shim.ChaincodeStubInterface) (RiskConfig, error) {
+	config, err := getRiskConfig(stub)
+	if err != nil {
+		return RiskConfig{}, err
+	}
+	if config == nil {
+		return RiskConfig{}, ccerror.New(ccerror.NotFound, "riskConfig", "No risk config has been set")
+	}
+	return *config, nil
+}
+
+// Scores a person against the current risk config. Arguments are the person
+// id and, for institutions, the purpose of their consent. Only consented
+// elements are scored; encrypted values cannot be read and score like missing
+// ones. Admins see every element and store the assessment on the Person;
+// institutions store theirs under their own key, so an assessment over a
+// subset never replaces one over everything.
+func (kyc *KYCChaincode) computeRiskScore(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: computeRiskScore called")
+
+	var purpose string
+	if len(args) != 1 && len(args) != 2 {
+		return nil, ccerror.IncorrectArgs("1 or 2")
+	}
+	if len(args) == 2 {
+		purpose = args[1]
+	}
+
+	person, err := kyc.mustGetPerson(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	consentedPerson := person
+	err = kyc.filterConsented(stub, &consentedPerson, purpose)
+	if err != nil {
+		return nil, err
+	}
+	config, err := mustGetRiskConfig(stub)
+	if err != nil {
+		return nil, err
+	}
+	now, err := getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	actor, err := getActor(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	factors := []RiskFactorScore{}
+	for _, factor := range []struct {
+		name   string
+		lookup RiskLookupFactor
+	}{{RiskFactorCountry, config.Country}, {RiskFactorOccupation, config.Occupation}} {
+		score, err := scoreLookupFactor(factor.name, factor.lookup, consentedPerson)
+		if err != nil {
+			return nil, err
+		}
+		factors = append(factors, score)
+	}
+	factors = append(factors,
+		scoreMissingElements(config, consentedPerson),
+		scoreExpiredElements(config, consentedPerson, now),
+		scoreVerificationAge(config, consentedPerson, now))
+
+	assessment := RiskAssessment{
+		Factors:       factors,
+		ConfigVersion: config.Version,
+		ElementsHash:  elementsHash(consentedPerson),
+		AssessedOn:    now.Format(time.RFC3339),
+		AssessedBy:    actor,
+		TxId:          stub.GetTxID(),
+	}
+	assessment.ElementIds = elementIds(consentedPerson)
+	for i := range assessment.Factors {
+		factor := &assessment.Factors[i]
+		factor.Contribution = factor.Weight * factor.Points / maxFactorPoints
+		assessment.Score += factor.Contribution
+	}
+	assessment.Band = riskBand(config, assessment.Score)
+
+	invoker, err := getInvoker(stub)
+	if err != nil {
+		return nil, err
+	}
+	if invoker.Role == RoleInstitution {
+		err = putInstitutionAssessment(stub, person.Id, invoker.Id, assessment)
+	} else {
+		person.RiskAssessment = &assessment
+		err = kyc.putPerson(stub, person)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = emitEvent(stub, KYCEvent{Type: EventRiskAssessed, PersonId: person.Id, Status: assessment.Band})
+	if err != nil {
+		return nil, err
+	}
+
+	jsonAsBytes, _ := json.Marshal(assessment)
+	return jsonAsBytes, nil
+}
+
+func riskBand(config RiskConfig, score int) string {
+	if score >= config.HighFrom {
+		return RiskBandHigh
+	}
+	if score >= config.MediumFrom {
+		return RiskBandMedium
+	}
+	return RiskBandLow
+}
+
+func scoreLookupFactor(name string, factor RiskLookupFactor, person Person) (RiskFactorScore, error) {
+	score := RiskFactorScore{Factor: name, Weight: factor.Weight, Points: factor.DefaultScore}
+	if factor.Weight == 0 {
+		score.Explanation = "not weighted"
+		return score, nil
+	}
+
+	var infoElement *InfoElement
+	for i := range person.InfoElements {
+		if person.InfoElements[i].ElementType == factor.ElementType {
+			infoElement = &person.InfoElements[i]
+			break
+		}
+	}
+	if infoElement == nil {
+		score.Explanation = fmt.Sprintf("no %s element, default score", factor.ElementType)
+		return score, nil
+	}
+	if infoElement.ElementValue == "" {
+		score.Explanation = fmt.Sprintf("%s value is not held on the ledger, default score", infoElement.Id)
+		return score, nil
+	}
+
+	if isSealed(infoElement.ElementValue) {
+		score.Explanation = fmt.Sprintf("%s is encrypted, default score", infoElement.Id)
+		return score, nil
+	}
+
+	value := infoElement.ElementValue
+
+	if factor.Field != "" {
+		fields := map[string]interface{}{}
+		if json.Unmarshal([]byte(value), &fields) != nil || fields[factor.Field] == nil {
+			score.Explanation = fmt.Sprintf("%s has no %s field, default score", infoElement.Id, factor.Field)
+			return score, nil
+		}
+		value = fmt.Sprint(fields[factor.Field])
+	}
+
+	points, ok := factor.Scores[normalizeRiskValue(value)]
+	if !ok {
+		score.Explanation = fmt.Sprintf("value of %s is not in the %s table, default score", infoElement.Id, name)
+		return score, nil
+	}
+	score.Points = points
+	score.Explanation = fmt.Sprintf("value of %s scored from the %s table", infoElement.Id, name)
+	return score, nil
+}
+
+func scoreMissingElements(config RiskConfig, person Person) RiskFactorScore {
+	score := RiskFactorScore{Factor: RiskFactorMissing, Weight: config.MissingWeight}
+	if len(config.RequiredElementTypes) == 0 {
+		score.Explanation = "no required element types"
+		return score
+	}
+
+	missing := []string{}
+	for _, elementType := range config.RequiredElementTypes {
+		found := false
+		for _, infoElement := range person.InfoElements {
+			if infoElement.ElementType == elementType {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, elementType)
+		}
+	}
+
+	score.Points = maxFactorPoints * len(missing) / len(config.RequiredElementTypes)
+	score.Explanation = fmt.Sprintf("%d of %d required element types missing", len(missing), len(config.RequiredElementTypes))
+	if len(missing) > 0 {
+		score.Explanation += ": " + strings.Join(missing, ", ")
+	}
+	return score
+}
+
+func scoreExpiredElements(config RiskConfig, person Person, now time.Time) RiskFactorScore {
+	score := RiskFactorScore{Factor: RiskFactorExpired, Weight: config.ExpiredWeight}
+	if len(person.InfoElements) == 0 {
+		score.Explanation = "no elements"
+		return score
+	}
+
+	expired := []string{}
+	for _, infoElement := range person.InfoElements {
+		if isLapsed(infoElement, now) || infoElement.Status == ElementStatusExpired {
+			expired = append(expired, infoElement.Id)
+		}
+	}
+
+	score.Points = maxFactorPoints * len(expired) / len(person.InfoElements)
+	score.Explanation = fmt.Sprintf("%d of %d elements expired", len(expired), len(person.InfoElements))
+	if len(expired) > 0 {
+		score.Explanation += ": " + strings.Join(expired, ", ")
+	}
+	return score
+}
+
+// Averages the verification age of the required elements, or of every
+// element when no types are required
+func scoreVerificationAge(config RiskConfig, person Person, now time.Time) RiskFactorScore {
+	score := RiskFactorScore{Factor: RiskFactorVerificationAge, Weight: config.VerificationAge.Weight}
+	if config.VerificationAge.Weight == 0 {
+		score.Explanation = "not weighted"
+		return score
+	}
+
+	maxDays := config.VerificationAge.MaxDays
+	totalDays := 0
+	counted := 0
+	unverified := 0
+	for _, infoElement := range person.InfoElements {
+		if len(config.RequiredElementTypes) > 0 && !containsString(config.RequiredElementTypes, infoElement.ElementType) {
+			continue
+		}
+		counted++
+
+		verifiedOn, err := parseDate(infoElement.VerifiedOn)
+		if infoElement.Status != ElementStatusVerified || infoElement.VerifiedOn == "" || err != nil {
+			unverified++
+			totalDays += maxDays
+			continue
+		}
+		days := int(now.Sub(verifiedOn).Hours() / 24)
+		if days > maxDays {
+			days = maxDays
+		}
+		if days < 0 {
+			days = 0
+		}
+		totalDays += days
+	}
+
+	if counted == 0 {
+		score.Explanation = "no elements to age"
+		return score
+	}
+	score.Points = maxFactorPoints * totalDays / (maxDays * counted)
+	score.Explanation = fmt.Sprintf("average verification age of %d elements is %d days, %d unverified", counted, totalDays/counted, unverified)
+	return score
+}
+
+func elementIds(person Person) []string {
+	elementIds := []string{}
+	for _, infoElement := range person.InfoElements {
+		elementIds = append(elementIds, infoElement.Id)
+	}
+	return elementIds
+}
+
+func elementsHash(person Person) string {
+	return snapshotHash(Person{Id: person.Id, InfoElements: person.InfoElements})
+}
+
+func institutionAssessmentKey(personId string, institutionId string) (string, error) {
+	return createCompositeKey(riskAssessmentObjectType, []string{personId, institutionId})
+}
+
+func putInstitutionAssessment(stub shim.ChaincodeStubInterface, personId string, institutionId string, assessment RiskAssessment) error {
+	key, err := institutionAssessmentKey(personId, institutionId)
+	if err != nil {
+		return err
+	}
+	jsonAsBytes, _ := json.Marshal(assessment)
+	return stub.PutState(key, jsonAsBytes)
+}
+
+// Reads the assessment an institution computed for a person, returning nil if
+// there is none
+func getInstitutionAssessment(stub shim.ChaincodeStubInterface, personId string, institutionId string) (*RiskAssessment, error) {
+	key, err := institutionAssessmentKey(personId, institutionId)
+	if err != nil {
+		return nil, err
+	}
+
+	assessmentJSONAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, ccerror.New(ccerror.Internal, "", "Failed to get risk assessment of %s by %s", personId, institutionId)
+	}
+	if assessmentJSONAsBytes == nil {
+		return nil, nil
+	}
+
+	assessment := RiskAssessment{}
+	err = json.Unmarshal(assessmentJSONAsBytes, &assessment)
+	if err != nil {
+		return nil, ccerror.New(ccerror.Internal, "", "Failed to unmarshal risk assessment of %s: %s", personId, err.Error())
+	}
+	return &assessment, nil
+}
+
+// Checks whether a consent filtered person still holds every element an
+// assessment was computed from. Assessments stored before ElementIds was
+// recorded may use any element of the full person.
+func assessmentCovered(assessment RiskAssessment, person Person, consentedPerson Person) (string, bool) {
+	basedOn := assessment.ElementIds
+	if basedOn == nil {
+		basedOn = elementIds(person)
+	}
+	for _, elementId := range basedOn {
+		if findInfoElement(consentedPerson, elementId) == nil {
+			return elementId, false
+		}
+	}
+	return "", true
+}
+
+// Returns the stored assessment of a person with its factor breakdown, and
+// whether it is stale. Arguments are the person id and, for institutions, the
+// purpose of their consent, which must cover every element the assessment
+// was computed from. Institutions get their own assessment when they stored
+// one, and the one on the Person otherwise.
+func (kyc *KYCChaincode) queryRiskAssessment(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: queryRiskAssessment called")
+
+	var purpose string
+	if len(args) != 1 && len(args) != 2 {
+		return nil, ccerror.IncorrectArgs("1 or 2")
+	}
+	if len(args) == 2 {
+		purpose = args[1]
+	}
+
+	person, err := kyc.mustGetPerson(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	consentedPerson := person
+	err = kyc.filterConsented(stub, &consentedPerson, purpose)
+	if err != nil {
+		return nil, err
+	}
+
+	invoker, err := getInvoker(stub)
+	if err != nil {
+		return nil, err
+	}
+	// The hash of an institution's assessment covers the elements it could read
+	assessment, assessedPerson := person.RiskAssessment, person
+	if invoker.Role == RoleInstitution {
+		ownAssessment, err := getInstitutionAssessment(stub, person.Id, invoker.Id)
+		if err != nil {
+			return nil, err
+		}
+		if ownAssessment != nil {
+			assessment, assessedPerson = ownAssessment, consentedPerson
+		}
+	}
+	if assessment == nil {
+		return nil, ccerror.New(ccerror.NotFound, "personId", "Person with id %s has not been assessed", args[0])
+	}
+
+	elementId, covered := assessmentCovered(*assessment, person, consentedPerson)
+	if !covered {
+		return nil, ccerror.New(ccerror.Forbidden, "personId", "No consent to read InfoElement with id %s the assessment is based on", elementId)
+	}
+
+	explanation := RiskExplanation{PersonId: person.Id, Assessment: assessment, StaleReasons: []string{}}
+	if assessment.ElementsHash != elementsHash(assessedPerson) {
+		explanation.StaleReasons = append(explanation.StaleReasons, "elements changed since the assessment")
+	}
+	config, err := getRiskConfig(stub)
+	if err != nil {
+		return nil, err
+	}
+	if config != nil && config.Version != assessment.ConfigVersion {
+		explanation.StaleReasons = append(explanation.StaleReasons, fmt.Sprintf("risk config is now version %d", config.Version))
+	}
+	explanation.Stale = len(explanation.StaleReasons) > 0
+
+	jsonAsBytes, _ := json.Marshal(explanation)
+	return jsonAsBytes, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+// Creates c1 with a COUNTRY element e1 of the given value and an unverified
+// PASSPORT e2, and a config scoring the country and the unverified elements
+func createScoredPerson(stub *testStub, country string) {
+	stub.t.Helper()
+	stub.registerElementType("COUNTRY")
+	stub.registerElementType("PASSPORT")
+	stub.mustInvoke("setRiskConfig", jsonArg(RiskConfig{
+		Country:              RiskLookupFactor{ElementType: "COUNTRY", Weight: 40, Scores: map[string]int{"ir": 100, "DE": 10}, DefaultScore: 50},
+		RequiredElementTypes: []string{"PASSPORT", "COUNTRY"},
+		MissingWeight:        30,
+		ExpiredWeight:        10,
+		VerificationAge:      RiskAgeFactor{Weight: 20, MaxDays: 365},
+		MediumFrom:           30,
+		HighFrom:             60,
+	}))
+	stub.mustInvoke("createPerson", "c1")
+	stub.mustInvoke("updateInfoElement", "c1", jsonArg(InfoElement{Id: "e1", ElementType: "COUNTRY", ElementValue: country}))
+	stub.mustInvoke("updateInfoElement", "c1", jsonArg(InfoElement{Id: "e2", ElementType: "PASSPORT", ElementValue: "X2"}))
+}
+
+func TestRiskBands(t *testing.T) {
+	for _, test := range []struct {
+		country string
+		score   int
+		band    string
+	}{
+		{"DE", 24, RiskBandLow},
+		{"FR", 40, RiskBandMedium},
+		{" ir ", 60, RiskBandHigh},
+	} {
+		stub := newTestStub(t)
+		createScoredPerson(stub, test.country)
+
+		assessment := RiskAssessment{}
+		json.Unmarshal(stub.mustInvoke("computeRiskScore", "c1"), &assessment)
+		if assessment.Score != test.score || assessment.Band != test.band {
+			t.Errorf("country %q scored %d %s, expected %d %s: %+v", test.country, assessment.Score, assessment.Band, test.score, test.band, assessment.Factors)
+		}
+		if stored := storedPerson(stub, "c1").RiskAssessment; stored == nil || stored.TxId != assessment.TxId {
+			t.Errorf("stored assessment = %+v", stored)
+		}
+	}
+}
+
+func TestRiskAssessmentGoesStale(t *testing.T) {
+	stub := newTestStub(t)
+	createScoredPerson(stub, "DE")
+	stub.mustInvoke("computeRiskScore", "c1")
+
+	explanation := RiskExplanation{}
+	stub.mustQuery(&explanation, "queryRiskAssessment", "c1")
+	if explanation.Stale {
+		t.Errorf("fresh assessment is stale: %v", explanation.StaleReasons)
+	}
+
+	stub.mustInvoke("updateInfoElement", "c1", jsonArg(InfoElement{Id: "e1", ElementType: "COUNTRY", ElementValue: "IR"}))
+	stub.mustQuery(&explanation, "queryRiskAssessment", "c1")
+	if !explanation.Stale || len(explanation.StaleReasons) != 1 {
+		t.Errorf("assessment after an element change = %+v", explanation)
+	}
+}
+
+func TestRiskScoreAppliesConsent(t *testing.T) {
+	stub := newTestStub(t)
+	createScoredPerson(stub, "IR")
+	stub.mustInvoke("grantConsent", "c1", jsonArg(Consent{Id: "k1", InstitutionId: "bank1", ElementTypes: []string{"PASSPORT"}, Purpose: "onboarding", ExpiresOn: "2026-06-01"}))
+
+	stub.as(RoleInstitution, "bank1")
+	_, err := stub.invoke("computeRiskScore", "c1")
+	expectCode(t, err, ccerror.InvalidArgument)
+
+	assessment := RiskAssessment{}
+	json.Unmarshal(stub.mustInvoke("computeRiskScore", "c1", "onboarding"), &assessment)
+	if assessment.Score != 55 || assessment.Band != RiskBandMedium || len(assessment.ElementIds) != 1 || assessment.ElementIds[0] != "e2" {
+		t.Errorf("assessment without consent to the country = %+v", assessment)
+	}
+	for _, factor := range assessment.Factors {
+		if strings.Contains(factor.Explanation, "e1") {
+			t.Errorf("factor %s explains the unconsented e1: %s", factor.Factor, factor.Explanation)
+		}
+	}
+	explanation := RiskExplanation{}
+	stub.mustQuery(&explanation, "queryRiskAssessment", "c1", "onboarding")
+
+	stub.as(RoleAdmin, "admin").mustInvoke("computeRiskScore", "c1")
+	stub.as(RoleInstitution, "bank1").mustQuery(&explanation, "queryRiskAssessment", "c1", "onboarding")
+	if explanation.Assessment.TxId != assessment.TxId || explanation.Stale {
+		t.Errorf("bank1 read %+v, expected its own assessment", explanation)
+	}
+	_, err = stub.as(RoleInstitution, "bank2").query("queryRiskAssessment", "c1", "onboarding")
+	expectCode(t, err, ccerror.Forbidden)
+	stub.as(RoleRegulator, "reg1").mustQuery(&explanation, "queryRiskAssessment", "c1")
+	if explanation.Assessment.Band != RiskBandHigh {
+		t.Errorf("regulator read %+v", explanation.Assessment)
+	}
+}
+
+func TestPartialAssessmentsDoNotReplaceTheFullOne(t *testing.T) {
+	stub := newTestStub(t)
+	createScoredPerson(stub, "IR")
+	stub.registerInstitution("bank1")
+	stub.mustInvoke("grantConsent", "c1", jsonArg(Consent{Id: "k1", InstitutionId: "bank1", ElementTypes: []string{"PASSPORT"}, Purpose: "onboarding", ExpiresOn: "2026-06-01"}))
+
+	full := RiskAssessment{}
+	json.Unmarshal(stub.mustInvoke("computeRiskScore", "c1"), &full)
+	stub.as(RoleInstitution, "bank1").mustInvoke("computeRiskScore", "c1", "onboarding")
+	if stored := storedPerson(stub, "c1").RiskAssessment; stored == nil || stored.TxId != full.TxId || stored.Band != RiskBandHigh {
+		t.Errorf("stored assessment = %+v, expected the full one", stored)
+	}
+
+	// Reads of the person and of request snapshots only show the full
+	// assessment to callers who can read every element it covers
+	person := Person{}
+	stub.as(RoleInstitution, "bank1").mustQuery(&person, "queryPerson", "c1", "onboarding")
+	if person.RiskAssessment != nil {
+		t.Errorf("bank1 read the full assessment %+v", person.RiskAssessment)
+	}
+	stub.mustInvoke("saveRequestState", "r1", "c1", "bank1")
+	if request := stub.request("r1"); request.Person.RiskAssessment != nil {
+		t.Errorf("request snapshot holds %+v", request.Person.RiskAssessment)
+	}
+
+	stub.as(RoleAdmin, "admin").mustInvoke("grantConsent", "c1", jsonArg(Consent{Id: "k2", InstitutionId: "bank1", ElementTypes: []string{"COUNTRY"}, Purpose: "onboarding", ExpiresOn: "2026-06-01"}))
+	stub.as(RoleInstitution, "bank1").mustQuery(&person, "queryPerson", "c1", "onboarding")
+	if person.RiskAssessment == nil || person.RiskAssessment.TxId != full.TxId {
+		t.Errorf("bank1 with consent to every element read %+v", person.RiskAssessment)
+	}
+}
+
+func TestDuplicateRiskScoresAreReportedInOrder(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		_, err := normalizeRiskScores(RiskFactorCountry, map[string]int{"fr": 1, "FR": 2, "de": 3, "DE": 4})
+		if err == nil || !strings.Contains(err.Error(), "entry for DE") {
+			t.Fatalf("duplicate error = %v, expected DE", err)
+		}
+	}
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+// Kinds of screening alerts
+const (
+	AlertWatchListHit = "WATCHLIST_HIT"
+	AlertNotScreened  = "NOT_SCREENED"
+)
+
+// Results of comparing a date of birth or nationality with a watch list
+// entry. Values that are missing or cannot be parsed compare as UNKNOWN.
+const (
+	ComparisonMatch    = "MATCH"
+	ComparisonMismatch = "MISMATCH"
+	ComparisonUnknown  = "UNKNOWN"
+)
+
+// Statuses of a screening alert. Open alerts block approval.
+const (
+	AlertStatusOpen    = "OPEN"
+	AlertStatusCleared = "CLEARED"
+)
+
+// ScreeningAlert is raised on a request whose person resembles a watch list
+// entry, or could not be screened. SubjectHash identifies what was screened
+// without storing it, so an alert cleared once is not raised again for the
+// same name and entry. DateOfBirthMatch and NationalityMatch are true on a
+// MATCH result; alerts raised before the results were recorded only carry
+// these flags.
+type ScreeningAlert struct {
+	Id                string  `json:"id"`
+	Kind              string  `json:"kind"`
+	EntryId           string  `json:"entryId,omitempty"`
+	List              string  `json:"list,omitempty"`
+	MatchedName       string  `json:"matchedName,omitempty"`
+	Score             float64 `json:"score,omitempty"`
+	DateOfBirthMatch  bool    `json:"dateOfBirthMatch"`
+	DateOfBirthResult string  `json:"dateOfBirthResult,omitempty"`
+	NationalityMatch  bool    `json:"nationalityMatch"`
+	NationalityResult string  `json:"nationalityResult,omitempty"`
+	Reason            string  `json:"reason,omitempty"`
+	SubjectHash       string  `json:"subjectHash"`
+	RequestVersion    string  `json:"requestVersion"`
+	Status            string  `json:"status"`
+	RaisedOn          string  `json:"raisedOn"`
+	ClearedBy         string  `json:"clearedBy,omitempty"`
+	ClearedOn         string  `json:"clearedOn,omitempty"`
+	ClearReason       string  `json:"clearReason,omitempty"`
+}
+
+// Letters that do not decompose into an ASCII base letter plus accents, or
+// that fold to more than one letter
+var foldedLetters = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'œ': "oe", 'ø': "o", 'đ': "d", 'ð': "d", 'þ': "th",
+	'ł': "l", 'ı': "i", 'ħ': "h", 'ŧ': "t", 'ŋ': "n",
+}
+
+// Accented Latin letters by base letter
+var accentedLetters = map[rune]string{
+	'a': "àáâãäåāăą", 'c': "çćĉċč", 'd': "ď", 'e': "èéêëēĕėęě", 'g': "ĝğġģ",
+	'h': "ĥ", 'i': "ìíîïĩīĭįİ", 'j': "ĵ", 'k': "ķ", 'l': "ĺļľŀ", 'n': "ñńņňŉ",
+	'o': "òóôõöōŏő", 'r': "ŕŗř", 's': "śŝşšș", 't': "ţťț", 'u': "ùúûüũūŭůűų",
+	'w': "ŵ", 'y': "ýÿŷ", 'z': "źżž",
+}
+
+var baseLetters = buildBaseLetters()
+
+func buildBaseLetters() map[rune]string {
+	letters := map[rune]string{}
+	for folded, base := range foldedLetters {
+		letters[folded] = base
+	}
+	for base, accented := range accentedLetters {
+		for _, letter := range accented {
+			letters[letter] = string(base)
+		}
+	}
+	return letters
+}
+
+// Folds case and diacritics, drops punctuation and sorts the name tokens, so
+// "Müller, Hans-Peter" and "hans peter muller" normalize alike
+func normalizeName(name string) string {
+	folded := ""
+	for _, letter := range strings.ToLower(name) {
+		if base, ok := baseLetters[letter]; ok {
+			folded += base
+		} else if unicode.IsLetter(letter) || unicode.IsDigit(letter) {
+			folded += string(letter)
+		} else {
+			folded += " "
+		}
+	}
+
+	tokens := strings.Fields(folded)
+	sort.Strings(tokens)
+	return strings.Join(tokens, " ")
+}
+
+// Jaro-Winkler similarity of two strings, between 0 and 1
+func jaroWinkler(first string, second string) float64 {
+	a := []rune(first)
+	b := []rune(second)
+	if len(a) == 0 && len(b) == 0 {
+		return 1
+	}
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+
+	window := len(a)
+	if len(b) > window {
+		window = len(b)
+	}
+	window = window/2 - 1
+	if window < 0 {
+		window = 0
+	}
+
+	aMatched := make([]bool, len(a))
+	bMatched := make([]bool, len(b))
+	matches := 0
+	for i := range a {
+		from := i - window
+		if from < 0 {
+			from = 0
+		}
+		to := i + window + 1
+		if to > len(b) {
+			to = len(b)
+		}
+		for j := from; j < to; j++ {
+			if !bMatched[j] && a[i] == b[j] {
+				aMatched[i] = true
+				bMatched[j] = true
+				matches++
+				break
+			}
+		}
+	}
+	if matches == 0 {
+		return 0
+	}
+
+	transpositions := 0
+	j := 0
+	for i := range a {
+		if !aMatched[i] {
+			continue
+		}
+		for !bMatched[j] {
+			j++
+		}
+		if a[i] != b[j] {
+			transpositions++
+		}
+		j++
+	}
+
+	m := float64(matches)
+	jaro := (m/float64(len(a)) + m/float64(len(b)) + (m-float64(transpositions)/2)/m) / 3
+
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && prefix < 4 && a[prefix] == b[prefix] {
+		prefix++
+	}
+	return jaro + float64(prefix)*0.1*(1-jaro)
+}
+
+// The attributes of a person that screening compares
+type screeningSubject struct {
+	name        string
+	dateOfBirth string
+	nationality string
+}
+
+// Screens the Person snapshot of a request against the watch list and adds
+// alerts for new hits. Values only held as hashes or encrypted by the client
+// cannot be screened and raise a NOT_SCREENED alert instead.
+func (kyc *KYCChaincode) screenRequest(stub shim.ChaincodeStubInterface, request *SubmittedRequest) error {
+	settings, err := getWatchListSettings(stub)
+	if err != nil || settings == nil {
+		return err
+	}
+
+	now, err := getTxTime(stub)
+	if err != nil {
+		return err
+	}
+
+	raise := func(alert ScreeningAlert) {
+		for _, existing := range request.Alerts {
+			if existing.Kind == alert.Kind && existing.EntryId == alert.EntryId && existing.SubjectHash == alert.SubjectHash {
+				return
+			}
+		}
+		alert.Id = fmt.Sprintf("alert-%d", len(request.Alerts)+1)
+		alert.RequestVersion = request.Version
+		alert.Status = AlertStatusOpen
+		alert.RaisedOn = now.Format(time.RFC3339)
+		request.Alerts = append(request.Alerts, alert)
+	}
+
+	subject := screeningSubject{}
+	subject.name, err = readScreeningValue(request.Person, settings.Name)
+	if err != nil {
+		return err
+	}
+	if subject.name == "" {
+		raise(ScreeningAlert{
+			Kind:        AlertNotScreened,
+			Reason:      "no readable name element of type " + settings.Name.ElementType,
+			SubjectHash: elementsHash(request.Person),
+		})
+		return nil
+	}
+	if settings.DateOfBirth.ElementType != "" {
+		subject.dateOfBirth, err = readScreeningValue(request.Person, settings.DateOfBirth)
+		if err != nil {
+			return err
+		}
+	}
+	if settings.Nationality.ElementType != "" {
+		subject.nationality, err = readScreeningValue(request.Person, settings.Nationality)
+		if err != nil {
+			return err
+		}
+	}
+
+	normalizedName := normalizeName(subject.name)
+	digest := sha256.Sum256([]byte(normalizedName))
+	subjectHash := hex.EncodeToString(digest[:])
+
+	return forEachWatchListEntry(stub, func(entry WatchListEntry) error {
+		alert, hit := matchWatchListEntry(entry, normalizedName, subject, settings.Threshold)
+		if hit {
+			alert.SubjectHash = subjectHash
+			raise(alert)
+		}
+		return nil
+	})
+}
+
+// Compares a subject with one entry. A name at or above the threshold is a
+// hit unless the entry's dates of birth or nationalities definitely
+// contradict the subject's. Values that cannot be compared never suppress a
+// hit.
+func matchWatchListEntry(entry WatchListEntry, normalizedName string, subject screeningSubject, threshold float64) (ScreeningAlert, bool) {
+	alert := ScreeningAlert{Kind: AlertWatchListHit, EntryId: entry.Id, List: entry.List}
+	for i, entryName := range entry.NormalizedNames {
+		score := jaroWinkler(normalizedName, entryName)
+		if score > alert.Score {
+			alert.Score = score
+			alert.MatchedName = entry.Names[i]
+		}
+	}
+	if alert.Score < threshold {
+		return alert, false
+	}
+
+	alert.DateOfBirthResult = compareEach(entry.DatesOfBirth, func(dateOfBirth string) string {
+		return compareDatesOfBirth(subject.dateOfBirth, dateOfBirth)
+	})
+	alert.NationalityResult = compareEach(entry.Nationalities, func(nationality string) string {
+		return compareNationalities(subject.nationality, nationality)
+	})
+	alert.DateOfBirthMatch = alert.DateOfBirthResult == ComparisonMatch
+	alert.NationalityMatch = alert.NationalityResult == ComparisonMatch
+
+	if alert.DateOfBirthResult == ComparisonMismatch || alert.NationalityResult == ComparisonMismatch {
+		return alert, false
+	}
+	return alert, true
+}
+
+// Combines the comparisons with every value of an entry: MATCH if any
+// matches, MISMATCH only if all of them contradict, UNKNOWN otherwise
+func compareEach(values []string, compare func(string) string) string {
+	if len(values) == 0 {
+		return ComparisonUnknown
+	}
+	result := ComparisonMismatch
+	for _, value := range values {
+		switch compare(value) {
+		case ComparisonMatch:
+			return ComparisonMatch
+		case ComparisonUnknown:
+			result = ComparisonUnknown
+		}
+	}
+	return result
+}
+
+// A date of birth as precisely as it was given. Month and day are 0 when
+// unknown.
+type birthDate struct {
+	year  int
+	month int
+	day   int
+}
+
+// Layouts of dates of birth that fix the order of day and month, and how
+// precise they are
+var birthDateLayouts = []struct {
+	layout   string
+	hasMonth bool
+	hasDay   bool
+}{
+	{time.RFC3339, true, true},
+	{"2006-1-2", true, true},
+	{"2006/1/2", true, true},
+	{"2006.1.2", true, true},
+	{"20060102", true, true},
+	{"2 January 2006", true, true},
+	{"2 Jan 2006", true, true},
+	{"January 2 2006", true, true},
+	{"Jan 2 2006", true, true},
+	{"2006-1", true, false},
+	{"2006/1", true, false},
+	{"January 2006", true, false},
+	{"Jan 2006", true, false},
+	{"2006", false, false},
+}
+
+// Day, month and year in either order, e.g. 09/07/1980 or 7.9.1980
+var numericBirthDatePattern = regexp.MustCompile(`^(\d{1,2})[./-](\d{1,2})[./-](\d{4})$`)
+
+// Parses a date of birth in any of the common formats. Returns every reading
+// of the value, two when day and month could be either way round, and none
+// when it is not a date.
+func parseBirthDate(value string) []birthDate {
+	value = strings.Join(strings.Fields(strings.Replace(value, ",", " ", -1)), " ")
+
+	if parts := numericBirthDatePattern.FindStringSubmatch(value); parts != nil {
+		first, _ := strconv.Atoi(parts[1])
+		second, _ := strconv.Atoi(parts[2])
+		year, _ := strconv.Atoi(parts[3])
+		readings := []birthDate{}
+		if isCalendarDate(year, second, first) {
+			readings = append(readings, birthDate{year, second, first})
+		}
+		if first != second && isCalendarDate(year, first, second) {
+			readings = append(readings, birthDate{year, first, second})
+		}
+		return readings
+	}
+
+	for _, format := range birthDateLayouts {
+		parsed, err := time.Parse(format.layout, value)
+		if err != nil {
+			continue
+		}
+		reading := birthDate{year: parsed.Year()}
+		if format.hasMonth {
+			reading.month = int(parsed.Month())
+		}
+		if format.hasDay {
+			reading.day = parsed.Day()
+		}
+		return []birthDate{reading}
+	}
+	return nil
+}
+
+func isCalendarDate(year int, month int, day int) bool {
+	date := time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+	return date.Year() == year && int(date.Month()) == month && date.Day() == day
+}
+
+// Dates agree on every part both of them give
+func (date birthDate) agrees(other birthDate) bool {
+	return date.year == other.year &&
+		(date.month == 0 || other.month == 0 || date.month == other.month) &&
+		(date.day == 0 || other.day == 0 || date.day == other.day)
+}
+
+func compareDatesOfBirth(subject string, entry string) string {
+	subjectReadings := parseBirthDate(subject)
+	entryReadings := parseBirthDate(entry)
+	if len(subjectReadings) == 0 || len(entryReadings) == 0 {
+		return ComparisonUnknown
+	}
+	for _, subjectReading := range subjectReadings {
+		for _, entryReading := range entryReadings {
+			if subjectReading.agrees(entryReading) {
+				return ComparisonMatch
+			}
+		}
+	}
+	return ComparisonMismatch
+}
+
+// Nationalities are compared as ISO 3166-1 alpha-2 codes, so codes and
+// country names compare alike
+func compareNationalities(subject string, entry string) string {
+	subjectCode, subjectKnown := countryCodes[normalizeName(subject)]
+	entryCode, entryKnown := countryCodes[normalizeName(entry)]
+	if !subjectKnown || !entryKnown {
+		return ComparisonUnknown
+	}
+	if subjectCode == entryCode {
+		return ComparisonMatch
+	}
+	return ComparisonMismatch
+}
+
+// Reads a screened attribute from the first element of its type. Returns ""
+// when the person has no such element or the value is not on the ledger in
+// clear.
+func readScreeningValue(person Person, field ScreeningField) (string, error) {
+	for _, infoElement := range person.InfoElements {
+		if infoElement.ElementType != field.ElementType {
+			continue
+		}
+
+		value := infoElement.ElementValue
+		if isSealed(value) {
+			return "", nil
+		}
+
+		if field.Field != "" && value != "" {
+			fields := map[string]interface{}{}
+			if json.Unmarshal([]byte(value), &fields) != nil || fields[field.Field] == nil {
+				return "", nil
+			}
+			value = fmt.Sprint(fields[field.Field])
+		}
+		return value, nil
+	}
+	return "", nil
+}
+
+// Counts the alerts of a request that still block approval
+func openAlerts(request SubmittedRequest) []string {
+	open := []string{}
+	for _, alert := range request.Alerts {
+		if alert.Status == AlertStatusOpen {
+			open = append(open, alert.Id)
+		}
+	}
+	return open
+}
+
+// Clears a screening alert after review. Arguments are the request id, the
+// alert id and the reason, which is required.
+func (kyc *KYCChaincode) clearAlert(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: clearAlert called")
+
+	if len(args) != 3 {
+		return nil, ccerror.IncorrectArgs("3")
+	}
+	if args[2] == "" {
+		return nil, ccerror.New(ccerror.InvalidArgument, "reason", "A reason is required to clear an alert")
+	}
+
+	request, err := kyc.getRequest(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if request == nil {
+		return nil, ccerror.New(ccerror.NotFound, "requestId", "Request not found")
+	}
+
+	var alert *ScreeningAlert
+	for i := range request.Alerts {
+		if request.Alerts[i].Id == args[1] {
+			alert = &request.Alerts[i]
+		}
+	}
+	if alert == nil {
+		return nil, ccerror.New(ccerror.NotFound, "alertId", "Alert %s does not exist on request %s", args[1], args[0])
+	}
+	if alert.Status != AlertStatusOpen {
+		return nil, ccerror.New(ccerror.Conflict, "alertId", "Alert %s is already %s", args[1], alert.Status)
+	}
+
+	now, err := getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	actor, err := getActor(stub)
+	if err != nil {
+		return nil, err
+	}
+	alert.Status = AlertStatusCleared
+	alert.ClearedBy = actor
+	alert.ClearedOn = now.Format(time.RFC3339)
+	alert.ClearReason = args[2]
+
+	err = kyc.putRequest(stub, *request)
+	if err != nil {
+		return nil, err
+	}
+
+	err = emitEvent(stub, KYCEvent{Type: EventAlertCleared, PersonId: request.Person.Id, RequestId: request.Id, Status: AlertStatusCleared})
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestJaroWinklerReferenceValues(t *testing.T) {
+	for _, test := range []struct {
+		first    string
+		second   string
+		expected float64
+	}{
+		{"MARTHA", "MARHTA", 0.961},
+		{"DIXON", "DICKSONX", 0.813},
+		{"DWAYNE", "DUANE", 0.840},
+		// Five characters out of order make 2.5 transpositions, not 2
+		{"ABCDEF", "BCAEDF", 0.861},
+		{"JONES", "JONES", 1},
+		{"ABC", "XYZ", 0},
+		{"", "", 1},
+	} {
+		if score := jaroWinkler(test.first, test.second); math.Abs(score-test.expected) > 0.001 {
+			t.Errorf("jaroWinkler(%s, %s) = %.4f, expected %.3f", test.first, test.second, score, test.expected)
+		}
+	}
+}
+
+func TestNormalizeName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"Müller, Hans-Peter": "hans muller peter",
+		"hans peter MULLER":  "hans muller peter",
+		"Łukasz  Øster":      "lukasz oster",
+		"Straße":             "strasse",
+	} {
+		if normalized := normalizeName(name); normalized != expected {
+			t.Errorf("normalizeName(%q) = %q, expected %q", name, normalized, expected)
+		}
+	}
+}
+
+func TestCompareDatesOfBirth(t *testing.T) {
+	for _, test := range []struct {
+		subject  string
+		entry    string
+		expected string
+	}{
+		{"1980-07-09", "1980", ComparisonMatch},
+		{"1980-07-09", "1980-07-09", ComparisonMatch},
+		{"09/07/1980", "1980-07-09", ComparisonMatch},
+		{"07/09/1980", "1980-07-09", ComparisonMatch},
+		{"9.7.1980", "1980-07-09", ComparisonMatch},
+		{"9 July 1980", "1980-07-09", ComparisonMatch},
+		{"Jul 9, 1980", "1980-07-09", ComparisonMatch},
+		{"July 1980", "1980-07-09", ComparisonMatch},
+		{"19800709", "1980-07-09", ComparisonMatch},
+		{"1980-07-09T00:00:00Z", "1980-07-09", ComparisonMatch},
+		{"13/07/1980", "1980-07-09", ComparisonMismatch},
+		{"1980-08", "1980-07-09", ComparisonMismatch},
+		{"1981-07-09", "1980", ComparisonMismatch},
+		{"31/02/1980", "1980", ComparisonUnknown},
+		{"around 1980", "1980", ComparisonUnknown},
+		{"", "1980", ComparisonUnknown},
+	} {
+		if result := compareDatesOfBirth(test.subject, test.entry); result != test.expected {
+			t.Errorf("compareDatesOfBirth(%q, %q) = %s, expected %s", test.subject, test.entry, result, test.expected)
+		}
+	}
+}
+
+func TestCompareNationalities(t *testing.T) {
+	for _, test := range []struct {
+		subject  string
+		entry    string
+		expected string
+	}{
+		{"DE", "Germany", ComparisonMatch},
+		{"deu", "DE", ComparisonMatch},
+		{"United Kingdom", "GB", ComparisonMatch},
+		{"Iran", "Islamic Republic of Iran", ComparisonMatch},
+		{"Türkiye", "Turkey", ComparisonMatch},
+		{"FR", "Germany", ComparisonMismatch},
+		{"German", "DE", ComparisonUnknown},
+		{"", "DE", ComparisonUnknown},
+	} {
+		if result := compareNationalities(test.subject, test.entry); result != test.expected {
+			t.Errorf("compareNationalities(%q, %q) = %s, expected %s", test.subject, test.entry, result, test.expected)
+		}
+	}
+}
+
+// Creates a person with a name, date of birth and nationality and submits a
+// request for it
+func submitScreenedPerson(stub *testStub, personId string, dateOfBirth string, nationality string) SubmittedRequest {
+	stub.t.Helper()
+	stub.mustInvoke("createPerson", personId)
+	stub.mustInvoke("updateInfoElements", personId, jsonArg(map[string]interface{}{
+		"elements": []InfoElement{
+			{Id: "name", ElementType: "NAME", ElementValue: "Müller, Hans"},
+			{Id: "dob", ElementType: "DOB", ElementValue: dateOfBirth},
+			{Id: "nationality", ElementType: "NATIONALITY", ElementValue: nationality},
+		},
+	}))
+	stub.mustInvoke("saveRequestState", "r-"+personId, personId)
+	return stub.request("r-" + personId)
+}
+
+func TestScreeningOnlySuppressesContradictedHits(t *testing.T) {
+	stub := newTestStub(t)
+	for _, elementType := range []string{"NAME", "DOB", "NATIONALITY"} {
+		stub.registerElementType(elementType)
+	}
+	stub.mustInvoke("loadWatchList", jsonArg(WatchListLoad{
+		Settings: &WatchListSettings{
+			Name:        ScreeningField{ElementType: "NAME"},
+			DateOfBirth: ScreeningField{ElementType: "DOB"},
+			Nationality: ScreeningField{ElementType: "NATIONALITY"},
+		},
+		Entries: []WatchListEntry{{Id: "w1", List: WatchListSanctions, Names: []string{"Hans Mueller"}, DatesOfBirth: []string{"1970-03-04"}, Nationalities: []string{"DE"}}},
+	}))
+
+	request := submitScreenedPerson(stub, "c1", "04/03/1970", "Germany")
+	if len(request.Alerts) != 1 || request.Alerts[0].DateOfBirthResult != ComparisonMatch || request.Alerts[0].NationalityResult != ComparisonMatch || !request.Alerts[0].DateOfBirthMatch {
+		t.Errorf("alerts for a matching person = %+v", request.Alerts)
+	}
+
+	request = submitScreenedPerson(stub, "c2", "early seventies", "German")
+	if len(request.Alerts) != 1 || request.Alerts[0].DateOfBirthResult != ComparisonUnknown || request.Alerts[0].NationalityResult != ComparisonUnknown {
+		t.Errorf("alerts for a person with unreadable details = %+v", request.Alerts)
+	}
+
+	request = submitScreenedPerson(stub, "c3", "1985-01-01", "DE")
+	if len(request.Alerts) != 0 {
+		t.Errorf("alerts for a person born in another year = %+v", request.Alerts)
+	}
+}
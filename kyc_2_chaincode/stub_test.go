@@ -0,0 +1,177 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+// testStub runs the chaincode on a MockStub as a chosen caller. The v0.6
+// MockStub has no certificate attributes, transaction timestamps or caller
+// metadata, so the wrapper supplies them. Every invoke is a transaction of its
+// own whose writes are rolled back when it fails, as they would be on a peer.
+// The events set by the last invoke are kept in events.
+type testStub struct {
+	*shim.MockStub
+	t        *testing.T
+	role     string
+	id       string
+	now      time.Time
+	txs      int
+	metadata []byte
+	events   *EventCapturingStub
+}
+
+// Starts an empty ledger on 2026-01-01 with an admin as the caller
+func newTestStub(t *testing.T) *testStub {
+	stub := &testStub{
+		MockStub: shim.NewMockStub("kyc", new(KYCChaincode)),
+		t:        t,
+		now:      time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	return stub.as(RoleAdmin, "admin")
+}
+
+// Makes the following calls as the given role and id
+func (stub *testStub) as(role string, id string) *testStub {
+	stub.role = role
+	stub.id = id
+	return stub
+}
+
+func (stub *testStub) ReadCertAttribute(attributeName string) ([]byte, error) {
+	switch attributeName {
+	case roleAttribute:
+		return []byte(stub.role), nil
+	case idAttribute:
+		return []byte(stub.id), nil
+	}
+	return nil, nil
+}
+
+func (stub *testStub) GetCallerMetadata() ([]byte, error) {
+	return stub.metadata, nil
+}
+
+func (stub *testStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	return &timestamp.Timestamp{Seconds: stub.now.Unix(), Nanos: int32(stub.now.Nanosecond())}, nil
+}
+
+// Runs one transaction a minute after the previous one
+func (stub *testStub) invoke(function string, args ...string) ([]byte, error) {
+	stub.txs++
+	stub.now = stub.now.Add(time.Minute)
+	txId := fmt.Sprintf("tx%d", stub.txs)
+
+	state := map[string][]byte{}
+	for key, value := range stub.State {
+		state[key] = value
+	}
+	keys := list.New()
+	keys.PushBackList(stub.Keys)
+
+	stub.MockTransactionStart(txId)
+	defer stub.MockTransactionEnd(txId)
+
+	stub.events = NewEventCapturingStub(stub)
+	payload, err := new(KYCChaincode).Invoke(stub.events, function, args)
+	if err != nil {
+		stub.State = state
+		stub.Keys = keys
+	}
+	return payload, err
+}
+
+func (stub *testStub) query(function string, args ...string) ([]byte, error) {
+	return new(KYCChaincode).Query(stub, function, args)
+}
+
+// Invokes a function that has to succeed
+func (stub *testStub) mustInvoke(function string, args ...string) []byte {
+	stub.t.Helper()
+	payload, err := stub.invoke(function, args...)
+	if err != nil {
+		stub.t.Fatalf("%s %v as %s %s failed: %s", function, args, stub.role, stub.id, err)
+	}
+	return payload
+}
+
+// Queries a function that has to succeed and decodes its result into v
+func (stub *testStub) mustQuery(v interface{}, function string, args ...string) {
+	stub.t.Helper()
+	payload, err := stub.query(function, args...)
+	if err != nil {
+		stub.t.Fatalf("%s %v as %s %s failed: %s", function, args, stub.role, stub.id, err)
+	}
+	err = json.Unmarshal(payload, v)
+	if err != nil {
+		stub.t.Fatalf("%s returned %s: %s", function, payload, err)
+	}
+}
+
+// Fails the test unless err is a chaincode error with the given code
+func expectCode(t *testing.T, err error, code ccerror.Code) {
+	t.Helper()
+	if err == nil {
+		t.Fatalf("expected %s, got no error", code)
+	}
+	if ccerror.CodeOf(err) != code {
+		t.Fatalf("expected %s, got %s", code, err)
+	}
+}
+
+// Encodes a value as a JSON argument
+func jsonArg(v interface{}) string {
+	jsonAsBytes, _ := json.Marshal(v)
+	return string(jsonAsBytes)
+}
+
+// Registers an active institution
+func (stub *testStub) registerInstitution(institutionId string) {
+	stub.t.Helper()
+	role, id := stub.role, stub.id
+	stub.as(RoleAdmin, "admin").mustInvoke("registerInstitution", jsonArg(Institution{Id: institutionId, MspId: institutionId + "MSP", DisplayName: institutionId}))
+	stub.as(role, id)
+}
+
+// Reads a request as an admin
+func (stub *testStub) request(requestId string) SubmittedRequest {
+	stub.t.Helper()
+	role, id := stub.role, stub.id
+	request := SubmittedRequest{}
+	stub.as(RoleAdmin, "admin").mustQuery(&request, "queryRequestState", requestId)
+	stub.as(role, id)
+	return request
+}
+
+// Registers an element type that accepts any value
+func (stub *testStub) registerElementType(name string) {
+	stub.t.Helper()
+	role, id := stub.role, stub.id
+	stub.as(RoleAdmin, "admin").mustInvoke("registerElementType", jsonArg(ElementTypeSpec{Name: name}))
+	stub.as(role, id)
+}
+
+// Registers an active verifier
+func (stub *testStub) registerVerifier(verifierId string, elementTypes ...string) {
+	stub.t.Helper()
+	role, id := stub.role, stub.id
+	stub.as(RoleAdmin, "admin").mustInvoke("registerVerifier", jsonArg(Verifier{Id: verifierId, DisplayName: verifierId, ElementTypes: elementTypes}))
+	stub.as(role, id)
+}
+
+// Reads a person as an admin
+func (stub *testStub) person(personId string) Person {
+	stub.t.Helper()
+	role, id := stub.role, stub.id
+	person := Person{}
+	stub.as(RoleAdmin, "admin").mustQuery(&person, "queryPerson", personId)
+	stub.as(role, id)
+	return person
+}
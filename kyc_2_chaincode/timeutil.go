@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+// Layouts accepted for dates supplied by clients, most precise first
+var dateLayouts = []string{time.RFC3339, "2006-01-02"}
+
+// Returns the transaction timestamp so every peer records the same time
+func getTxTime(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, ccerror.New(ccerror.Internal, "", "Failed to get transaction timestamp: %s", err.Error())
+	}
+	return time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).UTC(), nil
+}
+
+// Parses a client supplied date. Plain dates are read as midnight UTC.
+func parseDate(value string) (time.Time, error) {
+	for _, layout := range dateLayouts {
+		parsed, err := time.Parse(layout, value)
+		if err == nil {
+			return parsed.UTC(), nil
+		}
+	}
+	return time.Time{}, errors.New("Invalid date " + value + ", expecting YYYY-MM-DD or RFC3339")
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+// The v0.6 shim has no transient map. Queries take inputs that should not be
+// passed as arguments as a JSON object in the caller metadata instead, with
+// every value base64 encoded, e.g. {"document":"JVBERi0xLjQ="}. Queries are
+// not recorded on the ledger, but the metadata of an invoke is written into
+// the block like its arguments, so invokes must never take secrets this way.
+func getTransient(stub shim.ChaincodeStubInterface) (map[string][]byte, error) {
+	transient := map[string][]byte{}
+
+	metadata, err := stub.GetCallerMetadata()
+	if err != nil {
+		return nil, ccerror.New(ccerror.Internal, "", "Failed to get caller metadata: %s", err.Error())
+	}
+	if len(metadata) == 0 {
+		return transient, nil
+	}
+
+	err = json.Unmarshal(metadata, &transient)
+	if err != nil {
+		return nil, ccerror.New(ccerror.InvalidArgument, "metadata", "Caller metadata must be a JSON object of base64 values: %s", err.Error())
+	}
+
+	return transient, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+// Statuses of an InfoElement. Only verifyInfoElement and sweepExpired change
+// them; updateInfoElement resets an element to PENDING when its content,
+// type or validity changes.
+const (
+	ElementStatusPending  = "PENDING"
+	ElementStatusVerified = "VERIFIED"
+	ElementStatusRejected = "REJECTED"
+)
+
+// Carries the verification fields of the stored element over to an update,
+// ignoring whatever the client sent. They are reset when the value, hash,
+// type or validity changes, since the verification no longer applies to the
+// new element.
+func carryVerification(stored *InfoElement, updated *InfoElement) {
+	if stored == nil ||
+		stored.ElementValue != updated.ElementValue ||
+		stored.ValueHash != updated.ValueHash ||
+		stored.Hash != updated.Hash ||
+		stored.ElementType != updated.ElementType ||
+		stored.ValidTill != updated.ValidTill {
+		updated.Status = ElementStatusPending
+		updated.VerifiedOn = ""
+		updated.VerifiedBy = ""
+		updated.VerificationProof = ""
+		return
+	}
+
+	updated.Status = stored.Status
+	updated.VerifiedOn = stored.VerifiedOn
+	updated.VerifiedBy = stored.VerifiedBy
+	updated.VerificationProof = stored.VerificationProof
+}
+
+// Records a verifier's decision on an InfoElement. Arguments are the person
+// id, the element id, VERIFIED or REJECTED, and a reference to the proof. The
+// caller must be an active verifier in the registry.
+func (kyc *KYCChaincode) verifyInfoElement(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: verifyInfoElement called")
+
+	if len(args) != 4 {
+		return nil, ccerror.IncorrectArgs("4")
+	}
+
+	status := args[2]
+	if status != ElementStatusVerified && status != ElementStatusRejected {
+		return nil, ccerror.New(ccerror.InvalidArgument, "status", "Verification status must be %s or %s", ElementStatusVerified, ElementStatusRejected)
+	}
+	if args[3] == "" {
+		return nil, ccerror.New(ccerror.InvalidArgument, "verificationProof", "A verification proof reference is required")
+	}
+
+	person, err := kyc.mustGetPerson(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	elementIndex := -1
+	for i, infoElement := range person.InfoElements {
+		if infoElement.Id == args[1] {
+			elementIndex = i
+			break
+		}
+	}
+	if elementIndex < 0 {
+		return nil, ccerror.New(ccerror.NotFound, "elementId", "InfoElement with id %s does not exist", args[1])
+	}
+	infoElement := &person.InfoElements[elementIndex]
+
+	now, err := getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	if isLapsed(*infoElement, now) {
+		return nil, ccerror.New(ccerror.Conflict, "validTill", "InfoElement %s has expired and cannot be verified", infoElement.Id)
+	}
+
+	spec, err := kyc.getElementType(stub, infoElement.ElementType)
+	if err != nil {
+		return nil, err
+	}
+	if spec != nil && len(spec.AllowedStatuses) > 0 && !containsString(spec.AllowedStatuses, status) {
+		return nil, ccerror.New(ccerror.InvalidArgument, "status", "Status %s is not allowed for element type %s", status, spec.Name)
+	}
+
+	invoker, err := getInvoker(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = checkVerifier(stub, invoker.Id, infoElement.ElementType)
+	if err != nil {
+		return nil, err
+	}
+
+	infoElement.Status = status
+	infoElement.VerifiedOn = now.Format(time.RFC3339)
+	infoElement.VerifiedBy = invoker.Id
+	infoElement.VerificationProof = args[3]
+
+	err = kyc.putPerson(stub, person)
+	if err != nil {
+		return nil, err
+	}
+
+	err = emitEvent(stub, KYCEvent{
+		Type:         EventInfoElementUpdated,
+		PersonId:     person.Id,
+		ElementId:    infoElement.Id,
+		ElementType:  infoElement.ElementType,
+		Status:       infoElement.Status,
+		DocumentHash: infoElement.Hash,
+		ValueHash:    infoElement.ValueHash,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestUpdatesKeepVerificationOnlyForTheSameElement(t *testing.T) {
+	stub := newTestStub(t)
+	createConsentingPerson(stub)
+	stub.registerVerifier("v1")
+
+	for _, update := range []InfoElement{
+		{Id: "e1", ElementType: "PASSPORT", ElementValue: "X1", Comments: "seen at branch"},
+		{Id: "e1", ElementType: "PASSPORT", ElementValue: "X1", ValidTill: "2036-01-01"},
+		{Id: "e1", ElementType: "ADDRESS", ElementValue: "X1", ValidTill: "2036-01-01"},
+		{Id: "e1", ElementType: "ADDRESS", ElementValue: "X2", ValidTill: "2036-01-01"},
+	} {
+		stub.as(RoleVerifier, "v1").mustInvoke("verifyInfoElement", "c1", "e1", ElementStatusVerified, "proof")
+		stub.as(RoleCustomer, "c1").mustInvoke("updateInfoElement", "c1", jsonArg(update))
+
+		stored := findInfoElement(stub.person("c1"), "e1")
+		keepsVerification := update.Comments != ""
+		if (stored.Status == ElementStatusVerified) != keepsVerification || (stored.VerifiedBy != "") != keepsVerification {
+			t.Errorf("after updating to %+v the element is %+v", update, *stored)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+// Object type of the verifier registry, keyed by verifier id
+const verifierObjectType = "Verifier"
+
+// Statuses of a registered verifier. Suspended verifiers keep the
+// verifications they made but cannot make new ones.
+const (
+	VerifierStatusActive    = "ACTIVE"
+	VerifierStatusSuspended = "SUSPENDED"
+)
+
+// Verifier is a participant allowed to verify InfoElements. Id is the id
+// attribute of the verifier's certificates. ElementTypes limits the element
+// types the verifier may verify; empty allows all of them.
+type Verifier struct {
+	Id           string   `json:"id"`
+	DisplayName  string   `json:"displayName"`
+	Status       string   `json:"status"`
+	ElementTypes []string `json:"elementTypes"`
+	RegisteredOn string   `json:"registeredOn"`
+	UpdatedOn    string   `json:"updatedOn"`
+	TxId         string   `json:"txId"`
+}
+
+func validateVerifier(verifier Verifier) error {
+	if verifier.Id == "" {
+		return ccerror.New(ccerror.InvalidArgument, "id", "Verifier id must not be empty")
+	}
+	if err := validateCompositeKeyAttribute(verifier.Id); err != nil {
+		return err
+	}
+	if verifier.DisplayName == "" {
+		return ccerror.New(ccerror.InvalidArgument, "displayName", "Verifier %s needs a display name", verifier.Id)
+	}
+	if verifier.Status != VerifierStatusActive && verifier.Status != VerifierStatusSuspended {
+		return ccerror.New(ccerror.InvalidArgument, "status", "Verifier status must be %s or %s", VerifierStatusActive, VerifierStatusSuspended)
+	}
+	return nil
+}
+
+// Adds a verifier to the registry. New verifiers are ACTIVE unless another
+// status is given.
+func (kyc *KYCChaincode) registerVerifier(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: registerVerifier called")
+
+	if len(args) != 1 {
+		return nil, ccerror.IncorrectArgs("1")
+	}
+
+	verifier := Verifier{}
+	err := json.Unmarshal([]byte(args[0]), &verifier)
+	if err != nil {
+		return nil, ccerror.New(ccerror.InvalidArgument, "verifier", "Failed to unmarshal verifier: %s", err.Error())
+	}
+	if verifier.Status == "" {
+		verifier.Status = VerifierStatusActive
+	}
+	err = validateVerifier(verifier)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := getVerifier(stub, verifier.Id)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, ccerror.New(ccerror.AlreadyExists, "id", "Verifier %s is already registered", verifier.Id)
+	}
+
+	now, err := getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	verifier.RegisteredOn = now.Format(time.RFC3339)
+
+	return putVerifier(stub, verifier)
+}
+
+// Replaces the display name, status and element types of a registered verifier
+func (kyc *KYCChaincode) updateVerifier(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: updateVerifier called")
+
+	if len(args) != 1 {
+		return nil, ccerror.IncorrectArgs("1")
+	}
+
+	verifier := Verifier{}
+	err := json.Unmarshal([]byte(args[0]), &verifier)
+	if err != nil {
+		return nil, ccerror.New(ccerror.InvalidArgument, "verifier", "Failed to unmarshal verifier: %s", err.Error())
+	}
+	err = validateVerifier(verifier)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := mustGetVerifier(stub, verifier.Id)
+	if err != nil {
+		return nil, err
+	}
+	verifier.RegisteredOn = existing.RegisteredOn
+
+	return putVerifier(stub, verifier)
+}
+
+func putVerifier(stub shim.ChaincodeStubInterface, verifier Verifier) ([]byte, error) {
+	now, err := getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	verifier.UpdatedOn = now.Format(time.RFC3339)
+	verifier.TxId = stub.GetTxID()
+	if verifier.ElementTypes == nil {
+		verifier.ElementTypes = []string{}
+	}
+
+	key, err := createCompositeKey(verifierObjectType, []string{verifier.Id})
+	if err != nil {
+		return nil, err
+	}
+	jsonAsBytes, _ := json.Marshal(verifier)
+	err = stub.PutState(key, jsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
+	return jsonAsBytes, nil
+}
+
+// Reads a registered verifier, returning nil if the id is not registered
+func getVerifier(stub shim.ChaincodeStubInterface, verifierId string) (*Verifier, error) {
+	key, err := createCompositeKey(verifierObjectType, []string{verifierId})
+	if err != nil {
+		return nil, err
+	}
+
+	verifierJSONAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, ccerror.New(ccerror.Internal, "", "Failed to get verifier %s", verifierId)
+	}
+	if verifierJSONAsBytes == nil {
+		return nil, nil
+	}
+
+	verifier := Verifier{}
+	err = json.Unmarshal(verifierJSONAsBytes, &verifier)
+	if err != nil {
+		return nil, ccerror.New(ccerror.Internal, "", "Failed to unmarshal verifier %s: %s", verifierId, err.Error())
+	}
+	return &verifier, nil
+}
+
+func mustGetVerifier(stub shim.ChaincodeStubInterface, verifierId string) (Verifier, error) {
+	verifier, err := getVerifier(stub, verifierId)
+	if err != nil {
+		return Verifier{}, err
+	}
+	if verifier == nil {
+		return Verifier{}, ccerror.New(ccerror.NotFound, "verifierId", "Verifier %s is not registered", verifierId)
+	}
+	return *verifier, nil
+}
+
+func (kyc *KYCChaincode) queryVerifier(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: queryVerifier called")
+
+	if len(args) != 1 {
+		return nil, ccerror.IncorrectArgs("1")
+	}
+
+	verifier, err := mustGetVerifier(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	jsonAsBytes, _ := json.Marshal(verifier)
+	return jsonAsBytes, nil
+}
+
+// Lists registered verifiers in id order. Arguments are the page size and the
+// bookmark of the previous page.
+func (kyc *KYCChaincode) listVerifiers(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: listVerifiers called")
+
+	if len(args) != 2 {
+		return nil, ccerror.IncorrectArgs("2")
+	}
+
+	pageSize, lastKey, err := parsePageArgs(args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	startKey, endKey, err := compositeKeyRange(verifierObjectType, []string{})
+	if err != nil {
+		return nil, err
+	}
+
+	page, err := pageKeys(stub, startKey, endKey, pageSize, lastKey, func(key string, value []byte) (interface{}, bool, error) {
+		verifier := Verifier{}
+		err := json.Unmarshal(value, &verifier)
+		if err != nil {
+			return nil, false, ccerror.New(ccerror.Internal, "", "Failed to unmarshal verifier: %s", err.Error())
+		}
+		return verifier, true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	jsonAsBytes, _ := json.Marshal(page)
+	return jsonAsBytes, nil
+}
+
+// Checks that the verifier is registered, active and allowed to verify
+// elements of the given type. A verifier certificate alone is not enough.
+func checkVerifier(stub shim.ChaincodeStubInterface, verifierId string, elementType string) error {
+	verifier, err := getVerifier(stub, verifierId)
+	if err != nil {
+		return err
+	}
+	if verifier == nil {
+		return ccerror.New(ccerror.Forbidden, "", "Verifier %s is not registered", verifierId)
+	}
+	if verifier.Status != VerifierStatusActive {
+		return ccerror.New(ccerror.Forbidden, "", "Verifier %s is %s", verifierId, verifier.Status)
+	}
+	if len(verifier.ElementTypes) > 0 && !containsString(verifier.ElementTypes, elementType) {
+		return ccerror.New(ccerror.Forbidden, "", "Verifier %s may not verify elements of type %s", verifierId, elementType)
+	}
+	return nil
+}
+
+// Narrows the snapshot of a request to the elements a verifier may verify.
+// Verifiers only see requests holding at least one such element, and never
+// the risk assessment.
+func scopeRequestToVerifier(stub shim.ChaincodeStubInterface, request *SubmittedRequest, verifierId string) error {
+	verifier, err := getVerifier(stub, verifierId)
+	if err != nil {
+		return err
+	}
+	if verifier == nil || verifier.Status != VerifierStatusActive {
+		return ccerror.New(ccerror.Forbidden, "", "Verifier %s is not an active registered verifier", verifierId)
+	}
+
+	scopedInfoElements := []InfoElement{}
+	for _, infoElement := range request.Person.InfoElements {
+		if len(verifier.ElementTypes) == 0 || containsString(verifier.ElementTypes, infoElement.ElementType) {
+			scopedInfoElements = append(scopedInfoElements, infoElement)
+		}
+	}
+	if len(scopedInfoElements) == 0 {
+		return ccerror.New(ccerror.Forbidden, "", "Request %s holds no elements verifier %s may verify", request.Id, verifierId)
+	}
+	request.Person.InfoElements = scopedInfoElements
+	request.Person.RiskAssessment = nil
+	return nil
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+// Object types of the watch list entries, keyed by entry id, and of the
+// single key holding the watch list settings
+const watchListObjectType = "WatchList"
+const watchListSettingsObjectType = "WatchListSettings"
+
+// Largest number of entries loaded or changed by one transaction
+const maxWatchListBatch = 1000
+
+// Jaro-Winkler similarity a name needs to reach when no threshold is set
+const defaultScreeningThreshold = 0.9
+
+// Lists an entry can come from
+const (
+	WatchListSanctions = "SANCTIONS"
+	WatchListPEP       = "PEP"
+)
+
+// WatchListEntry is one sanctioned or politically exposed person. Dates of
+// birth are YYYY-MM-DD, or YYYY when only the year is known. NormalizedNames
+// is filled in by the chaincode when the entry is stored.
+type WatchListEntry struct {
+	Id              string   `json:"id"`
+	List            string   `json:"list"`
+	Names           []string `json:"names"`
+	DatesOfBirth    []string `json:"datesOfBirth"`
+	Nationalities   []string `json:"nationalities"`
+	Source          string   `json:"source"`
+	NormalizedNames []string `json:"normalizedNames"`
+}
+
+// ScreeningField names the InfoElement, and for structured values the field
+// of it, a screened attribute is read from
+type ScreeningField struct {
+	ElementType string `json:"elementType"`
+	Field       string `json:"field"`
+}
+
+// WatchListSettings says where screening finds a person's name, date of birth
+// and nationality, and how similar names must be to raise an alert. Version
+// is bumped by every change to the list.
+type WatchListSettings struct {
+	Threshold   float64        `json:"threshold"`
+	Name        ScreeningField `json:"name"`
+	DateOfBirth ScreeningField `json:"dateOfBirth"`
+	Nationality ScreeningField `json:"nationality"`
+	Version     int            `json:"version"`
+	Entries     int            `json:"entries"`
+	UpdatedOn   string         `json:"updatedOn"`
+	TxId        string         `json:"txId"`
+}
+
+// WatchListLoad is the argument of loadWatchList. With Replace set, every
+// entry not in the load is removed. Settings are required on the first load
+// and kept when omitted later.
+type WatchListLoad struct {
+	Replace  bool               `json:"replace"`
+	Settings *WatchListSettings `json:"settings"`
+	Entries  []WatchListEntry   `json:"entries"`
+}
+
+// WatchListDelta is the argument of updateWatchList
+type WatchListDelta struct {
+	Upsert []WatchListEntry `json:"upsert"`
+	Remove []string         `json:"remove"`
+}
+
+func validateWatchListEntry(entry WatchListEntry) error {
+	if entry.Id == "" {
+		return ccerror.New(ccerror.InvalidArgument, "id", "Watch list entries need an id")
+	}
+	if entry.List != WatchListSanctions && entry.List != WatchListPEP {
+		return ccerror.New(ccerror.InvalidArgument, "list", "Watch list entry %s must be on %s or %s", entry.Id, WatchListSanctions, WatchListPEP)
+	}
+	if len(entry.Names) == 0 {
+		return ccerror.New(ccerror.InvalidArgument, "names", "Watch list entry %s needs at least one name", entry.Id)
+	}
+	for _, dateOfBirth := range entry.DatesOfBirth {
+		if len(parseBirthDate(dateOfBirth)) == 0 {
+			return ccerror.New(ccerror.InvalidArgument, "datesOfBirth", "Watch list entry %s has invalid date of birth %s", entry.Id, dateOfBirth)
+		}
+	}
+	return nil
+}
+
+// Bulk loads watch list entries, optionally replacing the whole list
+func (kyc *KYCChaincode) loadWatchList(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: loadWatchList called")
+
+	if len(args) != 1 {
+		return nil, ccerror.IncorrectArgs("1")
+	}
+
+	load := WatchListLoad{}
+	err := json.Unmarshal([]byte(args[0]), &load)
+	if err != nil {
+		return nil, ccerror.New(ccerror.InvalidArgument, "watchList", "Failed to unmarshal watch list: %s", err.Error())
+	}
+	if len(load.Entries) > maxWatchListBatch {
+		return nil, ccerror.New(ccerror.InvalidArgument, "entries", "Load has more than %d entries", maxWatchListBatch)
+	}
+
+	settings, err := getWatchListSettings(stub)
+	if err != nil {
+		return nil, err
+	}
+	if load.Settings != nil {
+		current := settings
+		settings = load.Settings
+		if current != nil {
+			settings.Version = current.Version
+			settings.Entries = current.Entries
+		}
+	}
+	if settings == nil {
+		return nil, ccerror.New(ccerror.InvalidArgument, "settings", "The first watch list load needs settings")
+	}
+	if settings.Threshold == 0 {
+		settings.Threshold = defaultScreeningThreshold
+	}
+	if settings.Threshold < 0 || settings.Threshold > 1 {
+		return nil, ccerror.New(ccerror.InvalidArgument, "threshold", "Threshold must be between 0 and 1")
+	}
+	if settings.Name.ElementType == "" {
+		return nil, ccerror.New(ccerror.InvalidArgument, "name", "Settings must name the element type holding names")
+	}
+
+	if load.Replace {
+		_, err = deleteKeyRange(stub, watchListObjectType, []string{})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	added, err := putWatchListEntries(stub, load.Entries)
+	if err != nil {
+		return nil, err
+	}
+	if load.Replace {
+		settings.Entries = len(load.Entries)
+	} else {
+		settings.Entries += added
+	}
+
+	return putWatchListSettings(stub, *settings)
+}
+
+// Applies a delta of added, changed and removed watch list entries
+func (kyc *KYCChaincode) updateWatchList(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: updateWatchList called")
+
+	if len(args) != 1 {
+		return nil, ccerror.IncorrectArgs("1")
+	}
+
+	delta := WatchListDelta{}
+	err := json.Unmarshal([]byte(args[0]), &delta)
+	if err != nil {
+		return nil, ccerror.New(ccerror.InvalidArgument, "watchList", "Failed to unmarshal watch list delta: %s", err.Error())
+	}
+	if len(delta.Upsert)+len(delta.Remove) > maxWatchListBatch {
+		return nil, ccerror.New(ccerror.InvalidArgument, "watchList", "Delta has more than %d entries", maxWatchListBatch)
+	}
+
+	settings, err := getWatchListSettings(stub)
+	if err != nil {
+		return nil, err
+	}
+	if settings == nil {
+		return nil, ccerror.New(ccerror.NotFound, "watchList", "No watch list has been loaded")
+	}
+
+	for _, entry := range delta.Upsert {
+		if containsString(delta.Remove, entry.Id) {
+			return nil, ccerror.New(ccerror.InvalidArgument, "remove", "Watch list entry %s is both upserted and removed", entry.Id)
+		}
+	}
+
+	for _, entryId := range delta.Remove {
+		key, err := createCompositeKey(watchListObjectType, []string{entryId})
+		if err != nil {
+			return nil, err
+		}
+		existing, err := stub.GetState(key)
+		if err != nil {
+			return nil, ccerror.New(ccerror.Internal, "", "Failed to get watch list entry %s", entryId)
+		}
+		if existing == nil {
+			return nil, ccerror.New(ccerror.NotFound, "remove", "Watch list entry %s does not exist", entryId)
+		}
+		err = stub.DelState(key)
+		if err != nil {
+			return nil, ccerror.New(ccerror.Internal, "", "Failed to delete state")
+		}
+		settings.Entries--
+	}
+
+	added, err := putWatchListEntries(stub, delta.Upsert)
+	if err != nil {
+		return nil, err
+	}
+	settings.Entries += added
+
+	return putWatchListSettings(stub, *settings)
+}
+
+// Validates and stores entries. Returns how many of them are new.
+func putWatchListEntries(stub shim.ChaincodeStubInterface, entries []WatchListEntry) (int, error) {
+	added := 0
+	seen := map[string]bool{}
+	for _, entry := range entries {
+		err := validateWatchListEntry(entry)
+		if err != nil {
+			return 0, err
+		}
+		if seen[entry.Id] {
+			return 0, ccerror.New(ccerror.InvalidArgument, "id", "Watch list entry %s appears more than once", entry.Id)
+		}
+		seen[entry.Id] = true
+
+		entry.NormalizedNames = []string{}
+		for _, name := range entry.Names {
+			entry.NormalizedNames = append(entry.NormalizedNames, normalizeName(name))
+		}
+
+		key, err := createCompositeKey(watchListObjectType, []string{entry.Id})
+		if err != nil {
+			return 0, err
+		}
+		existing, err := stub.GetState(key)
+		if err != nil {
+			return 0, ccerror.New(ccerror.Internal, "", "Failed to get watch list entry %s", entry.Id)
+		}
+		if existing == nil {
+			added++
+		}
+
+		jsonAsBytes, _ := json.Marshal(entry)
+		err = stub.PutState(key, jsonAsBytes)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return added, nil
+}
+
+func putWatchListSettings(stub shim.ChaincodeStubInterface, settings WatchListSettings) ([]byte, error) {
+	now, err := getTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	settings.Version++
+	settings.UpdatedOn = now.Format(time.RFC3339)
+	settings.TxId = stub.GetTxID()
+
+	key, err := createCompositeKey(watchListSettingsObjectType, []string{})
+	if err != nil {
+		return nil, err
+	}
+	jsonAsBytes, _ := json.Marshal(settings)
+	err = stub.PutState(key, jsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
+	return jsonAsBytes, nil
+}
+
+// Reads the watch list settings, returning nil if no list was loaded yet
+func getWatchListSettings(stub shim.ChaincodeStubInterface) (*WatchListSettings, error) {
+	key, err := createCompositeKey(watchListSettingsObjectType, []string{})
+	if err != nil {
+		return nil, err
+	}
+
+	settingsJSONAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, ccerror.New(ccerror.Internal, "", "Failed to get watch list settings")
+	}
+	if settingsJSONAsBytes == nil {
+		return nil, nil
+	}
+
+	settings := WatchListSettings{}
+	err = json.Unmarshal(settingsJSONAsBytes, &settings)
+	if err != nil {
+		return nil, ccerror.New(ccerror.Internal, "", "Failed to unmarshal watch list settings: %s", err.Error())
+	}
+	return &settings, nil
+}
+
+// Calls visit for every watch list entry in id order
+func forEachWatchListEntry(stub shim.ChaincodeStubInterface, visit func(WatchListEntry) error) error {
+	startKey, endKey, err := compositeKeyRange(watchListObjectType, []string{})
+	if err != nil {
+		return err
+	}
+
+	iterator, err := stub.RangeQueryState(startKey, endKey)
+	if err != nil {
+		return err
+	}
+	defer iterator.Close()
+
+	for iterator.HasNext() {
+		_, entryJSONAsBytes, err := iterator.Next()
+		if err != nil {
+			return err
+		}
+
+		entry := WatchListEntry{}
+		err = json.Unmarshal(entryJSONAsBytes, &entry)
+		if err != nil {
+			return ccerror.New(ccerror.Internal, "", "Failed to unmarshal watch list entry: %s", err.Error())
+		}
+		err = visit(entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Lists watch list entries in id order. Arguments are the page size and the
+// bookmark of the previous page.
+func (kyc *KYCChaincode) queryWatchList(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("CHAINCODE: queryWatchList called")
+
+	if len(args) != 2 {
+		return nil, ccerror.IncorrectArgs("2")
+	}
+
+	pageSize, lastKey, err := parsePageArgs(args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	startKey, endKey, err := compositeKeyRange(watchListObjectType, []string{})
+	if err != nil {
+		return nil, err
+	}
+
+	page, err := pageKeys(stub, startKey, endKey, pageSize, lastKey, func(key string, value []byte) (interface{}, bool, error) {
+		entry := WatchListEntry{}
+		err := json.Unmarshal(value, &entry)
+		if err != nil {
+			return nil, false, ccerror.New(ccerror.Internal, "", "Failed to unmarshal watch list entry: %s", err.Error())
+		}
+		return entry, true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	jsonAsBytes, _ := json.Marshal(page)
+	return jsonAsBytes, nil
+}
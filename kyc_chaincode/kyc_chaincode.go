@@ -1,10 +1,10 @@
 package main;
 
 import (
-	"errors"
     "encoding/json"
 	"fmt"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
 )
 
 // KYCChaincode structure.
@@ -27,7 +27,11 @@ type DocMetaData struct {
 // ============================
 // Init - reset all the things
 // ============================
-func (kyc *KYCChaincode) Init(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+func (kyc *KYCChaincode) Init(stub shim.ChaincodeStubInterface, function string, args []string) (payload []byte, err error) {
+
+    defer func() {
+        err = ccerror.WithTx(err, stub.GetTxID());
+    }();
 
 	var testKey string = "testKey"
 	var testValue string = "testValue"
@@ -43,9 +47,13 @@ func (kyc *KYCChaincode) Init(stub shim.ChaincodeStubInterface, function string,
 // ======================================
 // Invoke - entry point for Invocations
 // ======================================
-func (kyc *KYCChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+func (kyc *KYCChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) (payload []byte, err error) {
     fmt.Println("invoke is running " + function);
 
+    defer func() {
+        err = ccerror.WithTx(err, stub.GetTxID());
+    }();
+
     if(function == "updatePerson"){
         return kyc.updatePerson(stub, args);
     } else if(function == "createPerson"){
@@ -53,52 +61,57 @@ func (kyc *KYCChaincode) Invoke(stub shim.ChaincodeStubInterface, function strin
     }
 
     fmt.Println("invoke did not find func: " + function);
-    return nil, errors.New("Received unknown function invocation");
+    return nil, ccerror.New(ccerror.InvalidArgument, "function", "Received unknown function invocation");
 }
 
 // =================================
 // Query - entry point for Queries
 // =================================
-func (kyc *KYCChaincode) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+func (kyc *KYCChaincode) Query(stub shim.ChaincodeStubInterface, function string, args []string) (payload []byte, err error) {
 	fmt.Println("query is running " + function);
 
+    defer func() {
+        err = ccerror.WithTx(err, stub.GetTxID());
+    }();
+
     if(function == "queryPerson"){
         return kyc.queryPerson(stub, args);
     }
 
     fmt.Println("query did not find func: " + function);
-    return nil, errors.New("Received unknown function query");
+    return nil, ccerror.New(ccerror.InvalidArgument, "function", "Received unknown function query");
 }
 
 // ======================================================================
 // CreatePerson - this method writes a new Person object into the ledger
 // ======================================================================
 func (kyc *KYCChaincode) createPerson(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-    var testKey string = "testKey"
-		var testValue string = "testValue1"
-
     err := kyc.checkArguments(args);
     if err != nil {
         return nil, err;
     }
 
     personAsJSON := args[0];
-    //personAsBytes := []byte(personAsJSON);
-		personAsBytes, queryErr := stub.GetState(testKey);
-		if queryErr != nil {
-	        jsonResp := "{\"Error\":\"Failed to get state for person with (\"  \") GUID\"}";
-			return nil, errors.New(jsonResp);
-		}
-		personAsBytes = []byte(personAsJSON);
+    personAsBytes := []byte(personAsJSON);
     person := Person{};
     unmarshalingError := json.Unmarshal(personAsBytes, &person);
     if unmarshalingError != nil {
-        return nil, unmarshalingError;
+        return nil, ccerror.New(ccerror.InvalidArgument, "person", "Failed to unmarshal person: %s", unmarshalingError.Error());
+    }
+    if person.Id == "" {
+        return nil, ccerror.New(ccerror.InvalidArgument, "id", "Person id is required");
     }
 
-		fmt.Println("SAHIL: Person ID: " + person.Id);
-    // creatingErr := stub.PutState(person.Id, personAsBytes);
-		creatingErr := stub.PutState(testKey, []byte(testValue));
+    // Persons are stored under their id, where queryPerson reads them
+    existingAsBytes, queryErr := stub.GetState(person.Id);
+    if queryErr != nil {
+        return nil, ccerror.New(ccerror.Internal, "", "Failed to get state for person with (%s) GUID", person.Id);
+    }
+    if existingAsBytes != nil {
+        return nil, ccerror.New(ccerror.AlreadyExists, "id", "Person with (%s) GUID already exists", person.Id);
+    }
+
+    creatingErr := stub.PutState(person.Id, personAsBytes);
     if creatingErr != nil {
         return nil, creatingErr;
     }
@@ -110,19 +123,15 @@ func (kyc *KYCChaincode) createPerson(stub shim.ChaincodeStubInterface, args []s
 // QueryPerson - this method reads a Person object from the ledger
 // ================================================================
 func (kyc *KYCChaincode) queryPerson(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var testKey string = "testKey"
-
     err := kyc.checkArguments(args);
     if err != nil {
         return nil, err;
     }
 
     personGUID := args[0];
-	//personAsBytes, queryErr := stub.GetState(personGUID);
-	personAsBytes, queryErr := stub.GetState(testKey);
+	personAsBytes, queryErr := stub.GetState(personGUID);
 	if queryErr != nil {
-        jsonResp := "{\"Error\":\"Failed to get state for person with (" + personGUID + ") GUID\"}";
-		return nil, errors.New(jsonResp);
+		return nil, ccerror.New(ccerror.Internal, "", "Failed to get state for person with (%s) GUID", personGUID);
 	}
 
     return personAsBytes, nil;
@@ -142,7 +151,7 @@ func (kyc *KYCChaincode) updatePerson(stub shim.ChaincodeStubInterface, args []s
     personAsBytes := []byte(personAsJSON);
     unmarshalingError := json.Unmarshal(personAsBytes, &person);
     if unmarshalingError != nil {
-        return nil, unmarshalingError;
+        return nil, ccerror.New(ccerror.InvalidArgument, "person", "Failed to unmarshal person: %s", unmarshalingError.Error());
     }
 
     updateErr := stub.PutState(person.Id, personAsBytes);
@@ -161,8 +170,7 @@ func (kyc *KYCChaincode) checkArguments(args []string) (error) {
         return nil;
     }
 
-    jsonResp := "{\"Error\":\"Wrong arguments, this API this API takes only 1 argument.\"}";
-    return errors.New(jsonResp);
+    return ccerror.IncorrectArgs("1");
 }
 
 // =====
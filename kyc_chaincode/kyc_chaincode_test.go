@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+func TestInitReturnsStructuredErrors(t *testing.T) {
+	stub := shim.NewMockStub("kyc", new(KYCChaincode))
+
+	_, err := stub.MockInit("tx1", "init", []string{})
+	if err != nil {
+		t.Fatalf("init failed: %s", err)
+	}
+
+	// The MockStub refuses writes outside a transaction
+	_, err = new(KYCChaincode).Init(stub, "init", []string{})
+	ccErr, ok := err.(*ccerror.Error)
+	if !ok || ccErr.Code != ccerror.Internal {
+		t.Fatalf("init outside a transaction returned %#v, expected an INTERNAL chaincode error", err)
+	}
+}
+
+func TestCreatedPersonsCanBeQueried(t *testing.T) {
+	stub := shim.NewMockStub("kyc", new(KYCChaincode))
+	person := `{"id":"p1","docsMetaData":[{"id":1,"hash":"ab","status":"VERIFIED"}]}`
+
+	_, err := stub.MockInvoke("tx1", "createPerson", []string{person})
+	if err != nil {
+		t.Fatalf("createPerson failed: %s", err)
+	}
+
+	personAsBytes, err := stub.MockQuery("queryPerson", []string{"p1"})
+	if err != nil || string(personAsBytes) != person {
+		t.Fatalf("queryPerson returned %s, %v", personAsBytes, err)
+	}
+
+	_, err = stub.MockInvoke("tx2", "createPerson", []string{person})
+	if ccerror.CodeOf(err) != ccerror.AlreadyExists {
+		t.Errorf("creating p1 again returned %v", err)
+	}
+	_, err = stub.MockInvoke("tx3", "createPerson", []string{`{"docsMetaData":[]}`})
+	if ccerror.CodeOf(err) != ccerror.InvalidArgument {
+		t.Errorf("creating a person without id returned %v", err)
+	}
+}
@@ -18,48 +18,66 @@ under the License.
 package main
 
 import (
-	"errors"
+	"encoding/json"
 	"fmt"
+	"math"
 	"strconv"
+	"strings"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
 )
 
 // SimpleChaincode example simple Chaincode implementation
 type SimpleChaincode struct {
 }
 
-func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface, function string, args []string) (payload []byte, err error) {
 	fmt.Printf("Init called, initializing chaincode")
+
+	defer func() {
+		err = ccerror.WithTx(err, stub.GetTxID())
+	}()
 	
-	var A, B string    // Entities
-	var Aval, Bval int // Asset holdings
-	var err error
+	var A, B string      // Entities
+	var Aval, Bval int64 // Asset holdings
 
 	if len(args) != 4 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 4")
+		return nil, ccerror.IncorrectArgs("4")
 	}
 
 	// Initialize the chaincode
 	A = args[0]
-	Aval, err = strconv.Atoi(args[1])
+	B = args[2]
+	if err = validateAccount("A", A); err != nil {
+		return nil, err
+	}
+	if err = validateAccount("B", B); err != nil {
+		return nil, err
+	}
+	if A == B {
+		return nil, ccerror.New(ccerror.InvalidArgument, "B", "Accounts A and B must differ")
+	}
+	Aval, err = parseAmount("Aval", args[1])
 	if err != nil {
-		return nil, errors.New("Expecting integer value for asset holding")
+		return nil, err
 	}
-	B = args[2]
-	Bval, err = strconv.Atoi(args[3])
+	Bval, err = parseAmount("Bval", args[3])
 	if err != nil {
-		return nil, errors.New("Expecting integer value for asset holding")
+		return nil, err
+	}
+	if Aval < 0 || Bval < 0 {
+		return nil, ccerror.New(ccerror.InvalidArgument, "args", "Initial asset holdings must not be negative")
 	}
 	fmt.Printf("Aval = %d, Bval = %d\n", Aval, Bval)
 
 	// Write the state to the ledger
-	err = stub.PutState(A, []byte(strconv.Itoa(Aval)))
+	err = stub.PutState(A, []byte(strconv.FormatInt(Aval, 10)))
 	if err != nil {
 		return nil, err
 	}
 
-	err = stub.PutState(B, []byte(strconv.Itoa(Bval)))
+	err = stub.PutState(B, []byte(strconv.FormatInt(Bval, 10)))
 	if err != nil {
 		return nil, err
 	}
@@ -67,55 +85,226 @@ func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface, function string
 	return nil, nil
 }
 
-// Transaction makes payment of X units from A to B
-func (t *SimpleChaincode) invoke(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	fmt.Printf("Running invoke")
-	
-	var A, B string    // Entities
-	var Aval, Bval int // Asset holdings
-	var X int          // Transaction value
-	var err error
+// Prefix of the keys overdraft limits are stored under. Account names are
+// plain keys, and cannot start with a null byte.
+const overdraftKeyPrefix = "\x00OverdraftLimit\x00"
+
+// Certificate attribute and value of the callers allowed to set overdraft
+// limits, create and delete accounts, and move funds out of any account
+const roleAttribute = "role"
+const adminRole = "admin"
+
+// Certificate attribute naming the account a caller owns. Chaincodes such
+// as kyc_2_chaincode call this one with the certificate of their invoker, so
+// an institution charged a fee debits its own account.
+const idAttribute = "id"
+
+// Balance of one account after a transfer
+type AccountBalance struct {
+	Account string `json:"account"`
+	Balance int64  `json:"balance"`
+}
+
+// Result of transferChecked
+type TransferResult struct {
+	Amount int64          `json:"amount"`
+	From   AccountBalance `json:"from"`
+	To     AccountBalance `json:"to"`
+}
+
+// Parses a whole amount, rejecting anything that is not a base 10 int64
+func parseAmount(field string, value string) (int64, error) {
+	amount, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, ccerror.New(ccerror.InvalidArgument, field, "Expecting integer value for %s, got %q", field, value)
+	}
+	return amount, nil
+}
+
+func isAdmin(stub shim.ChaincodeStubInterface) bool {
+	role, err := stub.ReadCertAttribute(roleAttribute)
+	return err == nil && string(role) == adminRole
+}
+
+// Fails unless the caller owns the account or is an admin
+func checkOwner(stub shim.ChaincodeStubInterface, account string) error {
+	if isAdmin(stub) {
+		return nil
+	}
+	id, err := stub.ReadCertAttribute(idAttribute)
+	if err != nil || string(id) != account {
+		return ccerror.New(ccerror.Forbidden, "A", "Only the owner of %s or an admin may move its funds", account)
+	}
+	return nil
+}
+
+func validateAccount(field string, account string) error {
+	if account == "" {
+		return ccerror.New(ccerror.InvalidArgument, field, "Account name must not be empty")
+	}
+	if strings.HasPrefix(account, "\x00") {
+		return ccerror.New(ccerror.InvalidArgument, field, "Account name must not start with a null byte")
+	}
+	return nil
+}
+
+func getBalance(stub shim.ChaincodeStubInterface, field string, account string) (int64, error) {
+	balanceBytes, err := stub.GetState(account)
+	if err != nil {
+		return 0, ccerror.New(ccerror.Internal, "", "Failed to get state for %s", account)
+	}
+	if balanceBytes == nil {
+		return 0, ccerror.New(ccerror.NotFound, field, "Entity %s not found", account)
+	}
+	balance, err := strconv.ParseInt(string(balanceBytes), 10, 64)
+	if err != nil {
+		return 0, ccerror.New(ccerror.Internal, "", "Balance of %s is not an integer", account)
+	}
+	return balance, nil
+}
 
+// Reads how far an account may go below zero. Accounts without a limit may not.
+func getOverdraftLimit(stub shim.ChaincodeStubInterface, account string) (int64, error) {
+	limitBytes, err := stub.GetState(overdraftKeyPrefix + account)
+	if err != nil {
+		return 0, ccerror.New(ccerror.Internal, "", "Failed to get overdraft limit for %s", account)
+	}
+	if limitBytes == nil {
+		return 0, nil
+	}
+	limit, err := strconv.ParseInt(string(limitBytes), 10, 64)
+	if err != nil {
+		return 0, ccerror.New(ccerror.Internal, "", "Overdraft limit of %s is not an integer", account)
+	}
+	return limit, nil
+}
+
+// Moves X units from A to B. Only the owner of A or an admin may call it. A
+// may not end up below minus its overdraft limit, and neither balance may
+// overflow.
+func (t *SimpleChaincode) transfer(stub shim.ChaincodeStubInterface, args []string) (TransferResult, error) {
 	if len(args) != 3 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+		return TransferResult{}, ccerror.IncorrectArgs("3")
 	}
 
-	A = args[0]
-	B = args[1]
+	A := args[0]
+	B := args[1]
+	if err := validateAccount("A", A); err != nil {
+		return TransferResult{}, err
+	}
+	if err := validateAccount("B", B); err != nil {
+		return TransferResult{}, err
+	}
+	if A == B {
+		return TransferResult{}, ccerror.New(ccerror.InvalidArgument, "B", "Cannot transfer from %s to itself", A)
+	}
+	if err := checkOwner(stub, A); err != nil {
+		return TransferResult{}, err
+	}
 
-	// Get the state from the ledger
-	// TODO: will be nice to have a GetAllState call to ledger
-	Avalbytes, err := stub.GetState(A)
+	X, err := parseAmount("X", args[2])
 	if err != nil {
-		return nil, errors.New("Failed to get state")
+		return TransferResult{}, err
 	}
-	if Avalbytes == nil {
-		return nil, errors.New("Entity not found")
+	if X <= 0 {
+		return TransferResult{}, ccerror.New(ccerror.InvalidArgument, "X", "Transfer amount must be positive")
 	}
-	Aval, _ = strconv.Atoi(string(Avalbytes))
 
-	Bvalbytes, err := stub.GetState(B)
+	// Get the state from the ledger
+	Aval, err := getBalance(stub, "A", A)
 	if err != nil {
-		return nil, errors.New("Failed to get state")
+		return TransferResult{}, err
 	}
-	if Bvalbytes == nil {
-		return nil, errors.New("Entity not found")
+	Bval, err := getBalance(stub, "B", B)
+	if err != nil {
+		return TransferResult{}, err
+	}
+	limit, err := getOverdraftLimit(stub, A)
+	if err != nil {
+		return TransferResult{}, err
 	}
-	Bval, _ = strconv.Atoi(string(Bvalbytes))
 
-	// Perform the execution
-	X, err = strconv.Atoi(args[2])
+	// Aval - X >= -limit, written so that neither side can overflow
+	if Aval < 0 && X > math.MaxInt64+Aval {
+		return TransferResult{}, ccerror.New(ccerror.Conflict, "X", "Insufficient funds in %s", A)
+	}
 	Aval = Aval - X
+	if Aval < -limit {
+		return TransferResult{}, ccerror.New(ccerror.Conflict, "X", "Insufficient funds in %s", A)
+	}
+	if Bval > math.MaxInt64-X {
+		return TransferResult{}, ccerror.New(ccerror.Conflict, "X", "Balance of %s would overflow", B)
+	}
 	Bval = Bval + X
 	fmt.Printf("Aval = %d, Bval = %d\n", Aval, Bval)
 
 	// Write the state back to the ledger
-	err = stub.PutState(A, []byte(strconv.Itoa(Aval)))
+	err = stub.PutState(A, []byte(strconv.FormatInt(Aval, 10)))
+	if err != nil {
+		return TransferResult{}, err
+	}
+
+	err = stub.PutState(B, []byte(strconv.FormatInt(Bval, 10)))
+	if err != nil {
+		return TransferResult{}, err
+	}
+
+	return TransferResult{Amount: X, From: AccountBalance{A, Aval}, To: AccountBalance{B, Bval}}, nil
+}
+
+// Transaction makes payment of X units from A to B
+func (t *SimpleChaincode) invoke(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Printf("Running invoke")
+
+	_, err := t.transfer(stub, args)
 	if err != nil {
 		return nil, err
 	}
 
-	err = stub.PutState(B, []byte(strconv.Itoa(Bval)))
+	return nil, nil
+}
+
+// Same as invoke, returning the new balances of both accounts as JSON
+func (t *SimpleChaincode) transferChecked(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Printf("Running transferChecked")
+
+	result, err := t.transfer(stub, args)
+	if err != nil {
+		return nil, err
+	}
+
+	jsonAsBytes, _ := json.Marshal(result)
+	return jsonAsBytes, nil
+}
+
+// Sets how far below zero an account may go. Only admins may call it.
+func (t *SimpleChaincode) setOverdraftLimit(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Printf("Running setOverdraftLimit")
+
+	if len(args) != 2 {
+		return nil, ccerror.IncorrectArgs("2")
+	}
+
+	if !isAdmin(stub) {
+		return nil, ccerror.New(ccerror.Forbidden, "", "Only admins may set overdraft limits")
+	}
+
+	A := args[0]
+	if err := validateAccount("A", A); err != nil {
+		return nil, err
+	}
+	limit, err := parseAmount("limit", args[1])
+	if err != nil {
+		return nil, err
+	}
+	if limit < 0 {
+		return nil, ccerror.New(ccerror.InvalidArgument, "limit", "Overdraft limit must not be negative")
+	}
+	if _, err := getBalance(stub, "A", A); err != nil {
+		return nil, err
+	}
+
+	err = stub.PutState(overdraftKeyPrefix+A, []byte(strconv.FormatInt(limit, 10)))
 	if err != nil {
 		return nil, err
 	}
@@ -123,20 +312,31 @@ func (t *SimpleChaincode) invoke(stub shim.ChaincodeStubInterface, args []string
 	return nil, nil
 }
 
-// Deletes an entity from state
+// Deletes an entity from state. Only admins may call it.
 func (t *SimpleChaincode) delete(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	fmt.Printf("Running delete")
 	
 	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+		return nil, ccerror.IncorrectArgs("1")
+	}
+	if !isAdmin(stub) {
+		return nil, ccerror.New(ccerror.Forbidden, "", "Only admins may delete accounts")
 	}
 
 	A := args[0]
 
-	// Delete the key from the state in ledger
+	if err := validateAccount("A", A); err != nil {
+		return nil, err
+	}
+
+	// Delete the key from the state in ledger, with its overdraft limit
 	err := stub.DelState(A)
 	if err != nil {
-		return nil, errors.New("Failed to delete state")
+		return nil, ccerror.New(ccerror.Internal, "", "Failed to delete state")
+	}
+	err = stub.DelState(overdraftKeyPrefix + A)
+	if err != nil {
+		return nil, ccerror.New(ccerror.Internal, "", "Failed to delete state")
 	}
 
 	return nil, nil
@@ -144,16 +344,30 @@ func (t *SimpleChaincode) delete(stub shim.ChaincodeStubInterface, args []string
 
 // Invoke callback representing the invocation of a chaincode
 // This chaincode will manage two accounts A and B and will transfer X units from A to B upon invoke
-func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) (payload []byte, err error) {
 	fmt.Printf("Invoke called, determining function")
+
+	defer func() {
+		err = ccerror.WithTx(err, stub.GetTxID())
+	}()
 	
 	// Handle different functions
 	if function == "invoke" {
 		// Transaction makes payment of X units from A to B
 		fmt.Printf("Function is invoke")
 		return t.invoke(stub, args)
+	} else if function == "transferChecked" {
+		fmt.Printf("Function is transferChecked")
+		return t.transferChecked(stub, args)
+	} else if function == "setOverdraftLimit" {
+		fmt.Printf("Function is setOverdraftLimit")
+		return t.setOverdraftLimit(stub, args)
 	} else if function == "init" {
+		// Resets balances, so unlike the deploy time Init only admins may call it
 		fmt.Printf("Function is init")
+		if !isAdmin(stub) {
+			return nil, ccerror.New(ccerror.Forbidden, "", "Only admins may initialize accounts")
+		}
 		return t.Init(stub, function, args)
 	} else if function == "delete" {
 		// Deletes an entity from its state
@@ -161,19 +375,33 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function stri
 		return t.delete(stub, args)
 	}
 
-	return nil, errors.New("Received unknown function invocation")
+	return nil, ccerror.New(ccerror.InvalidArgument, "function", "Received unknown function invocation")
 }
 
-func (t* SimpleChaincode) Run(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+func (t* SimpleChaincode) Run(stub shim.ChaincodeStubInterface, function string, args []string) (payload []byte, err error) {
 	fmt.Printf("Run called, passing through to Invoke (same function)")
+
+	defer func() {
+		err = ccerror.WithTx(err, stub.GetTxID())
+	}()
 	
 	// Handle different functions
 	if function == "invoke" {
 		// Transaction makes payment of X units from A to B
 		fmt.Printf("Function is invoke")
 		return t.invoke(stub, args)
+	} else if function == "transferChecked" {
+		fmt.Printf("Function is transferChecked")
+		return t.transferChecked(stub, args)
+	} else if function == "setOverdraftLimit" {
+		fmt.Printf("Function is setOverdraftLimit")
+		return t.setOverdraftLimit(stub, args)
 	} else if function == "init" {
+		// Resets balances, so unlike the deploy time Init only admins may call it
 		fmt.Printf("Function is init")
+		if !isAdmin(stub) {
+			return nil, ccerror.New(ccerror.Forbidden, "", "Only admins may initialize accounts")
+		}
 		return t.Init(stub, function, args)
 	} else if function == "delete" {
 		// Deletes an entity from its state
@@ -181,22 +409,25 @@ func (t* SimpleChaincode) Run(stub shim.ChaincodeStubInterface, function string,
 		return t.delete(stub, args)
 	}
 
-	return nil, errors.New("Received unknown function invocation")
+	return nil, ccerror.New(ccerror.InvalidArgument, "function", "Received unknown function invocation")
 }
 
 // Query callback representing the query of a chaincode
-func (t *SimpleChaincode) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+func (t *SimpleChaincode) Query(stub shim.ChaincodeStubInterface, function string, args []string) (payload []byte, err error) {
 	fmt.Printf("Query called, determining function")
+
+	defer func() {
+		err = ccerror.WithTx(err, stub.GetTxID())
+	}()
 	
 	if function != "query" {
 		fmt.Printf("Function is query")
-		return nil, errors.New("Invalid query function name. Expecting \"query\"")
+		return nil, ccerror.New(ccerror.InvalidArgument, "function", "Invalid query function name. Expecting \"query\"")
 	}
 	var A string // Entities
-	var err error
 
 	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting name of the person to query")
+		return nil, ccerror.IncorrectArgs("name of the person to query")
 	}
 
 	A = args[0]
@@ -204,13 +435,11 @@ func (t *SimpleChaincode) Query(stub shim.ChaincodeStubInterface, function strin
 	// Get the state from the ledger
 	Avalbytes, err := stub.GetState(A)
 	if err != nil {
-		jsonResp := "{\"Error\":\"Failed to get state for " + A + "\"}"
-		return nil, errors.New(jsonResp)
+		return nil, ccerror.New(ccerror.Internal, "", "Failed to get state for %s", A)
 	}
 
 	if Avalbytes == nil {
-		jsonResp := "{\"Error\":\"Nil amount for " + A + "\"}"
-		return nil, errors.New(jsonResp)
+		return nil, ccerror.New(ccerror.NotFound, "name", "Nil amount for %s", A)
 	}
 
 	jsonResp := "{\"Name\":\"" + A + "\",\"Amount\":\"" + string(Avalbytes) + "\"}"
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/sahilsooryen/kyc_chaincode/ccerror"
+)
+
+// testStub is a MockStub whose caller has the given role and id
+type testStub struct {
+	*shim.MockStub
+	t    *testing.T
+	role string
+	id   string
+	txs  int
+}
+
+// Starts a ledger holding accounts a and b with the given balances. The
+// following calls are made by the owner of a.
+func newTestStub(t *testing.T, aval int64, bval int64) *testStub {
+	stub := &testStub{MockStub: shim.NewMockStub("test", new(SimpleChaincode)), t: t}
+	stub.as(adminRole, "admin").mustInvoke("init", "a", strconv.FormatInt(aval, 10), "b", strconv.FormatInt(bval, 10))
+	stub.as("user", "a")
+	return stub
+}
+
+// Makes the following calls with the given role and id
+func (stub *testStub) as(role string, id string) *testStub {
+	stub.role = role
+	stub.id = id
+	return stub
+}
+
+func (stub *testStub) ReadCertAttribute(attributeName string) ([]byte, error) {
+	switch attributeName {
+	case roleAttribute:
+		return []byte(stub.role), nil
+	case idAttribute:
+		return []byte(stub.id), nil
+	}
+	return nil, nil
+}
+
+func (stub *testStub) invoke(function string, args ...string) ([]byte, error) {
+	stub.txs++
+	txId := "tx" + strconv.Itoa(stub.txs)
+	stub.MockTransactionStart(txId)
+	defer stub.MockTransactionEnd(txId)
+	return new(SimpleChaincode).Invoke(stub, function, args)
+}
+
+// Invokes a function that has to succeed
+func (stub *testStub) mustInvoke(function string, args ...string) []byte {
+	stub.t.Helper()
+	payload, err := stub.invoke(function, args...)
+	if err != nil {
+		stub.t.Fatalf("%s %v failed: %s", function, args, err)
+	}
+	return payload
+}
+
+// Fails the test unless the balances of a and b are as expected
+func (stub *testStub) expectBalances(aval int64, bval int64) {
+	stub.t.Helper()
+	for account, expected := range map[string]int64{"a": aval, "b": bval} {
+		payload, err := new(SimpleChaincode).Query(stub, "query", []string{account})
+		if err != nil {
+			stub.t.Fatalf("query %s failed: %s", account, err)
+		}
+		if balance, _ := strconv.ParseInt(string(payload), 10, 64); balance != expected {
+			stub.t.Errorf("balance of %s = %d, expected %d", account, balance, expected)
+		}
+	}
+}
+
+// Fails the test unless err is a chaincode error with the given code
+func expectCode(t *testing.T, err error, code ccerror.Code) {
+	t.Helper()
+	if err == nil {
+		t.Fatalf("expected %s, got no error", code)
+	}
+	if ccerror.CodeOf(err) != code {
+		t.Fatalf("expected %s, got %s", code, err)
+	}
+}
+
+func TestTransferChecked(t *testing.T) {
+	stub := newTestStub(t, 100, 50)
+
+	result := TransferResult{}
+	json.Unmarshal(stub.mustInvoke("transferChecked", "a", "b", "30"), &result)
+	if result.Amount != 30 || result.From != (AccountBalance{"a", 70}) || result.To != (AccountBalance{"b", 80}) {
+		t.Errorf("result = %+v", result)
+	}
+	stub.as("user", "b").mustInvoke("invoke", "b", "a", "80")
+	stub.expectBalances(150, 0)
+}
+
+func TestTransferNeedsTheOwnerOrAnAdmin(t *testing.T) {
+	stub := newTestStub(t, 100, 50)
+
+	stub.as("user", "b")
+	_, err := stub.invoke("invoke", "a", "b", "10")
+	expectCode(t, err, ccerror.Forbidden)
+	_, err = stub.invoke("transferChecked", "a", "b", "10")
+	expectCode(t, err, ccerror.Forbidden)
+	_, err = stub.invoke("init", "a", "0", "b", "150")
+	expectCode(t, err, ccerror.Forbidden)
+	_, err = stub.invoke("delete", "a")
+	expectCode(t, err, ccerror.Forbidden)
+	stub.expectBalances(100, 50)
+
+	stub.as(adminRole, "admin").mustInvoke("invoke", "a", "b", "10")
+	stub.expectBalances(90, 60)
+}
+
+func TestTransferRejectsOverflow(t *testing.T) {
+	stub := newTestStub(t, 10, math.MaxInt64-5)
+
+	_, err := stub.invoke("invoke", "a", "b", "10")
+	expectCode(t, err, ccerror.Conflict)
+	stub.expectBalances(10, math.MaxInt64-5)
+
+	// An overdrawn account cannot wrap around by sending close to MaxInt64
+	stub = newTestStub(t, 10, 0)
+	stub.as(adminRole, "admin").mustInvoke("setOverdraftLimit", "a", "100")
+	stub.as("user", "a").mustInvoke("invoke", "a", "b", "50")
+	_, err = stub.invoke("invoke", "a", "b", strconv.FormatInt(math.MaxInt64, 10))
+	expectCode(t, err, ccerror.Conflict)
+	stub.expectBalances(-40, 50)
+}
+
+func TestTransferRespectsOverdraftLimit(t *testing.T) {
+	stub := newTestStub(t, 10, 0)
+
+	_, err := stub.invoke("invoke", "a", "b", "11")
+	expectCode(t, err, ccerror.Conflict)
+
+	_, err = stub.invoke("setOverdraftLimit", "a", "5")
+	expectCode(t, err, ccerror.Forbidden)
+	stub.as(adminRole, "admin")
+	_, err = stub.invoke("setOverdraftLimit", "a", "-1")
+	expectCode(t, err, ccerror.InvalidArgument)
+	_, err = stub.invoke("setOverdraftLimit", "c", "5")
+	expectCode(t, err, ccerror.NotFound)
+	stub.mustInvoke("setOverdraftLimit", "a", "5")
+
+	stub.mustInvoke("invoke", "a", "b", "15")
+	stub.expectBalances(-5, 15)
+	_, err = stub.invoke("invoke", "a", "b", "1")
+	expectCode(t, err, ccerror.Conflict)
+
+	// Deleting an account drops its limit with it
+	stub.mustInvoke("delete", "a")
+	stub.mustInvoke("init", "a", "0", "b", "15")
+	_, err = stub.invoke("invoke", "a", "b", "1")
+	expectCode(t, err, ccerror.Conflict)
+}
+
+func TestTransferValidatesArguments(t *testing.T) {
+	stub := newTestStub(t, 10, 10)
+
+	for _, test := range []struct {
+		args []string
+		code ccerror.Code
+	}{
+		{[]string{"a", "b"}, ccerror.InvalidArgument},
+		{[]string{"", "b", "1"}, ccerror.InvalidArgument},
+		{[]string{"a", "\x00OverdraftLimit\x00a", "1"}, ccerror.InvalidArgument},
+		{[]string{"a", "a", "1"}, ccerror.InvalidArgument},
+		{[]string{"a", "b", "one"}, ccerror.InvalidArgument},
+		{[]string{"a", "b", "1.5"}, ccerror.InvalidArgument},
+		{[]string{"a", "b", "99999999999999999999"}, ccerror.InvalidArgument},
+		{[]string{"a", "b", "0"}, ccerror.InvalidArgument},
+		{[]string{"a", "b", "-1"}, ccerror.InvalidArgument},
+		{[]string{"a", "c", "1"}, ccerror.NotFound},
+	} {
+		_, err := stub.invoke("invoke", test.args...)
+		expectCode(t, err, test.code)
+	}
+	stub.expectBalances(10, 10)
+
+	for _, args := range [][]string{
+		{"a", "1", "a", "1"},
+		{"a", "-1", "b", "1"},
+		{"a", "1", "", "1"},
+		{"a", "x", "b", "1"},
+	} {
+		_, err := stub.as(adminRole, "admin").invoke("init", args...)
+		expectCode(t, err, ccerror.InvalidArgument)
+	}
+}